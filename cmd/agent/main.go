@@ -4,11 +4,16 @@ import (
 	"context"
 	"errors"
 	"flag"
+	"fmt"
+	"strconv"
+	"strings"
 
 	"github.com/caarlos0/env"
 
 	monitor "github.com/a-tho/monitor/internal"
+	"github.com/a-tho/monitor/pkg/encryption"
 	"github.com/a-tho/monitor/pkg/telemetry"
+	"github.com/a-tho/monitor/pkg/tlsconfig"
 )
 
 type Config struct {
@@ -17,6 +22,14 @@ type Config struct {
 	Report    int    `env:"REPORT_INTERVAL"`
 	Key       string `env:"KEY"`
 	RateLimit int    `env:"RATE_LIMIT"`
+	Buckets   string `env:"BUCKETS"`
+	TLS       bool   `env:"TLS"`
+	TLSCA     string `env:"TLS_CA"`
+	TLSCert   string `env:"TLS_CERT"`
+	TLSKey    string `env:"TLS_KEY"`
+	CryptoKey string `env:"CRYPTO_KEY"`
+	KeyID     string `env:"KEY_ID"`
+	Token     string `env:"TOKEN"`
 }
 
 func main() {
@@ -31,9 +44,31 @@ func run() error {
 		return err
 	}
 
+	buckets, err := parseBuckets(cfg.Buckets)
+	if err != nil {
+		return err
+	}
+
 	ctx := context.Background()
-	var obs monitor.Observer = telemetry.NewObserver(cfg.SrvAddr, cfg.Poll, cfg.Report/cfg.Poll, cfg.Key, cfg.RateLimit)
-	if err := obs.Observe(ctx); err != nil {
+	obs, err := telemetry.NewObserver(cfg.SrvAddr, cfg.Poll, cfg.Report/cfg.Poll, cfg.Key, cfg.RateLimit, buckets)
+	if err != nil {
+		return fmt.Errorf("k: %w", err)
+	}
+	// Any TLS setting implies https
+	if cfg.TLS || cfg.TLSCA != "" || cfg.TLSCert != "" {
+		if obs.TLSConfig, err = tlsconfig.Client(cfg.TLSCA, cfg.TLSCert, cfg.TLSKey); err != nil {
+			return err
+		}
+	}
+	if cfg.CryptoKey != "" {
+		if obs.PublicKey, err = encryption.LoadPublicKey(cfg.CryptoKey); err != nil {
+			return err
+		}
+	}
+	obs.KeyID = cfg.KeyID
+	obs.Token = cfg.Token
+	var observer monitor.Observer = obs
+	if err := observer.Observe(ctx); err != nil {
 		return err
 	}
 
@@ -46,6 +81,14 @@ func parseConfig(cfg *Config) error {
 	flag.IntVar(&cfg.Report, "r", 10, "rate of reporting metrics in seconds")
 	flag.StringVar(&cfg.Key, "k", "", "key to sign requests with")
 	flag.IntVar(&cfg.RateLimit, "l", 5, "max number of outgoing requests")
+	flag.StringVar(&cfg.Buckets, "buckets", "", "comma-separated histogram bucket upper bounds in seconds")
+	flag.BoolVar(&cfg.TLS, "tls", false, "report over https, verifying the server against the system authorities unless tls-ca is set")
+	flag.StringVar(&cfg.TLSCA, "tls-ca", "", "PEM authorities to verify the server certificate with")
+	flag.StringVar(&cfg.TLSCert, "tls-cert", "", "PEM client certificate for mutual TLS")
+	flag.StringVar(&cfg.TLSKey, "tls-key", "", "PEM key of the client certificate")
+	flag.StringVar(&cfg.CryptoKey, "crypto-key", "", "PEM RSA public key of the server to encrypt batches with")
+	flag.StringVar(&cfg.KeyID, "key-id", "", "ID of the key k on the server, its primary key if empty")
+	flag.StringVar(&cfg.Token, "token", "", "bearer token with the write scope, if the server requires tokens")
 	flag.Parse()
 
 	// Both poll/report intervals must be positive, report interval has to be
@@ -59,5 +102,30 @@ func parseConfig(cfg *Config) error {
 		return err
 	}
 
+	if (cfg.TLSCert == "") != (cfg.TLSKey == "") {
+		return errors.New("tls-cert and tls-key go together")
+	}
+
 	return nil
 }
+
+// parseBuckets parses comma-separated increasing bucket upper bounds. An empty
+// string means the default buckets.
+func parseBuckets(s string) ([]float64, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	var buckets []float64
+	for _, field := range strings.Split(s, ",") {
+		b, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bucket %q: %w", field, err)
+		}
+		if len(buckets) > 0 && b <= buckets[len(buckets)-1] {
+			return nil, errors.New("buckets must be increasing")
+		}
+		buckets = append(buckets, b)
+	}
+	return buckets, nil
+}
@@ -2,15 +2,30 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
+	"net"
 	"net/http"
 	_ "net/http/pprof"
-	"os"
 	"os/signal"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 
+	"github.com/rs/zerolog/log"
+
+	monitor "github.com/a-tho/monitor/internal"
 	"github.com/a-tho/monitor/internal/config"
+	"github.com/a-tho/monitor/pkg/audit"
+	"github.com/a-tho/monitor/pkg/encryption"
+	"github.com/a-tho/monitor/pkg/graphite"
+	mw "github.com/a-tho/monitor/pkg/middleware"
 	"github.com/a-tho/monitor/pkg/server"
+	"github.com/a-tho/monitor/pkg/statsd"
 	"github.com/a-tho/monitor/pkg/storage"
+	"github.com/a-tho/monitor/pkg/stream"
+	"github.com/a-tho/monitor/pkg/tlsconfig"
 )
 
 func main() {
@@ -31,31 +46,208 @@ func run() error {
 
 	cfg.Log()
 
-	ctx := context.Background()
-	cfg.Metrics, err = storage.New(ctx, cfg.DatabaseDSN, cfg.FileStoragePath, cfg.StoreInterval, cfg.Restore)
+	// One handler for every signal the server stops on
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	defer stop()
+
+	if cfg.MigrateOnly {
+		return storage.Migrate(ctx, cfg.StorageAddrs()[0])
+	}
+
+	var tlsCfg *tls.Config
+	if cfg.TLSCert != "" {
+		if tlsCfg, err = tlsconfig.Server(cfg.TLSCert, cfg.TLSKey, cfg.TLSClientCA); err != nil {
+			return err
+		}
+	}
+
+	srvOpts := []server.Option{}
+	keyring, err := cfg.Keyring()
+	if err != nil {
+		return err
+	}
+	if keyring != nil {
+		srvOpts = append(srvOpts, server.WithKeyring(keyring))
+	}
+	if cfg.CryptoKey != "" {
+		key, err := encryption.LoadPrivateKey(cfg.CryptoKey)
+		if err != nil {
+			return err
+		}
+		srvOpts = append(srvOpts, server.WithPrivateKey(key))
+	}
+	if cfg.TrustedSubnet != "" {
+		_, subnet, err := net.ParseCIDR(cfg.TrustedSubnet)
+		if err != nil {
+			return err
+		}
+		srvOpts = append(srvOpts, server.WithTrustedSubnet(subnet))
+	}
+	var proxies []*net.IPNet
+	if cfg.TrustedProxies != "" {
+		for _, cidr := range strings.Split(cfg.TrustedProxies, ",") {
+			_, proxy, err := net.ParseCIDR(strings.TrimSpace(cidr))
+			if err != nil {
+				return err
+			}
+			proxies = append(proxies, proxy)
+		}
+		srvOpts = append(srvOpts, server.WithTrustedProxies(proxies...))
+	}
+	influxTypes, err := monitor.ParseTypeMapping(cfg.InfluxTypes)
 	if err != nil {
 		return err
 	}
-	defer cfg.Metrics.Close()
+	srvOpts = append(srvOpts, server.WithTypeMapping(influxTypes))
+	graphiteTypes, err := monitor.ParseTypeMapping(cfg.GraphiteTypes)
+	if err != nil {
+		return err
+	}
+	if cfg.ClientRateLimit > 0 {
+		key := mw.ClientIP
+		if cfg.RateLimitBy == "real-ip" {
+			key = mw.RealIP(proxies)
+		}
+		srvOpts = append(srvOpts, server.WithRateLimit(mw.NewRateLimiter(cfg.ClientRateLimit, cfg.ClientBurst, key)))
+	}
+	srvOpts = append(srvOpts, server.WithBodyLimits(cfg.MaxBodySize, cfg.MaxInflatedSize))
+	if cfg.TokenFile != "" {
+		tokens, err := monitor.LoadTokenFile(cfg.TokenFile)
+		if err != nil {
+			return err
+		}
+		srvOpts = append(srvOpts, server.WithTokens(tokens))
+	}
+	if cfg.AuditFile != "" {
+		auditLog, err := audit.OpenFile(cfg.AuditFile, cfg.AuditMaxSize, cfg.AuditFiles)
+		if err != nil {
+			return err
+		}
+		// Deferred calls run once the server has shut down
+		defer auditLog.Close()
+		srvOpts = append(srvOpts, server.WithAuditLog(auditLog))
+	}
 
-	mux := server.NewServer(cfg.Metrics, cfg.Key)
+	opts := storage.Options{
+		StoreInterval:   cfg.StoreInterval,
+		Restore:         cfg.Restore,
+		RestoreSnapshot: cfg.RestoreSnapshot,
+		Snapshots:       cfg.Snapshots,
+		HistorySize:     cfg.HistorySize,
+	}
+	cfg.Metrics, err = storage.New(ctx, opts, cfg.StorageAddrs()...)
+	if err != nil {
+		return err
+	}
+
+	if cfg.DBTokens {
+		// The storage may have fallen back to a backend without tokens
+		tokens, ok := cfg.Metrics.(monitor.TokenStore)
+		if !ok {
+			cfg.Metrics.Close()
+			return errors.New("db-tokens requires the Postgres storage")
+		}
+		srvOpts = append(srvOpts, server.WithTokens(tokens))
+	}
+	if cfg.DBAudit {
+		auditLog, ok := cfg.Metrics.(monitor.AuditLog)
+		if !ok {
+			cfg.Metrics.Close()
+			return errors.New("db-audit requires the Postgres storage")
+		}
+		srvOpts = append(srvOpts, server.WithAuditLog(auditLog))
+	}
+
+	if cfg.GaugeTTL > 0 {
+		go storage.ExpireGauges(ctx, cfg.Metrics, time.Duration(cfg.GaugeTTL)*time.Second)
+	}
+
+	// Listeners stop with ctx, and are done once they have flushed
+	var serves []func(context.Context) error
+	if cfg.StatsDAddr != "" {
+		l, err := statsd.Listen(cfg.StatsDAddr, cfg.Metrics, time.Duration(cfg.StatsDFlush)*time.Second, nil)
+		if err != nil {
+			cfg.Metrics.Close()
+			return err
+		}
+		serves = append(serves, l.Serve)
+	}
+	if cfg.GraphiteAddr != "" {
+		l, err := graphite.Listen(cfg.GraphiteAddr, cfg.Metrics, graphiteTypes)
+		if err != nil {
+			cfg.Metrics.Close()
+			return err
+		}
+		serves = append(serves, l.Serve)
+	}
+	var listeners sync.WaitGroup
+	for _, serve := range serves {
+		listeners.Add(1)
+		go func(serve func(context.Context) error) {
+			defer listeners.Done()
+			if err := serve(ctx); err != nil {
+				log.Err(err).Msg("Listener failed")
+			}
+		}(serve)
+	}
+
+	hub := stream.NewHub()
+	srvOpts = append(srvOpts, server.WithStreamHub(hub))
+	srv := &http.Server{
+		Addr:      cfg.SrvAddr,
+		Handler:   server.NewServer(cfg.Metrics, cfg.Key, srvOpts...),
+		TLSConfig: tlsCfg,
+	}
+	// Streams never complete on their own, so end them as shutdown begins
+	srv.RegisterOnShutdown(hub.Close)
+	prof := &http.Server{Addr: cfg.ProfAddr}
+
+	errs := make(chan error, 2)
 	go func() {
-		if err := http.ListenAndServe(cfg.SrvAddr, mux); err != nil {
-			panic(err)
+		var err error
+		if srv.TLSConfig != nil {
+			err = srv.ListenAndServeTLS("", "") // certificates are in the config
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if !errors.Is(err, http.ErrServerClosed) {
+			errs <- err
 		}
 	}()
-
 	go func() {
-		if err := http.ListenAndServe(cfg.ProfAddr, nil); err != nil {
-			panic(err)
+		if err := prof.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			errs <- err
 		}
 	}()
 
-	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, syscall.SIGINT)
-	signal.Notify(quit, syscall.SIGQUIT)
+	select {
+	case <-ctx.Done():
+		log.Info().Msg("Shutting down")
+	case err = <-errs:
+		log.Err(err).Msg("Server failed, shutting down")
+	}
+	stop()
 
-	<-quit
+	// Let in-flight requests complete before the storage is flushed
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.ShutdownTimeout)*time.Second)
+	defer cancel()
+	if shutdownErr := srv.Shutdown(shutdownCtx); shutdownErr != nil {
+		log.Err(shutdownErr).Msg("Failed to shut down server gracefully")
+		if err == nil {
+			err = shutdownErr
+		}
+	}
+	if shutdownErr := prof.Shutdown(shutdownCtx); shutdownErr != nil {
+		log.Err(shutdownErr).Msg("Failed to shut down profiling server gracefully")
+	}
 
-	return nil
+	listeners.Wait()
+
+	if closeErr := cfg.Metrics.Close(); closeErr != nil {
+		log.Err(closeErr).Msg("Failed to close storage")
+		if err == nil {
+			err = closeErr
+		}
+	}
+	return err
 }
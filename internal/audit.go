@@ -0,0 +1,76 @@
+package monitor
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// An AuditRecord tells who wrote a series and how its value changed.
+type AuditRecord struct {
+	Time time.Time `json:"time"`
+	// The client identity: the address it connects from, the address it
+	// claims in the X-Real-IP header, the ID of the key it signed with, and
+	// the name of its bearer token
+	IP     string `json:"ip"`
+	RealIP string `json:"real_ip,omitempty"`
+	KeyID  string `json:"key_id,omitempty"`
+	Token  string `json:"token,omitempty"`
+
+	ID    string      `json:"id"` // series key
+	MType string      `json:"type"`
+	Old   *AuditValue `json:"old,omitempty"` // nil if the series was new
+	New   *AuditValue `json:"new,omitempty"`
+}
+
+// An AuditValue is the stored value of a series of any type. Counters hold
+// the accumulated value, not the increment.
+type AuditValue struct {
+	Delta     *int64     `json:"delta,omitempty"`
+	Value     *float64   `json:"value,omitempty"`
+	Histogram *Histogram `json:"histogram,omitempty"`
+	Summary   *Summary   `json:"summary,omitempty"`
+}
+
+// A Change is the stored value of a series before and after an update, Old
+// being nil if the series was new.
+type Change struct {
+	Old, New *AuditValue
+}
+
+// An AuditQuery selects audit records.
+type AuditQuery struct {
+	// Metric is the metric name or series key of the records, any if empty
+	Metric string
+	// Prefix restricts the metric names of the records
+	Prefix string
+	// From and To bound the time of the records, To only if not zero
+	From, To time.Time
+	// Limit is the maximum number of records to return, unlimited if not
+	// positive
+	Limit int
+}
+
+// Matches tells whether the query selects the record.
+func (q AuditQuery) Matches(r AuditRecord) bool {
+	if q.Metric != "" && r.ID != q.Metric {
+		name, _, err := ParseSeriesKey(r.ID)
+		if err != nil || name != q.Metric {
+			return false
+		}
+	}
+	if !strings.HasPrefix(r.ID, q.Prefix) {
+		return false
+	}
+	if r.Time.Before(q.From) {
+		return false
+	}
+	return q.To.IsZero() || !r.Time.After(q.To)
+}
+
+// An AuditLog keeps audit records. Audit appends records, and AuditTrail
+// returns the records selected by a query, oldest first.
+type AuditLog interface {
+	Audit(ctx context.Context, records ...AuditRecord) error
+	AuditTrail(ctx context.Context, q AuditQuery) ([]AuditRecord, error)
+}
@@ -0,0 +1,35 @@
+package monitor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuditQueryMatches(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	record := AuditRecord{Time: now, ID: `app.load{cpu="0"}`, MType: "gauge"}
+
+	tests := []struct {
+		name string
+		q    AuditQuery
+		want bool
+	}{
+		{name: "any", q: AuditQuery{}, want: true},
+		{name: "metric name", q: AuditQuery{Metric: "app.load"}, want: true},
+		{name: "series key", q: AuditQuery{Metric: `app.load{cpu="0"}`}, want: true},
+		{name: "other series", q: AuditQuery{Metric: `app.load{cpu="1"}`}, want: false},
+		{name: "other metric", q: AuditQuery{Metric: "app"}, want: false},
+		{name: "prefix", q: AuditQuery{Prefix: "app."}, want: true},
+		{name: "other prefix", q: AuditQuery{Prefix: "db."}, want: false},
+		{name: "within range", q: AuditQuery{From: now, To: now}, want: true},
+		{name: "before range", q: AuditQuery{From: now.Add(time.Second)}, want: false},
+		{name: "after range", q: AuditQuery{To: now.Add(-time.Second)}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.q.Matches(record))
+		})
+	}
+}
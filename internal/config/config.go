@@ -1,11 +1,14 @@
 package config
 
 import (
+	"errors"
 	"flag"
+	"net/url"
 	"os"
 	"time"
 
 	monitor "github.com/a-tho/monitor/internal"
+	mw "github.com/a-tho/monitor/pkg/middleware"
 
 	"github.com/caarlos0/env"
 	"github.com/rs/zerolog"
@@ -14,38 +17,161 @@ import (
 
 type Config struct {
 	// Flags
-	SrvAddr         string `env:"ADDRESS"`
-	ProfAddr        string `env:"PROF_ADDRESS"`
-	LogLevel        string `env:"LOG_LEVEL"`
-	LogFormat       string `env:"LOG_FORMAT"`
-	StoreInterval   int    `env:"STORE_INTERVAL"`
-	FileStoragePath string `env:"FILE_STORAGE_PATH"`
-	Restore         bool   `env:"RESTORE"`
-	Key             string `env:"KEY"`
+	SrvAddr         string  `env:"ADDRESS"`
+	ProfAddr        string  `env:"PROF_ADDRESS"`
+	LogLevel        string  `env:"LOG_LEVEL"`
+	LogFormat       string  `env:"LOG_FORMAT"`
+	StoreInterval   int     `env:"STORE_INTERVAL"`
+	FileStoragePath string  `env:"FILE_STORAGE_PATH"`
+	Restore         bool    `env:"RESTORE"`
+	RestoreSnapshot string  `env:"RESTORE_SNAPSHOT"`
+	Snapshots       int     `env:"SNAPSHOTS"`
+	Key             string  `env:"KEY"`
+	HistorySize     int     `env:"HISTORY_SIZE"`
+	GaugeTTL        int     `env:"GAUGE_TTL"`
+	ShutdownTimeout int     `env:"SHUTDOWN_TIMEOUT"`
+	TLSCert         string  `env:"TLS_CERT"`
+	TLSKey          string  `env:"TLS_KEY"`
+	TLSClientCA     string  `env:"TLS_CLIENT_CA"`
+	CryptoKey       string  `env:"CRYPTO_KEY"`
+	TrustedSubnet   string  `env:"TRUSTED_SUBNET"`
+	TrustedProxies  string  `env:"TRUSTED_PROXIES"`
+	StatsDAddr      string  `env:"STATSD_ADDRESS"`
+	StatsDFlush     int     `env:"STATSD_FLUSH_INTERVAL"`
+	GraphiteAddr    string  `env:"GRAPHITE_ADDRESS"`
+	GraphiteTypes   string  `env:"GRAPHITE_TYPE_MAPPING"`
+	InfluxTypes     string  `env:"INFLUX_TYPE_MAPPING"`
+	ClientRateLimit float64 `env:"CLIENT_RATE_LIMIT"`
+	ClientBurst     int     `env:"CLIENT_BURST"`
+	RateLimitBy     string  `env:"RATE_LIMIT_BY"`
+	MaxBodySize     int64   `env:"MAX_BODY_SIZE"`
+	MaxInflatedSize int64   `env:"MAX_INFLATED_SIZE"`
+	Keys            string  `env:"KEYS"`
+	PrimaryKeyID    string  `env:"PRIMARY_KEY_ID"`
+	StrictSigning   bool    `env:"STRICT_SIGNING"`
+	ReplayWindow    int     `env:"REPLAY_WINDOW"`
+	TokenFile       string  `env:"TOKEN_FILE"`
+	DBTokens        bool    `env:"DB_TOKENS"`
+	AuditFile       string  `env:"AUDIT_FILE"`
+	AuditMaxSize    int64   `env:"AUDIT_MAX_SIZE"`
+	AuditFiles      int     `env:"AUDIT_FILES"`
+	DBAudit         bool    `env:"DB_AUDIT"`
 
 	// Storage
 	Metrics     monitor.MetricRepo
 	DatabaseDSN string `env:"DATABASE_DSN"`
+	StorageAddr string `env:"STORAGE_ADDRESS"`
+	MigrateOnly bool   `env:"MIGRATE_ONLY"`
 }
 
 func (c *Config) ParseConfig() error {
 	flag.StringVar(&c.SrvAddr, "a", "localhost:8080", "address and port to run server")
 	flag.StringVar(&c.ProfAddr, "p", "localhost:9090", "address and port to expose profile")
 	flag.StringVar(&c.LogLevel, "log", "debug", "log level")
-	flag.IntVar(&c.StoreInterval, "i", 300, "interval in seconds after which readings saved to disk")
+	flag.IntVar(&c.StoreInterval, "i", 300, "interval in seconds between snapshots of the write-ahead log, 0 to sync every update to disk")
 	flag.StringVar(&c.FileStoragePath, "f", "/tmp/metrics-db.json", "file where to save current values")
 	flag.BoolVar(&c.Restore, "r", true, "whether or not to load previously saved values on server start")
+	flag.StringVar(&c.RestoreSnapshot, "restore-snapshot", "", "snapshot file or timestamp to restore instead of the latest values")
+	flag.IntVar(&c.Snapshots, "snapshots", 5, "number of timestamped snapshots to keep")
 	flag.StringVar(&c.Key, "k", "", "key to verify/sign requests/responses with")
+	flag.IntVar(&c.HistorySize, "history", 1000, "number of recent values kept per metric in memory")
+	flag.IntVar(&c.GaugeTTL, "gauge-ttl", 0, "seconds after which gauges not updated are removed, 0 to keep them forever")
+	flag.IntVar(&c.ShutdownTimeout, "shutdown-timeout", 10, "seconds to let in-flight requests complete on shutdown")
+	flag.StringVar(&c.TLSCert, "tls-cert", "", "PEM certificate to serve over TLS, plain HTTP if empty")
+	flag.StringVar(&c.TLSKey, "tls-key", "", "PEM key of the TLS certificate")
+	flag.StringVar(&c.TLSClientCA, "tls-client-ca", "", "PEM authorities client certificates must be issued by, enables mutual TLS")
+	flag.StringVar(&c.CryptoKey, "crypto-key", "", "PEM RSA private key to decrypt batches with")
+	flag.StringVar(&c.TrustedSubnet, "t", "", "CIDR of the clients allowed to write metrics, everyone if empty; the connection address is checked unless it is a trusted proxy")
+	flag.StringVar(&c.TrustedProxies, "trusted-proxies", "", "comma-separated CIDRs of the proxies whose X-Real-IP header t checks instead of their own address; they must set the header")
+	flag.StringVar(&c.StatsDAddr, "statsd", "", "UDP address and port to receive StatsD metrics on, disabled if empty")
+	flag.IntVar(&c.StatsDFlush, "statsd-flush", 1, "interval in seconds between writes of the received StatsD metrics")
+	flag.StringVar(&c.GraphiteAddr, "graphite", "", "TCP address and port to receive Graphite plaintext metrics on, disabled if empty")
+	flag.StringVar(&c.GraphiteTypes, "graphite-type-mapping", "", "comma-separated pattern=type rules typing Graphite metrics, gauges by default")
+	flag.StringVar(&c.InfluxTypes, "influx-type-mapping", "", "comma-separated pattern=type rules typing InfluxDB line protocol metrics, gauges by default")
+	flag.Float64Var(&c.ClientRateLimit, "client-rate", 0, "requests per second allowed to each client, unlimited if 0")
+	flag.IntVar(&c.ClientBurst, "client-burst", 10, "requests each client may make at once")
+	flag.StringVar(&c.RateLimitBy, "rate-limit-by", "ip", "what tells clients apart for rate limiting: ip, or real-ip to take X-Real-IP from the trusted-proxies")
+	flag.Int64Var(&c.MaxBodySize, "max-body", 8<<20, "max bytes of a request body, unlimited if 0")
+	flag.Int64Var(&c.MaxInflatedSize, "max-inflated", 64<<20, "max bytes of a decompressed request body, unlimited if 0")
+	flag.StringVar(&c.Keys, "keys", "", "comma-separated id:base64 keys to verify/sign requests/responses with, along with k")
+	flag.StringVar(&c.PrimaryKeyID, "primary-key-id", "", "ID of the key for requests without a key ID, k if empty")
+	flag.BoolVar(&c.StrictSigning, "strict-signing", false, "reject writes that are not signed and stamped")
+	flag.IntVar(&c.ReplayWindow, "replay-window", 300, "seconds signed requests are accepted for after their timestamp")
+	flag.StringVar(&c.TokenFile, "token-file", "", "file of the bearer tokens required to access the server")
+	flag.BoolVar(&c.DBTokens, "db-tokens", false, "require the bearer tokens of the tokens table of the Postgres storage")
+	flag.StringVar(&c.AuditFile, "audit-file", "", "file to record metric writes to")
+	flag.Int64Var(&c.AuditMaxSize, "audit-max-size", 10<<20, "bytes of the audit file before it is rotated, 0 to never rotate")
+	flag.IntVar(&c.AuditFiles, "audit-files", 5, "number of rotated audit files to keep")
+	flag.BoolVar(&c.DBAudit, "db-audit", false, "record metric writes to the audit table of the Postgres storage")
 	flag.StringVar(&c.DatabaseDSN, "d", "", "database dsn")
+	flag.StringVar(&c.StorageAddr, "s", "", "storage address (memory://, file:///path, postgres://...), overrides d and f")
+	flag.BoolVar(&c.MigrateOnly, "migrate-only", false, "apply database migrations and exit")
 	flag.Parse()
 
 	if err := env.Parse(c); err != nil {
 		return err
 	}
 
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return errors.New("tls-cert and tls-key go together")
+	}
+	if c.TLSClientCA != "" && c.TLSCert == "" {
+		return errors.New("tls-client-ca requires tls-cert")
+	}
+	if c.RateLimitBy != "ip" && c.RateLimitBy != "real-ip" {
+		return errors.New("rate-limit-by must be ip or real-ip")
+	}
+	if c.TokenFile != "" && c.DBTokens {
+		return errors.New("token-file and db-tokens are exclusive")
+	}
+	if c.AuditFile != "" && c.DBAudit {
+		return errors.New("audit-file and db-audit are exclusive")
+	}
+
 	return nil
 }
 
+// Keyring returns the signing keyring, nil if there are no keys. The key k
+// goes without a key ID.
+func (c Config) Keyring() (*mw.Keyring, error) {
+	keys, err := mw.ParseKeys(c.Keys)
+	if err != nil {
+		return nil, err
+	}
+	key, err := mw.ParseKey(c.Key)
+	if err != nil {
+		return nil, err
+	}
+	if key != nil {
+		keys[""] = key
+	}
+	if len(keys) == 0 {
+		if c.StrictSigning {
+			return nil, errors.New("strict-signing requires keys")
+		}
+		return nil, nil
+	}
+	return mw.NewKeyring(keys, c.PrimaryKeyID, c.StrictSigning, time.Duration(c.ReplayWindow)*time.Second)
+}
+
+// StorageAddrs returns the storage addresses to try in order. An explicit
+// storage address is used as is, otherwise the database is preferred over the
+// file, and memory is the last resort.
+func (c Config) StorageAddrs() []string {
+	if c.StorageAddr != "" {
+		return []string{c.StorageAddr}
+	}
+
+	var addrs []string
+	if c.DatabaseDSN != "" {
+		addrs = append(addrs, c.DatabaseDSN)
+	}
+	if c.FileStoragePath != "" {
+		addrs = append(addrs, (&url.URL{Scheme: "file", Path: c.FileStoragePath}).String())
+	}
+	return append(addrs, "memory://")
+}
+
 func (c Config) InitLogger() {
 	level := zerolog.ErrorLevel
 	if newLevel, err := zerolog.ParseLevel(c.LogLevel); err == nil {
@@ -61,5 +187,35 @@ func (c Config) Log() {
 	log.Info().Int("StoreInterval", c.StoreInterval).Msg("")
 	log.Info().Str("FileStoragePath", c.FileStoragePath).Msg("")
 	log.Info().Bool("Restore", c.Restore).Msg("")
+	log.Info().Str("RestoreSnapshot", c.RestoreSnapshot).Msg("")
+	log.Info().Int("Snapshots", c.Snapshots).Msg("")
+	log.Info().Int("HistorySize", c.HistorySize).Msg("")
+	log.Info().Int("GaugeTTL", c.GaugeTTL).Msg("")
+	log.Info().Int("ShutdownTimeout", c.ShutdownTimeout).Msg("")
+	log.Info().Str("TLSCert", c.TLSCert).Msg("")
+	log.Info().Str("TLSClientCA", c.TLSClientCA).Msg("")
+	log.Info().Str("CryptoKey", c.CryptoKey).Msg("")
+	log.Info().Str("TrustedSubnet", c.TrustedSubnet).Msg("")
+	log.Info().Str("TrustedProxies", c.TrustedProxies).Msg("")
+	log.Info().Str("StatsDAddr", c.StatsDAddr).Msg("")
+	log.Info().Int("StatsDFlush", c.StatsDFlush).Msg("")
+	log.Info().Str("GraphiteAddr", c.GraphiteAddr).Msg("")
+	log.Info().Str("GraphiteTypes", c.GraphiteTypes).Msg("")
+	log.Info().Str("InfluxTypes", c.InfluxTypes).Msg("")
+	log.Info().Float64("ClientRateLimit", c.ClientRateLimit).Msg("")
+	log.Info().Int("ClientBurst", c.ClientBurst).Msg("")
+	log.Info().Str("RateLimitBy", c.RateLimitBy).Msg("")
+	log.Info().Int64("MaxBodySize", c.MaxBodySize).Msg("")
+	log.Info().Int64("MaxInflatedSize", c.MaxInflatedSize).Msg("")
+	log.Info().Str("PrimaryKeyID", c.PrimaryKeyID).Msg("")
+	log.Info().Bool("StrictSigning", c.StrictSigning).Msg("")
+	log.Info().Int("ReplayWindow", c.ReplayWindow).Msg("")
+	log.Info().Str("TokenFile", c.TokenFile).Msg("")
+	log.Info().Bool("DBTokens", c.DBTokens).Msg("")
+	log.Info().Str("AuditFile", c.AuditFile).Msg("")
+	log.Info().Int64("AuditMaxSize", c.AuditMaxSize).Msg("")
+	log.Info().Int("AuditFiles", c.AuditFiles).Msg("")
+	log.Info().Bool("DBAudit", c.DBAudit).Msg("")
 	log.Info().Str("DatabaseDSN", c.DatabaseDSN).Msg("")
+	log.Info().Str("StorageAddr", c.StorageAddr).Msg("")
 }
@@ -0,0 +1,172 @@
+package monitor
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// SummaryWindow is the number of most recent observations a summary keeps to
+// compute quantiles from.
+const SummaryWindow = 1024
+
+// ErrBucketMismatch is returned when histograms with different bucket layouts
+// are merged.
+var ErrBucketMismatch = errors.New("histogram buckets do not match")
+
+// DefaultBuckets are the histogram bucket upper bounds used unless configured
+// otherwise, suitable for latencies in seconds.
+func DefaultBuckets() []float64 {
+	return []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+}
+
+// DefaultQuantiles are the quantiles computed for summaries.
+func DefaultQuantiles() []float64 {
+	return []float64{0.5, 0.9, 0.99}
+}
+
+// A Histogram counts observations in buckets. Buckets holds the upper bounds
+// of the buckets in increasing order, and Counts the number of observations
+// in each bucket (not cumulative) with one extra bucket for the observations
+// above the last bound.
+type Histogram struct {
+	Buckets []float64 `json:"buckets"`
+	Counts  []uint64  `json:"counts"`
+	Sum     float64   `json:"sum"`
+	Count   uint64    `json:"count"`
+}
+
+// NewHistogram returns an empty histogram with the bucket upper bounds.
+func NewHistogram(buckets []float64) *Histogram {
+	return &Histogram{
+		Buckets: buckets,
+		Counts:  make([]uint64, len(buckets)+1),
+	}
+}
+
+// Observe adds the observation v to the histogram.
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.Buckets, v)
+	h.Counts[i]++
+	h.Sum += v
+	h.Count++
+}
+
+// Validate checks that the buckets are increasing and that the counts match
+// them.
+func (h *Histogram) Validate() error {
+	if len(h.Counts) != len(h.Buckets)+1 {
+		return fmt.Errorf("histogram has %d counts for %d buckets, want %d", len(h.Counts), len(h.Buckets), len(h.Buckets)+1)
+	}
+	for i := 1; i < len(h.Buckets); i++ {
+		if !(h.Buckets[i-1] < h.Buckets[i]) {
+			return errors.New("histogram buckets are not increasing")
+		}
+	}
+
+	var count uint64
+	for _, c := range h.Counts {
+		count += c
+	}
+	if count != h.Count {
+		return fmt.Errorf("histogram count %d differs from the sum of counts %d", h.Count, count)
+	}
+	return nil
+}
+
+// Merge adds the observations of o, which must be valid, to the histogram. An
+// empty histogram takes the buckets of o.
+func (h *Histogram) Merge(o Histogram) error {
+	if err := o.Validate(); err != nil {
+		return err
+	}
+	if h.Counts == nil {
+		h.Buckets = append([]float64(nil), o.Buckets...)
+		h.Counts = make([]uint64, len(o.Counts))
+	}
+	if len(h.Buckets) != len(o.Buckets) {
+		return ErrBucketMismatch
+	}
+	for i := range h.Buckets {
+		if h.Buckets[i] != o.Buckets[i] {
+			return ErrBucketMismatch
+		}
+	}
+
+	for i := range h.Counts {
+		h.Counts[i] += o.Counts[i]
+	}
+	h.Sum += o.Sum
+	h.Count += o.Count
+	return nil
+}
+
+// A Summary tracks the count and sum of observations and computes quantiles
+// over the most recent ones. Agents only send Observations, the server fills
+// in the rest.
+type Summary struct {
+	Observations []float64  `json:"observations,omitempty"`
+	Sum          float64    `json:"sum"`
+	Count        uint64     `json:"count"`
+	Quantiles    []Quantile `json:"quantiles,omitempty"`
+}
+
+// A Quantile is the value below which the given fraction of observations
+// falls.
+type Quantile struct {
+	Quantile float64 `json:"quantile"`
+	Value    float64 `json:"value"`
+}
+
+// Validate checks that the summary has observations and that they are
+// numbers.
+func (s *Summary) Validate() error {
+	if len(s.Observations) == 0 {
+		return errors.New("summary has no observations")
+	}
+	for _, v := range s.Observations {
+		if math.IsNaN(v) {
+			return errors.New("summary observation is NaN")
+		}
+	}
+	return nil
+}
+
+// Merge adds the observations of o to the summary, keeping at most window of
+// the most recent ones.
+func (s *Summary) Merge(o Summary, window int) {
+	for _, v := range o.Observations {
+		s.Sum += v
+	}
+	s.Count += uint64(len(o.Observations))
+
+	s.Observations = append(s.Observations, o.Observations...)
+	if extra := len(s.Observations) - window; extra > 0 {
+		s.Observations = append(s.Observations[:0], s.Observations[extra:]...)
+	}
+}
+
+// ComputeQuantiles fills in Quantiles from the kept observations using the
+// nearest-rank method.
+func (s *Summary) ComputeQuantiles(quantiles []float64) {
+	s.Quantiles = nil
+	if len(s.Observations) == 0 {
+		return
+	}
+
+	sorted := append([]float64(nil), s.Observations...)
+	sort.Float64s(sorted)
+
+	s.Quantiles = make([]Quantile, len(quantiles))
+	for i, q := range quantiles {
+		rank := int(math.Ceil(q*float64(len(sorted)))) - 1
+		if rank < 0 {
+			rank = 0
+		}
+		if rank >= len(sorted) {
+			rank = len(sorted) - 1
+		}
+		s.Quantiles[i] = Quantile{Quantile: q, Value: sorted[rank]}
+	}
+}
@@ -0,0 +1,81 @@
+package monitor
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHistogramMerge(t *testing.T) {
+	a := NewHistogram([]float64{1, 2})
+	a.Observe(0.5)
+	a.Observe(3)
+
+	b := NewHistogram([]float64{1, 2})
+	b.Observe(1.5)
+	require.NoError(t, b.Validate())
+
+	var merged Histogram
+	require.NoError(t, merged.Merge(*a))
+	require.NoError(t, merged.Merge(*b))
+	assert.Equal(t, []uint64{1, 1, 1}, merged.Counts)
+	assert.Equal(t, uint64(3), merged.Count)
+	assert.Equal(t, 5.0, merged.Sum)
+
+	other := NewHistogram([]float64{1, 5})
+	assert.ErrorIs(t, merged.Merge(*other), ErrBucketMismatch)
+	assert.Equal(t, uint64(3), merged.Count, "failed merge must not change the histogram")
+}
+
+func TestHistogramValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		h       Histogram
+		wantErr bool
+	}{
+		{
+			name: "valid",
+			h:    Histogram{Buckets: []float64{1}, Counts: []uint64{2, 1}, Count: 3},
+		},
+		{
+			name:    "missing +Inf bucket",
+			h:       Histogram{Buckets: []float64{1}, Counts: []uint64{3}, Count: 3},
+			wantErr: true,
+		},
+		{
+			name:    "buckets not increasing",
+			h:       Histogram{Buckets: []float64{2, 1}, Counts: []uint64{0, 0, 0}},
+			wantErr: true,
+		},
+		{
+			name:    "count mismatch",
+			h:       Histogram{Buckets: []float64{1}, Counts: []uint64{2, 1}, Count: 4},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.h.Validate()
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestSummaryQuantiles(t *testing.T) {
+	var s Summary
+	s.Merge(Summary{Observations: []float64{5, 1, 4}}, 4)
+	s.Merge(Summary{Observations: []float64{2, 3}}, 4)
+
+	assert.Equal(t, []float64{1, 4, 2, 3}, s.Observations)
+	assert.Equal(t, uint64(5), s.Count)
+	assert.Equal(t, 15.0, s.Sum)
+
+	s.ComputeQuantiles([]float64{0, 0.5, 1})
+	assert.Equal(t, []Quantile{{0, 1}, {0.5, 2}, {1, 4}}, s.Quantiles)
+}
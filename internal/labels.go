@@ -0,0 +1,288 @@
+package monitor
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// NameLabel is the pseudo-label that matchers use to select metrics by name.
+const NameLabel = "__name__"
+
+// Labels are the dimensions of a metric, e.g. {cpu="3"}. Metrics with the
+// same name but different labels are separate series.
+type Labels map[string]string
+
+// String formats the labels canonically, sorted by name and with quoted
+// values: {cpu="3",host="web"}. Empty labels format as an empty string.
+func (l Labels) String() string {
+	if len(l) == 0 {
+		return ""
+	}
+
+	names := make([]string, 0, len(l))
+	for name := range l {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteByte('=')
+		b.WriteString(strconv.Quote(l[name]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// Validate checks that every label name is a valid identifier.
+func (l Labels) Validate() error {
+	for name := range l {
+		if !labelNameRe.MatchString(name) || name == NameLabel {
+			return fmt.Errorf("invalid label name %q", name)
+		}
+	}
+	return nil
+}
+
+// SeriesKey identifies a series by the metric name followed by its canonical
+// labels, e.g. CPUutilization{cpu="3"}. Without labels the key is the name.
+func SeriesKey(name string, labels Labels) string {
+	return name + labels.String()
+}
+
+// ParseSeriesKey splits a series key into the metric name and labels. The
+// labels may come in any order and need not be canonical.
+func ParseSeriesKey(key string) (string, Labels, error) {
+	name, matchers, err := parseSelector(key)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var labels Labels
+	for _, m := range matchers {
+		if m.Op != MatchEqual {
+			return "", nil, fmt.Errorf("series key %q: labels must be set with %s", key, MatchEqual)
+		}
+		if labels == nil {
+			labels = make(Labels, len(matchers))
+		}
+		labels[m.Name] = m.Value
+	}
+	return name, labels, labels.Validate()
+}
+
+// Key returns the series key of the metric, see SeriesKey.
+func (m *Metrics) Key() string {
+	return SeriesKey(m.ID, m.Labels)
+}
+
+// Normalize moves labels written into the ID, as in CPUutilization{cpu="3"},
+// into Labels and validates them. Labels set explicitly take precedence.
+func (m *Metrics) Normalize() error {
+	name, labels, err := ParseSeriesKey(m.ID)
+	if err != nil {
+		return err
+	}
+	if name == "" {
+		return errors.New("empty metric name")
+	}
+	if err = m.Labels.Validate(); err != nil {
+		return err
+	}
+
+	for k, v := range m.Labels {
+		if labels == nil {
+			labels = make(Labels, len(m.Labels))
+		}
+		labels[k] = v
+	}
+	m.ID, m.Labels = name, labels
+	return nil
+}
+
+// MatchOp is the comparison a LabelMatcher applies to the label value.
+type MatchOp string
+
+// Label matching operators.
+const (
+	MatchEqual     MatchOp = "="
+	MatchNotEqual  MatchOp = "!="
+	MatchRegexp    MatchOp = "=~"
+	MatchNotRegexp MatchOp = "!~"
+)
+
+// A LabelMatcher selects series by the value of a label. A missing label has
+// an empty value.
+type LabelMatcher struct {
+	Name  string
+	Op    MatchOp
+	Value string
+	re    *regexp.Regexp
+}
+
+// NewLabelMatcher returns a matcher, compiling the value as an anchored
+// regular expression for the regexp operators.
+func NewLabelMatcher(name string, op MatchOp, value string) (LabelMatcher, error) {
+	m := LabelMatcher{Name: name, Op: op, Value: value}
+
+	switch op {
+	case MatchEqual, MatchNotEqual:
+	case MatchRegexp, MatchNotRegexp:
+		re, err := regexp.Compile("^(?:" + value + ")$")
+		if err != nil {
+			return m, err
+		}
+		m.re = re
+	default:
+		return m, fmt.Errorf("unknown match operator %q", op)
+	}
+	return m, nil
+}
+
+// Matches tells whether the label value v satisfies the matcher.
+func (m LabelMatcher) Matches(v string) bool {
+	switch m.Op {
+	case MatchEqual:
+		return v == m.Value
+	case MatchNotEqual:
+		return v != m.Value
+	case MatchRegexp:
+		return m.re.MatchString(v)
+	case MatchNotRegexp:
+		return !m.re.MatchString(v)
+	}
+	return false
+}
+
+// Prefix returns the literal prefix of the values a regexp matcher matches,
+// telling whether any value starting with it does, as for prefix.* patterns.
+func (m LabelMatcher) Prefix() (string, bool) {
+	if m.re == nil {
+		return "", false
+	}
+	return literalPrefix(m.re)
+}
+
+// literalPrefix returns the literal prefix of the strings matching the
+// anchored regular expression re, telling whether any string starting with
+// it does.
+func literalPrefix(re *regexp.Regexp) (string, bool) {
+	prefix, _ := re.LiteralPrefix()
+	return prefix, re.String() == "^(?:"+regexp.QuoteMeta(prefix)+".*)$"
+}
+
+// Matchers select series satisfying all of them.
+type Matchers []LabelMatcher
+
+// ParseMatchers parses a selector made of an optional metric name and label
+// matchers, e.g. CPUutilization{cpu=~"0|1",host!="web"}.
+func ParseMatchers(selector string) (Matchers, error) {
+	name, matchers, err := parseSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+	if name != "" {
+		matchers = append(matchers, LabelMatcher{Name: NameLabel, Op: MatchEqual, Value: name})
+	}
+	return matchers, nil
+}
+
+// MatchesLabels tells whether the series with the metric name and labels
+// satisfies all matchers.
+func (ms Matchers) MatchesLabels(name string, labels Labels) bool {
+	for _, m := range ms {
+		v := labels[m.Name]
+		if m.Name == NameLabel {
+			v = name
+		}
+		if !m.Matches(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// Matches tells whether the series identified by key satisfies all matchers.
+// Keys that fail to parse match nothing.
+func (ms Matchers) Matches(key string) bool {
+	if len(ms) == 0 {
+		return true
+	}
+	name, labels, err := ParseSeriesKey(key)
+	if err != nil {
+		return false
+	}
+	return ms.MatchesLabels(name, labels)
+}
+
+var labelNameRe = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// parseSelector parses name{label<op>"value",...}, both the name and the
+// braces being optional.
+func parseSelector(s string) (string, []LabelMatcher, error) {
+	open := strings.IndexByte(s, '{')
+	if open < 0 {
+		return strings.TrimSpace(s), nil, nil
+	}
+	name := strings.TrimSpace(s[:open])
+	rest := strings.TrimSpace(s[open+1:])
+
+	var matchers []LabelMatcher
+	for {
+		rest = strings.TrimLeft(rest, " ")
+		if strings.HasPrefix(rest, "}") {
+			if strings.TrimSpace(rest[1:]) != "" {
+				return "", nil, fmt.Errorf("selector %q: trailing characters", s)
+			}
+			return name, matchers, nil
+		}
+
+		// Label name
+		end := strings.IndexAny(rest, "=!~ ")
+		if end <= 0 {
+			return "", nil, fmt.Errorf("selector %q: expected label name", s)
+		}
+		label := rest[:end]
+		rest = strings.TrimLeft(rest[end:], " ")
+
+		// Operator
+		var op MatchOp
+		for _, candidate := range []MatchOp{MatchRegexp, MatchNotRegexp, MatchNotEqual, MatchEqual} {
+			if strings.HasPrefix(rest, string(candidate)) {
+				op = candidate
+				break
+			}
+		}
+		if op == "" {
+			return "", nil, fmt.Errorf("selector %q: expected operator after %s", s, label)
+		}
+		rest = strings.TrimLeft(rest[len(op):], " ")
+
+		// Quoted value
+		quoted, err := strconv.QuotedPrefix(rest)
+		if err != nil {
+			return "", nil, fmt.Errorf("selector %q: expected quoted value for %s", s, label)
+		}
+		value, _ := strconv.Unquote(quoted)
+		rest = strings.TrimLeft(rest[len(quoted):], " ")
+
+		m, err := NewLabelMatcher(label, op, value)
+		if err != nil {
+			return "", nil, fmt.Errorf("selector %q: %w", s, err)
+		}
+		matchers = append(matchers, m)
+
+		if strings.HasPrefix(rest, ",") {
+			rest = rest[1:]
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package monitor
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsNormalize(t *testing.T) {
+	tests := []struct {
+		name    string
+		metric  Metrics
+		wantKey string
+		wantErr bool
+	}{
+		{
+			name:    "no labels",
+			metric:  Metrics{ID: "Alloc"},
+			wantKey: "Alloc",
+		},
+		{
+			name:    "explicit labels",
+			metric:  Metrics{ID: "CPUutilization", Labels: Labels{"host": "web", "cpu": "3"}},
+			wantKey: `CPUutilization{cpu="3",host="web"}`,
+		},
+		{
+			name:    "labels in the name",
+			metric:  Metrics{ID: `CPUutilization{ host="web", cpu="3" }`},
+			wantKey: `CPUutilization{cpu="3",host="web"}`,
+		},
+		{
+			name:    "explicit labels take precedence",
+			metric:  Metrics{ID: `CPUutilization{cpu="3"}`, Labels: Labels{"cpu": "4"}},
+			wantKey: `CPUutilization{cpu="4"}`,
+		},
+		{
+			name:    "escaped value",
+			metric:  Metrics{ID: "Path", Labels: Labels{"dir": `C:\ "x"`}},
+			wantKey: `Path{dir="C:\\ \"x\""}`,
+		},
+		{
+			name:    "invalid label name",
+			metric:  Metrics{ID: "CPUutilization", Labels: Labels{"3cpu": "3"}},
+			wantErr: true,
+		},
+		{
+			name:    "matcher in the name",
+			metric:  Metrics{ID: `CPUutilization{cpu=~"3"}`},
+			wantErr: true,
+		},
+		{
+			name:    "unterminated labels",
+			metric:  Metrics{ID: `CPUutilization{cpu="3"`},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.metric.Normalize()
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			if assert.NoError(t, err) {
+				assert.Equal(t, tt.wantKey, tt.metric.Key())
+			}
+		})
+	}
+}
+
+func TestMatchersMatches(t *testing.T) {
+	keys := []string{
+		"Alloc",
+		`CPUutilization{cpu="0"}`,
+		`CPUutilization{cpu="1"}`,
+		`CPUutilization{cpu="12",host="db"}`,
+	}
+
+	tests := []struct {
+		name     string
+		selector string
+		want     []string
+	}{
+		{
+			name:     "everything",
+			selector: "",
+			want:     keys,
+		},
+		{
+			name:     "by name",
+			selector: "CPUutilization",
+			want:     keys[1:],
+		},
+		{
+			name:     "by label",
+			selector: `{cpu="1"}`,
+			want:     []string{keys[2]},
+		},
+		{
+			name:     "by regexp",
+			selector: `CPUutilization{cpu=~"1|12"}`,
+			want:     keys[2:],
+		},
+		{
+			name:     "by missing label",
+			selector: `CPUutilization{host!="db"}`,
+			want:     keys[1:3],
+		},
+		{
+			name:     "by negative regexp",
+			selector: `{__name__!~"CPU.*"}`,
+			want:     keys[:1],
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			matchers, err := ParseMatchers(tt.selector)
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			var got []string
+			for _, key := range keys {
+				if matchers.Matches(key) {
+					got = append(got, key)
+				}
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package monitor
+
+import (
+	"fmt"
+	"math"
+	"path"
+	"strings"
+)
+
+// A TypeMapping decides whether the values that ingestion protocols without
+// metric types deliver are gauges or counters. The first rule whose glob
+// pattern matches the metric name wins, and names no rule matches are gauges.
+// Counter values are increments, added to the stored counter.
+type TypeMapping []TypeRule
+
+// A TypeRule maps the metric names matching Pattern onto Type.
+type TypeRule struct {
+	Pattern string
+	Type    string
+}
+
+// ParseTypeMapping parses comma-separated pattern=type rules, e.g.
+// "*_total=counter,requests.*=counter".
+func ParseTypeMapping(s string) (TypeMapping, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	var m TypeMapping
+	for _, rule := range strings.Split(s, ",") {
+		pattern, typ, ok := strings.Cut(strings.TrimSpace(rule), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid type mapping rule %q", rule)
+		}
+		if typ != "gauge" && typ != "counter" {
+			return nil, fmt.Errorf("invalid type %q in mapping rule %q", typ, rule)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern in mapping rule %q: %w", rule, err)
+		}
+		m = append(m, TypeRule{Pattern: pattern, Type: typ})
+	}
+	return m, nil
+}
+
+// Type returns the type of the metric name.
+func (m TypeMapping) Type(name string) string {
+	for _, rule := range m {
+		if ok, _ := path.Match(rule.Pattern, name); ok {
+			return rule.Type
+		}
+	}
+	return "gauge"
+}
+
+// Metric returns the metric of the type name maps onto, with the value v.
+// Counters only take integral values.
+func (m TypeMapping) Metric(name string, labels Labels, v float64) (*Metrics, error) {
+	metric := &Metrics{ID: name, MType: m.Type(name), Labels: labels}
+	if metric.MType == "counter" {
+		if v != math.Trunc(v) || math.Abs(v) > math.MaxInt64 {
+			return nil, fmt.Errorf("counter %s: value %v is not an integer", name, v)
+		}
+		delta := int64(v)
+		metric.Delta = &delta
+		return metric, nil
+	}
+	metric.Value = &v
+	return metric, nil
+}
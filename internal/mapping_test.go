@@ -0,0 +1,45 @@
+package monitor
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTypeMapping(t *testing.T) {
+	m, err := ParseTypeMapping("*_total=counter, requests.*=counter,requests.latency=gauge")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: "http_requests_total", want: "counter"},
+		{name: "requests.count", want: "counter"},
+		{name: "requests.latency", want: "counter"}, // first rule wins
+		{name: "cpu.load", want: "gauge"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, m.Type(tt.name))
+		})
+	}
+
+	metric, err := m.Metric("http_requests_total", nil, 3)
+	require.NoError(t, err)
+	require.NotNil(t, metric.Delta)
+	assert.Equal(t, int64(3), *metric.Delta)
+	_, err = m.Metric("http_requests_total", nil, 3.5)
+	assert.Error(t, err)
+
+	metric, err = m.Metric("cpu.load", Labels{"cpu": "0"}, 0.5)
+	require.NoError(t, err)
+	require.NotNil(t, metric.Value)
+	assert.Equal(t, `cpu.load{cpu="0"}`, metric.Key())
+
+	for _, s := range []string{"cpu", "cpu=histogram", "[=gauge"} {
+		_, err := ParseTypeMapping(s)
+		assert.Error(t, err, s)
+	}
+}
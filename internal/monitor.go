@@ -2,39 +2,117 @@ package monitor
 
 import (
 	"context"
+	"errors"
 	"io"
+	"time"
 )
 
+// ErrNotFound is returned when a metric to act upon does not exist.
+var ErrNotFound = errors.New("metric not found")
+
 type Gauge float64
 
 type Counter int64
 
 type Metrics struct {
-	ID    string   `json:"id"`              // metric name
-	MType string   `json:"type"`            // parameter, taking a value of gauge or counter
-	Delta *int64   `json:"delta,omitempty"` // metric value in case of a counter
-	Value *float64 `json:"value,omitempty"` // metric value in case of a gauge
+	ID        string     `json:"id"`                  // metric name
+	MType     string     `json:"type"`                // parameter, taking a value of gauge, counter, histogram or summary
+	Delta     *int64     `json:"delta,omitempty"`     // metric value in case of a counter
+	Value     *float64   `json:"value,omitempty"`     // metric value in case of a gauge
+	Histogram *Histogram `json:"histogram,omitempty"` // metric value in case of a histogram
+	Summary   *Summary   `json:"summary,omitempty"`   // metric value in case of a summary
+	Labels    Labels     `json:"labels,omitempty"`    // metric dimensions
+	Time      *time.Time `json:"time,omitempty"`      // when the value was measured, its arrival if nil
+
+	// Shift has a committed gauge Value added to the stored one rather than
+	// replace it, as StatsD signed gauges do
+	Shift bool `json:"-"`
+}
+
+// SampledAt returns when the value was measured, t if that is not known.
+func (m *Metrics) SampledAt(t time.Time) time.Time {
+	if m.Time != nil {
+		return *m.Time
+	}
+	return t
+}
+
+// A Sample is a metric value recorded at a moment in time. For counters it
+// holds the accumulated value after the update, not the increment.
+type Sample struct {
+	Time  time.Time `json:"time"`
+	Delta *int64    `json:"delta,omitempty"` // metric value in case of a counter
+	Value *float64  `json:"value,omitempty"` // metric value in case of a gauge
 }
 
 // A MetricRepo is used for a single metric type (e.g. gauge or counter) and
-// stores a value for each metric name.
+// stores a value for each series, a series being identified by its key (see
+// SeriesKey). The batch methods take the key of each metric from Metrics.Key.
+// ApplyBatch applies metrics of any type all at once: either every metric is
+// applied or, on error, none of them.
+//
+// Delete removes the series k of the metric type mtype along with its history
+// and returns ErrNotFound if there is no such series, while DeleteBatch skips
+// missing ones. ExpireGauges removes the gauges last updated before the given
+// time and returns how many it removed.
+//
+// ClaimBatch claims the idempotency key of a batch about to be applied and
+// tells its state: BatchNew if the caller now holds the claim, BatchPending if
+// another caller does, and BatchApplied if the batch was applied recently.
+// The holder then applies the batch with CommitBatch, which marks the key
+// applied along with it, or gives the claim up with ReleaseBatch. CommitBatch
+// with an empty key is ApplyBatch, and it also returns how every item changed
+// its series, as seen while the batch applies.
+//
+// Query iterates over the gauges and counters selected by a compiled query
+// (see Query.Compile).
 type MetricRepo interface {
 	SetGauge(ctx context.Context, k string, v Gauge) (MetricRepo, error)
 	SetGaugeBatch(ctx context.Context, batch []*Metrics) (MetricRepo, error)
 	GetGauge(ctx context.Context, k string) (v Gauge, ok bool)
 	StringGauge(ctx context.Context) (string, error)
-	WriteAllGauge(ctx context.Context, wr io.Writer) error
+	WriteAllGauge(ctx context.Context, wr io.Writer, matchers ...LabelMatcher) error
+	GaugeHistory(ctx context.Context, k string, from, to time.Time) ([]Sample, error)
 
 	AddCounter(ctx context.Context, k string, v Counter) (MetricRepo, error)
 	AddCounterBatch(ctx context.Context, batch []*Metrics) (MetricRepo, error)
 	GetCounter(ctx context.Context, k string) (v Counter, ok bool)
 	StringCounter(ctx context.Context) (string, error)
-	WriteAllCounter(ctx context.Context, wr io.Writer) error
+	WriteAllCounter(ctx context.Context, wr io.Writer, matchers ...LabelMatcher) error
+	CounterHistory(ctx context.Context, k string, from, to time.Time) ([]Sample, error)
+
+	AddHistogram(ctx context.Context, k string, v Histogram) (MetricRepo, error)
+	GetHistogram(ctx context.Context, k string) (v Histogram, ok bool)
+
+	AddSummary(ctx context.Context, k string, v Summary) (MetricRepo, error)
+	GetSummary(ctx context.Context, k string) (v Summary, ok bool)
+
+	ApplyBatch(ctx context.Context, batch []*Metrics) (MetricRepo, error)
+
+	Delete(ctx context.Context, mtype, k string) (MetricRepo, error)
+	DeleteBatch(ctx context.Context, batch []*Metrics) (MetricRepo, error)
+	ExpireGauges(ctx context.Context, before time.Time) (int, error)
+
+	ClaimBatch(ctx context.Context, key string) (BatchState, error)
+	CommitBatch(ctx context.Context, key string, batch []*Metrics) ([]Change, error)
+	ReleaseBatch(ctx context.Context, key string) error
+
+	Query(ctx context.Context, q Query) (MetricIterator, error)
 
 	PingContext(ctx context.Context) error
 	Close() error
 }
 
+// BatchState is the state of the idempotency key of a batch.
+type BatchState int
+
+// Batch states, see MetricRepo.ClaimBatch.
+const (
+	BatchNew BatchState = iota
+	BatchPending
+	BatchApplied
+)
+
 // An Observer is used to collect and transmit metrics.
 type Observer interface {
 	Observe(ctx context.Context) error
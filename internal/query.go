@@ -0,0 +1,196 @@
+package monitor
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Query orders.
+const (
+	SortByName  = "name"
+	SortByValue = "value"
+)
+
+// A Query selects gauge and counter series for MetricRepo.Query.
+type Query struct {
+	// Types are the metric types to select (gauge, counter), all of them if
+	// empty.
+	Types []string
+	// Name is a glob pattern (see path.Match) the metric name must match,
+	// or a regular expression with NameRegexp set. Empty matches any name.
+	Name       string
+	NameRegexp bool
+	// Matchers further select series by their labels.
+	Matchers Matchers
+	// SortBy is SortByName (the default) to order series by key, or
+	// SortByValue. Ties are broken by key and then type.
+	SortBy string
+	Desc   bool
+	// After is the cursor of the last series of the previous page.
+	After *Cursor
+	// Limit is the maximum number of series to return, unlimited if not
+	// positive.
+	Limit int
+
+	nameRe *regexp.Regexp
+}
+
+// A Cursor is the position of a series in the order of a query.
+type Cursor struct {
+	Value float64 `json:"value,omitempty"`
+	Key   string  `json:"key"`
+	Type  string  `json:"type"`
+}
+
+// A MetricIterator goes through the series selected by a query, in the manner
+// of sql.Rows: Next advances to the next series, Metric returns it, and Err
+// tells why the iteration stopped early. Close must be called once done.
+type MetricIterator interface {
+	Next() bool
+	Metric() Metrics
+	Err() error
+	Close() error
+}
+
+// Compile validates the query and prepares its name pattern.
+func (q *Query) Compile() error {
+	for _, typ := range q.Types {
+		if typ != "gauge" && typ != "counter" {
+			return fmt.Errorf("query: unsupported metric type %q", typ)
+		}
+	}
+	switch q.SortBy {
+	case "":
+		q.SortBy = SortByName
+	case SortByName, SortByValue:
+	default:
+		return fmt.Errorf("query: unknown order %q", q.SortBy)
+	}
+
+	if q.Name == "" {
+		return nil
+	}
+	expr := q.Name
+	if !q.NameRegexp {
+		if _, err := path.Match(q.Name, ""); err != nil {
+			return fmt.Errorf("query: name pattern: %w", err)
+		}
+		expr = GlobToRegexp(q.Name)
+	}
+	re, err := regexp.Compile("^(?:" + expr + ")$")
+	if err != nil {
+		return fmt.Errorf("query: name pattern: %w", err)
+	}
+	q.nameRe = re
+	return nil
+}
+
+// HasType tells whether the query selects the metric type typ.
+func (q *Query) HasType(typ string) bool {
+	if len(q.Types) == 0 {
+		return true
+	}
+	for _, t := range q.Types {
+		if t == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// NamePrefix returns the literal prefix of the metric names the query
+// selects, telling whether any name starting with it is selected. The query
+// must be compiled.
+func (q *Query) NamePrefix() (string, bool) {
+	if q.nameRe == nil {
+		return "", true
+	}
+	return literalPrefix(q.nameRe)
+}
+
+// Matches tells whether the series of the metric type typ identified by name
+// and labels is selected, ignoring the order. The query must be compiled.
+func (q *Query) Matches(typ, name string, labels Labels) bool {
+	if !q.HasType(typ) {
+		return false
+	}
+	if q.nameRe != nil && !q.nameRe.MatchString(name) {
+		return false
+	}
+	return q.Matchers.MatchesLabels(name, labels)
+}
+
+// Less tells whether the series at cursor a comes before the one at b in the
+// order of the query.
+func (q *Query) Less(a, b Cursor) bool {
+	less := func() bool {
+		if q.SortBy == SortByValue && a.Value != b.Value {
+			return a.Value < b.Value
+		}
+		if a.Key != b.Key {
+			return a.Key < b.Key
+		}
+		return a.Type < b.Type
+	}
+	if q.Desc {
+		a, b = b, a
+	}
+	return less()
+}
+
+// ErrQueryValue is returned for series whose value cannot be ordered.
+var ErrQueryValue = errors.New("query: metric has no value")
+
+// CursorOf returns the cursor of the gauge or counter m.
+func CursorOf(m Metrics) (Cursor, error) {
+	c := Cursor{Key: m.Key(), Type: m.MType}
+	switch {
+	case m.Value != nil:
+		c.Value = *m.Value
+	case m.Delta != nil:
+		c.Value = float64(*m.Delta)
+	default:
+		return c, ErrQueryValue
+	}
+	return c, nil
+}
+
+// GlobToRegexp converts a glob pattern in the syntax of path.Match into an
+// equivalent regular expression.
+func GlobToRegexp(glob string) string {
+	var b strings.Builder
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteByte('.')
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+				b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+			}
+		case '[':
+			// Character classes share the syntax, up to the closing bracket
+			end := i + 1
+			for end < len(glob) && glob[end] != ']' {
+				if glob[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(glob) {
+				b.WriteString(`\[`)
+				continue
+			}
+			b.WriteString(glob[i : end+1])
+			i = end
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,75 @@
+package monitor
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGlobToRegexp(t *testing.T) {
+	tests := []struct {
+		glob    string
+		match   []string
+		noMatch []string
+	}{
+		{glob: "CPU*", match: []string{"CPU", "CPUutilization"}, noMatch: []string{"TotalCPU"}},
+		{glob: "Heap?nuse", match: []string{"HeapInuse"}, noMatch: []string{"HeapInnuse"}},
+		{glob: "a.b", match: []string{"a.b"}, noMatch: []string{"axb"}},
+		{glob: "[A-C]lloc", match: []string{"Alloc"}, noMatch: []string{"Dlloc"}},
+		{glob: "[^A]lloc", match: []string{"Blloc"}, noMatch: []string{"Alloc"}},
+		{glob: `\*`, match: []string{"*"}, noMatch: []string{"a"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.glob, func(t *testing.T) {
+			re, err := regexp.Compile("^(?:" + GlobToRegexp(tt.glob) + ")$")
+			require.NoError(t, err)
+			for _, s := range tt.match {
+				assert.True(t, re.MatchString(s), s)
+			}
+			for _, s := range tt.noMatch {
+				assert.False(t, re.MatchString(s), s)
+			}
+		})
+	}
+}
+
+func TestQueryLess(t *testing.T) {
+	a := Cursor{Value: 2, Key: "Apple", Type: "gauge"}
+	b := Cursor{Value: 1, Key: "Peach", Type: "gauge"}
+	c := Cursor{Value: 1, Key: "Peach", Type: "counter"}
+
+	byName := Query{SortBy: SortByName}
+	assert.True(t, byName.Less(a, b))
+	assert.True(t, byName.Less(c, b))
+
+	byValue := Query{SortBy: SortByValue, Desc: true}
+	assert.True(t, byValue.Less(a, b))
+	assert.True(t, byValue.Less(b, c))
+}
+
+func TestQueryNamePrefix(t *testing.T) {
+	tests := []struct {
+		name         string
+		wantPrefix   string
+		wantComplete bool
+	}{
+		{name: "", wantPrefix: "", wantComplete: true},
+		{name: "CPU*", wantPrefix: "CPU", wantComplete: true},
+		{name: "a.b*", wantPrefix: "a.b", wantComplete: true},
+		{name: "Heap?nuse", wantPrefix: "Heap", wantComplete: false},
+		{name: "*Alloc", wantPrefix: "", wantComplete: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := Query{Name: tt.name}
+			require.NoError(t, q.Compile())
+			prefix, complete := q.NamePrefix()
+			assert.Equal(t, tt.wantPrefix, prefix)
+			assert.Equal(t, tt.wantComplete, complete)
+		})
+	}
+}
@@ -0,0 +1,75 @@
+// Package rotate names, lists and prunes the timestamped copies of a file,
+// such as rotated logs and snapshots.
+package rotate
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// timeLayout formats the suffix of the copies, which sorts them
+// chronologically.
+const timeLayout = "20060102T150405.000000000Z"
+
+// Name returns the name of the copy of the file at path made at t.
+func Name(path string, t time.Time) string {
+	return path + "." + t.UTC().Format(timeLayout)
+}
+
+// IsSuffix tells whether s is the suffix of a copy.
+func IsSuffix(s string) bool {
+	_, err := time.Parse(timeLayout, s)
+	return err == nil
+}
+
+// List returns the copies of the file at path, oldest first.
+func List(path string) ([]string, error) {
+	matches, err := filepath.Glob(globEscape(path) + ".*")
+	if err != nil {
+		return nil, err
+	}
+
+	var copies []string
+	for _, match := range matches {
+		if IsSuffix(strings.TrimPrefix(match, path+".")) {
+			copies = append(copies, match)
+		}
+	}
+	sort.Strings(copies)
+	return copies, nil
+}
+
+// RemoveOld removes the copies of the file at path but the kept most recent
+// ones.
+func RemoveOld(path string, kept int) error {
+	copies, err := List(path)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for len(copies) > kept {
+		if err = os.Remove(copies[0]); err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, err)
+		}
+		copies = copies[1:]
+	}
+	return errors.Join(errs...)
+}
+
+// globEscape escapes the characters of path that filepath.Match treats
+// specially.
+func globEscape(path string) string {
+	var b strings.Builder
+	for _, r := range path {
+		if strings.ContainsRune(`*?[\`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
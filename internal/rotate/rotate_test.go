@@ -0,0 +1,38 @@
+package rotate
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRemoveOld(t *testing.T) {
+	// Glob metacharacters in the path are taken literally
+	path := filepath.Join(t.TempDir(), "metrics[1].json")
+	start := time.Date(2023, 8, 1, 0, 0, 0, 0, time.UTC)
+
+	var copies []string
+	for i := 0; i < 3; i++ {
+		name := Name(path, start.Add(time.Duration(i)*time.Second))
+		require.NoError(t, os.WriteFile(name, nil, 0o600))
+		copies = append(copies, name)
+	}
+	// Neither the file itself nor other suffixes are copies
+	require.NoError(t, os.WriteFile(path, nil, 0o600))
+	require.NoError(t, os.WriteFile(path+".tmp-1", nil, 0o600))
+
+	listed, err := List(path)
+	require.NoError(t, err)
+	assert.Equal(t, copies, listed)
+
+	require.NoError(t, RemoveOld(path, 1))
+	listed, err = List(path)
+	require.NoError(t, err)
+	assert.Equal(t, copies[2:], listed)
+	assert.FileExists(t, path)
+	assert.FileExists(t, path+".tmp-1")
+}
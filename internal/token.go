@@ -0,0 +1,160 @@
+package monitor
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// ErrUnknownToken is returned when a bearer token is not known to the store.
+var ErrUnknownToken = errors.New("unknown token")
+
+// A Scope is a kind of access a token grants.
+type Scope string
+
+// Token scopes. Read covers getting metric values and listings, write covers
+// updates, and admin covers everything along with deletion.
+const (
+	ScopeRead  Scope = "read"
+	ScopeWrite Scope = "write"
+	ScopeAdmin Scope = "admin"
+)
+
+// ParseScopes parses comma-separated scopes, e.g. "read,write".
+func ParseScopes(s string) ([]Scope, error) {
+	var scopes []Scope
+	for _, field := range strings.Split(s, ",") {
+		scope := Scope(strings.TrimSpace(field))
+		switch scope {
+		case ScopeRead, ScopeWrite, ScopeAdmin:
+		default:
+			return nil, fmt.Errorf("invalid scope %q", field)
+		}
+		scopes = append(scopes, scope)
+	}
+	return scopes, nil
+}
+
+// A Token is the access granted to the bearer of a secret. Name identifies the
+// token, not the secret, and Prefix restricts the metric names it acts upon.
+type Token struct {
+	Name   string
+	Scopes []Scope
+	Prefix string
+}
+
+// Has tells whether the token grants the scope.
+func (t Token) Has(scope Scope) bool {
+	for _, s := range t.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// Permits tells whether the token may act upon the metric name, or the series
+// key starting with it.
+func (t Token) Permits(name string) bool {
+	return strings.HasPrefix(name, t.Prefix)
+}
+
+// Matchers returns the matchers selecting the series the token may act upon,
+// none if it is not restricted.
+func (t Token) Matchers() Matchers {
+	if t.Prefix == "" {
+		return nil
+	}
+	// A quoted prefix always compiles
+	m, _ := NewLabelMatcher(NameLabel, MatchRegexp, regexp.QuoteMeta(t.Prefix)+".*")
+	return Matchers{m}
+}
+
+// A TokenStore looks tokens up by their secret, returning ErrUnknownToken
+// for unknown secrets.
+type TokenStore interface {
+	LookupToken(ctx context.Context, secret string) (Token, error)
+}
+
+// HashToken returns the hex encoded SHA-256 of the secret, which is what
+// token stores keep instead of the secret itself.
+func HashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// TokenFile holds tokens by the hash of their secret.
+type TokenFile map[string]Token
+
+// ParseTokens parses one token per line, made of its name, the hash of its
+// secret (see HashToken), comma-separated scopes and an optional metric name
+// prefix, separated by spaces. Blank lines and lines starting with # are
+// skipped.
+func ParseTokens(r io.Reader) (TokenFile, error) {
+	tokens := make(TokenFile)
+	names := make(map[string]bool)
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 3 && len(fields) != 4 {
+			return nil, fmt.Errorf("tokens: line %d: expected name, hash, scopes and optional prefix", n)
+		}
+		name, hash := fields[0], strings.ToLower(fields[1])
+		if b, err := hex.DecodeString(hash); err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("tokens: line %d: invalid SHA-256 hash", n)
+		}
+		scopes, err := ParseScopes(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("tokens: line %d: %w", n, err)
+		}
+		if names[name] {
+			return nil, fmt.Errorf("tokens: line %d: duplicate name %q", n, name)
+		}
+		if _, ok := tokens[hash]; ok {
+			return nil, fmt.Errorf("tokens: line %d: duplicate hash", n)
+		}
+
+		token := Token{Name: name, Scopes: scopes}
+		if len(fields) == 4 {
+			token.Prefix = fields[3]
+		}
+		tokens[hash] = token
+		names[name] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("tokens: %w", err)
+	}
+	return tokens, nil
+}
+
+// LoadTokenFile reads the tokens from the file at path (see ParseTokens).
+func LoadTokenFile(path string) (TokenFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseTokens(f)
+}
+
+// LookupToken returns the token of the secret.
+func (f TokenFile) LookupToken(_ context.Context, secret string) (Token, error) {
+	token, ok := f[HashToken(secret)]
+	if !ok {
+		return Token{}, ErrUnknownToken
+	}
+	return token, nil
+}
@@ -0,0 +1,73 @@
+package monitor
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTokens(t *testing.T) {
+	hash := HashToken("secret")
+
+	tests := []struct {
+		name    string
+		file    string
+		want    Token
+		wantErr bool
+	}{
+		{
+			name: "scopes and prefix",
+			file: "# dashboards\n\ngrafana " + hash + " read,write app.\n",
+			want: Token{Name: "grafana", Scopes: []Scope{ScopeRead, ScopeWrite}, Prefix: "app."},
+		},
+		{
+			name: "upper case hash",
+			file: "admin " + strings.ToUpper(hash) + " admin",
+			want: Token{Name: "admin", Scopes: []Scope{ScopeAdmin}},
+		},
+		{name: "missing scopes", file: "grafana " + hash, wantErr: true},
+		{name: "invalid scope", file: "grafana " + hash + " delete", wantErr: true},
+		{name: "invalid hash", file: "grafana secret read", wantErr: true},
+		{name: "duplicate name", file: "grafana " + hash + " read\ngrafana " + HashToken("other") + " read", wantErr: true},
+		{name: "duplicate hash", file: "grafana " + hash + " read\nagent " + hash + " write", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokens, err := ParseTokens(strings.NewReader(tt.file))
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			token, err := tokens.LookupToken(context.Background(), "secret")
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, token)
+
+			_, err = tokens.LookupToken(context.Background(), "other")
+			assert.ErrorIs(t, err, ErrUnknownToken)
+		})
+	}
+}
+
+func TestToken(t *testing.T) {
+	reader := Token{Scopes: []Scope{ScopeRead}, Prefix: "app."}
+	assert.True(t, reader.Has(ScopeRead))
+	assert.False(t, reader.Has(ScopeWrite))
+	assert.True(t, reader.Permits("app.load"))
+	assert.True(t, reader.Permits(`app.load{cpu="0"}`))
+	assert.False(t, reader.Permits("apps.load"))
+
+	ms := reader.Matchers()
+	assert.True(t, ms.Matches(`app.load{cpu="0"}`))
+	assert.False(t, ms.Matches("appXload"), "the prefix is not a pattern")
+
+	admin := Token{Scopes: []Scope{ScopeAdmin}}
+	assert.True(t, admin.Has(ScopeRead))
+	assert.True(t, admin.Has(ScopeWrite))
+	assert.True(t, admin.Permits("db.load"))
+	assert.Empty(t, admin.Matchers())
+}
@@ -0,0 +1,191 @@
+// Package audit implements an audit log kept in local files.
+package audit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	monitor "github.com/a-tho/monitor/internal"
+	"github.com/a-tho/monitor/internal/rotate"
+)
+
+// File is an audit log of JSON lines. Once the file grows past its maximum
+// size, it is renamed with a timestamp suffix and a new file is started,
+// keeping a number of the most recent rotated files.
+type File struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64
+	kept    int
+	f       *os.File
+	size    int64
+}
+
+// OpenFile opens the audit log at path for appending, rotating it past
+// maxSize bytes if positive and keeping kept rotated files.
+func OpenFile(path string, maxSize int64, kept int) (*File, error) {
+	l := &File{path: path, maxSize: maxSize, kept: kept}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *File) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.f, l.size = f, info.Size()
+	return nil
+}
+
+// Audit appends the records to the file, rotating it first if they would
+// take it past its maximum size.
+func (l *File) Audit(_ context.Context, records ...monitor.AuditRecord) error {
+	var buf []byte
+	for _, record := range records {
+		line, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+	if len(buf) == 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f == nil {
+		return os.ErrClosed
+	}
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(buf)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := l.f.Write(buf)
+	l.size += int64(n)
+	return err
+}
+
+// rotate renames the file with a timestamp suffix and starts a new one.
+func (l *File) rotate() error {
+	if err := l.f.Close(); err != nil {
+		return err
+	}
+	l.f = nil
+	if err := os.Rename(l.path, rotate.Name(l.path, time.Now())); err != nil {
+		return err
+	}
+	if err := l.open(); err != nil {
+		return err
+	}
+	return rotate.RemoveOld(l.path, l.kept)
+}
+
+// AuditTrail reads the records selected by the query from the rotated files
+// and the current one, oldest first. Lines that cannot be decoded are
+// skipped.
+func (l *File) AuditTrail(ctx context.Context, q monitor.AuditQuery) ([]monitor.AuditRecord, error) {
+	files, err := l.openAll()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	var records []monitor.AuditRecord
+	for _, f := range files {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		done, err := readRecords(f, q, &records)
+		if err != nil {
+			return nil, err
+		}
+		if done {
+			break
+		}
+	}
+	return records, nil
+}
+
+// openAll opens the rotated files and the current one, oldest first. They
+// are opened at once so that a rotation does not change what they hold while
+// they are read.
+func (l *File) openAll() ([]*os.File, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	paths, err := rotate.List(l.path)
+	if err != nil {
+		return nil, err
+	}
+	paths = append(paths, l.path)
+
+	files := make([]*os.File, 0, len(paths))
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue // removed since listed
+		}
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// readRecords appends the records of the file f selected by the query,
+// telling whether the limit of the query was reached.
+func readRecords(f *os.File, q monitor.AuditQuery, records *[]monitor.AuditRecord) (bool, error) {
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var record monitor.AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			continue
+		}
+		if !q.Matches(record) {
+			continue
+		}
+		*records = append(*records, record)
+		if q.Limit > 0 && len(*records) == q.Limit {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
+
+// Close closes the file.
+func (l *File) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
@@ -0,0 +1,71 @@
+package audit
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	monitor "github.com/a-tho/monitor/internal"
+	"github.com/a-tho/monitor/internal/rotate"
+)
+
+func TestFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	ctx := context.Background()
+
+	// Small enough for every record to rotate the file
+	l, err := OpenFile(path, 100, 2)
+	require.NoError(t, err)
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	ids := []string{"load", `load{cpu="0"}`, "hits", "load"}
+	for i, id := range ids {
+		v := float64(i)
+		record := monitor.AuditRecord{
+			Time:  start.Add(time.Duration(i) * time.Minute),
+			IP:    "10.0.0.1",
+			ID:    id,
+			MType: "gauge",
+			New:   &monitor.AuditValue{Value: &v},
+		}
+		require.NoError(t, l.Audit(ctx, record))
+		time.Sleep(time.Millisecond) // rotated files are named after the time
+	}
+
+	rotated, err := rotate.List(path)
+	require.NoError(t, err)
+	assert.Len(t, rotated, 2, "older rotated files are removed")
+
+	// The first record went with the removed file
+	records, err := l.AuditTrail(ctx, monitor.AuditQuery{})
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+	assert.Equal(t, `load{cpu="0"}`, records[0].ID)
+	assert.Equal(t, 3.0, *records[2].New.Value)
+
+	records, err = l.AuditTrail(ctx, monitor.AuditQuery{Metric: "load", Limit: 1})
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, `load{cpu="0"}`, records[0].ID)
+
+	records, err = l.AuditTrail(ctx, monitor.AuditQuery{From: start.Add(2 * time.Minute), To: start.Add(2 * time.Minute)})
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, "hits", records[0].ID)
+
+	// Reopening appends to the file
+	require.NoError(t, l.Close())
+	assert.ErrorIs(t, l.Audit(ctx, monitor.AuditRecord{ID: "load"}), os.ErrClosed)
+	l, err = OpenFile(path, 0, 2)
+	require.NoError(t, err)
+	defer l.Close()
+	require.NoError(t, l.Audit(ctx, monitor.AuditRecord{Time: start.Add(time.Hour), ID: "hits"}))
+	records, err = l.AuditTrail(ctx, monitor.AuditQuery{Metric: "hits"})
+	require.NoError(t, err)
+	assert.Len(t, records, 2)
+}
@@ -0,0 +1,150 @@
+// Package encryption implements the hybrid encryption of request bodies: a
+// random AES-256 key seals the body with GCM, and the server's RSA public key
+// wraps that key with OAEP.
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+)
+
+const (
+	// Header marks an encrypted body, its value names the scheme.
+	Header = "Encryption"
+	// Scheme is the only supported scheme.
+	Scheme = "rsa-oaep-aes256-gcm"
+
+	keySize = 32
+)
+
+var (
+	ErrCiphertext = errors.New("malformed ciphertext")
+	ErrKey        = errors.New("unsupported key")
+)
+
+// Encrypt seals plaintext for the owner of key. The result holds the wrapped
+// AES key, the GCM nonce and the sealed plaintext, in that order.
+func Encrypt(key *rsa.PublicKey, plaintext []byte) ([]byte, error) {
+	aesKey := make([]byte, keySize)
+	if _, err := rand.Read(aesKey); err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(aesKey)
+	if err != nil {
+		return nil, err
+	}
+
+	wrapped, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, key, aesKey, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, len(wrapped), len(wrapped)+gcm.NonceSize()+len(plaintext)+gcm.Overhead())
+	copy(out, wrapped)
+	nonce := out[len(out) : len(out)+gcm.NonceSize()]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out = out[:len(out)+len(nonce)]
+
+	return gcm.Seal(out, nonce, plaintext, nil), nil
+}
+
+// Decrypt opens the ciphertext produced by Encrypt with the public half of
+// key.
+func Decrypt(key *rsa.PrivateKey, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < key.Size() {
+		return nil, ErrCiphertext
+	}
+	aesKey, err := rsa.DecryptOAEP(sha256.New(), nil, key, ciphertext[:key.Size()], nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrCiphertext, err)
+	}
+	gcm, err := newGCM(aesKey)
+	if err != nil {
+		return nil, err
+	}
+
+	ciphertext = ciphertext[key.Size():]
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, ErrCiphertext
+	}
+	nonce, sealed := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrCiphertext, err)
+	}
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// LoadPublicKey reads an RSA public key from the PEM file path, either PKIX
+// or PKCS #1.
+func LoadPublicKey(path string) (*rsa.PublicKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if block.Type == "RSA PUBLIC KEY" {
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", path, ErrKey)
+	}
+	return rsaKey, nil
+}
+
+// LoadPrivateKey reads an RSA private key from the PEM file path, either
+// PKCS #8 or PKCS #1.
+func LoadPrivateKey(path string) (*rsa.PrivateKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if block.Type == "RSA PRIVATE KEY" {
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", path, ErrKey)
+	}
+	return rsaKey, nil
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", path)
+	}
+	return block, nil
+}
@@ -0,0 +1,85 @@
+package encryption
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryptDecrypt(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	plaintext := []byte(`[{"id":"Alloc","type":"gauge","value":1}]`)
+	ciphertext, err := Encrypt(&key.PublicKey, plaintext)
+	require.NoError(t, err)
+	assert.NotContains(t, string(ciphertext), "Alloc")
+
+	got, err := Decrypt(key, ciphertext)
+	require.NoError(t, err)
+	assert.Equal(t, plaintext, got)
+
+	tampered := append([]byte(nil), ciphertext...)
+	tampered[len(tampered)-1] ^= 1
+	tests := []struct {
+		name       string
+		key        *rsa.PrivateKey
+		ciphertext []byte
+	}{
+		{name: "tampered", key: key, ciphertext: tampered},
+		{name: "other key", key: other, ciphertext: ciphertext},
+		{name: "truncated key", key: key, ciphertext: ciphertext[:key.Size()-1]},
+		{name: "truncated nonce", key: key, ciphertext: ciphertext[:key.Size()+1]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Decrypt(tt.key, tt.ciphertext)
+			assert.ErrorIs(t, err, ErrCiphertext)
+		})
+	}
+}
+
+func TestLoadKeys(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	pkix, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	write := func(name, typ string, der []byte) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0o600))
+		return path
+	}
+
+	for _, path := range []string{
+		write("pkcs1.key", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key)),
+		write("pkcs8.key", "PRIVATE KEY", pkcs8),
+	} {
+		got, err := LoadPrivateKey(path)
+		require.NoError(t, err, path)
+		assert.True(t, key.Equal(got), path)
+	}
+	for _, path := range []string{
+		write("pkcs1.pub", "RSA PUBLIC KEY", x509.MarshalPKCS1PublicKey(&key.PublicKey)),
+		write("pkix.pub", "PUBLIC KEY", pkix),
+	} {
+		got, err := LoadPublicKey(path)
+		require.NoError(t, err, path)
+		assert.True(t, key.PublicKey.Equal(got), path)
+	}
+
+	_, err = LoadPublicKey(filepath.Join(dir, "missing.pub"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
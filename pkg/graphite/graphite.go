@@ -0,0 +1,172 @@
+// Package graphite implements a listener for the Graphite plaintext protocol
+// feeding the metric repository.
+package graphite
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	monitor "github.com/a-tho/monitor/internal"
+)
+
+const (
+	// maxBatchSize bounds the number of lines written at once.
+	maxBatchSize = 1000
+	// maxLineLen bounds the length of a line, the connection of a client
+	// sending a longer one being closed.
+	maxLineLen = 64 << 10
+	// defaultIdleTimeout is how long a connection may stay silent before it
+	// is closed.
+	defaultIdleTimeout = 5 * time.Minute
+)
+
+// A Listener receives Graphite lines over TCP.
+type Listener struct {
+	metrics  monitor.MetricRepo
+	ln       net.Listener
+	mapping  monitor.TypeMapping
+	m        sync.Mutex
+	conns    map[net.Conn]struct{}
+	handlers sync.WaitGroup
+
+	idleTimeout time.Duration
+}
+
+// Listen returns a listener on the TCP address addr, writing to metrics the
+// values typed by mapping.
+func Listen(addr string, metrics monitor.MetricRepo, mapping monitor.TypeMapping) (*Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Listener{
+		metrics: metrics,
+		ln:      ln,
+		mapping: mapping,
+		conns:   make(map[net.Conn]struct{}),
+
+		idleTimeout: defaultIdleTimeout,
+	}, nil
+}
+
+// Addr returns the address the listener accepts connections on.
+func (l *Listener) Addr() net.Addr {
+	return l.ln.Addr()
+}
+
+// Serve accepts connections until ctx is done, then closes them once the
+// lines read so far are written.
+func (l *Listener) Serve(ctx context.Context) error {
+	go func() {
+		<-ctx.Done()
+		l.ln.Close()
+
+		l.m.Lock()
+		for conn := range l.conns {
+			conn.Close()
+		}
+		l.m.Unlock()
+	}()
+
+	var err error
+	for {
+		var conn net.Conn
+		conn, err = l.ln.Accept()
+		if err != nil {
+			break
+		}
+
+		l.m.Lock()
+		if ctx.Err() != nil {
+			l.m.Unlock()
+			conn.Close()
+			continue // the listener is closed already
+		}
+		l.conns[conn] = struct{}{}
+		l.handlers.Add(1)
+		l.m.Unlock()
+
+		go l.handle(conn)
+	}
+
+	l.handlers.Wait()
+	if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+// handle reads the lines of conn, writing them whenever no more are buffered.
+func (l *Listener) handle(conn net.Conn) {
+	defer l.handlers.Done()
+	defer func() {
+		l.m.Lock()
+		delete(l.conns, conn)
+		l.m.Unlock()
+		conn.Close()
+	}()
+
+	var batch []*monitor.Metrics
+	flush := func() {
+		if len(batch) > 0 {
+			l.write(batch)
+			batch = batch[:0]
+		}
+	}
+
+	// The scanner reads again only once the lines buffered are parsed
+	scanner := bufio.NewScanner(readerFunc(func(p []byte) (int, error) {
+		flush()
+		if err := conn.SetReadDeadline(time.Now().Add(l.idleTimeout)); err != nil {
+			return 0, err
+		}
+		return conn.Read(p)
+	}))
+	scanner.Buffer(nil, maxLineLen)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			metric, err := parseLine(line, l.mapping)
+			if err != nil {
+				log.Debug().Err(err).Msg("Skipping graphite line")
+			} else {
+				batch = append(batch, metric)
+			}
+		}
+		if len(batch) >= maxBatchSize {
+			flush()
+		}
+	}
+	flush()
+
+	var netErr net.Error
+	switch err := scanner.Err(); {
+	case err == nil, errors.Is(err, net.ErrClosed):
+	case errors.Is(err, bufio.ErrTooLong):
+		log.Warn().Str("client", conn.RemoteAddr().String()).Msg("Closing graphite connection sending a line too long")
+	case errors.As(err, &netErr) && netErr.Timeout():
+		log.Debug().Str("client", conn.RemoteAddr().String()).Msg("Closing idle graphite connection")
+	default:
+		log.Err(err).Msg("Failed to read graphite line")
+	}
+}
+
+// readerFunc turns a function into an io.Reader.
+type readerFunc func(p []byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) {
+	return f(p)
+}
+
+func (l *Listener) write(batch []*monitor.Metrics) {
+	// The connection may be closing on shutdown, the lines read still count
+	if _, err := l.metrics.ApplyBatch(context.Background(), batch); err != nil {
+		log.Err(err).Int("size", len(batch)).Msg("Failed to write graphite batch")
+	}
+}
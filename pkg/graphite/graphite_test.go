@@ -0,0 +1,90 @@
+package graphite
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	monitor "github.com/a-tho/monitor/internal"
+	"github.com/a-tho/monitor/pkg/storage"
+)
+
+func TestListener(t *testing.T) {
+	metrics, err := storage.New(context.Background(), storage.Options{}, "memory://")
+	require.NoError(t, err)
+
+	mapping := monitor.TypeMapping{{Pattern: "*.count", Type: "counter"}}
+	l, err := Listen("127.0.0.1:0", metrics, mapping)
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error)
+	go func() { served <- l.Serve(ctx) }()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("requests.count 2 1700000000\nload;host=web1 0.5 1700000000\nbogus\nrequests.count 3 1700000010\n"))
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		counter, _ := metrics.GetCounter(context.Background(), "requests.count")
+		return counter == 5
+	}, time.Second, 10*time.Millisecond)
+	gauge, ok := metrics.GetGauge(context.Background(), `load{host="web1"}`)
+	require.True(t, ok)
+	assert.Equal(t, monitor.Gauge(0.5), gauge)
+
+	// Open connections do not hold up shutdown
+	cancel()
+	select {
+	case err := <-served:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("listener did not stop")
+	}
+	conn.Close()
+}
+
+func TestListenerLimits(t *testing.T) {
+	metrics, err := storage.New(context.Background(), storage.Options{}, "memory://")
+	require.NoError(t, err)
+
+	l, err := Listen("127.0.0.1:0", metrics, nil)
+	require.NoError(t, err)
+	l.idleTimeout = 50 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go l.Serve(ctx)
+
+	closed := func(t *testing.T, conn net.Conn) {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		// Closed with unread data, the connection may be reset rather
+		// than ended
+		_, err := conn.Read(make([]byte, 1))
+		var netErr net.Error
+		if assert.Error(t, err) && errors.As(err, &netErr) {
+			assert.False(t, netErr.Timeout(), "connection left open")
+		}
+	}
+
+	// A line without end does not fill the memory up
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("load 1\n" + strings.Repeat("x", maxLineLen+1)))
+	require.NoError(t, err)
+	closed(t, conn)
+	gauge, _ := metrics.GetGauge(context.Background(), "load")
+	assert.Equal(t, monitor.Gauge(1), gauge, "lines before the long one are written")
+
+	// Idle connections are closed
+	conn, err = net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	closed(t, conn)
+}
@@ -0,0 +1,75 @@
+package graphite
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	monitor "github.com/a-tho/monitor/internal"
+)
+
+var ErrLine = errors.New("malformed graphite line")
+
+// parseLine parses a line of the form path[;tag=value...] value [timestamp]
+// into a metric typed by mapping. The timestamp, in Unix seconds, is when the
+// value was measured; without it the value is taken as of its arrival.
+func parseLine(line string, mapping monitor.TypeMapping) (*monitor.Metrics, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || len(fields) > 3 {
+		return nil, fmt.Errorf("%w: %q", ErrLine, line)
+	}
+
+	name, labels, err := parsePath(fields[0])
+	if err != nil {
+		return nil, err
+	}
+
+	v, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return nil, fmt.Errorf("%w: invalid value %q", ErrLine, fields[1])
+	}
+	var ts *time.Time
+	if len(fields) == 3 {
+		sec, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil || math.IsNaN(sec) || math.Abs(sec) >= math.MaxInt64/float64(time.Second) {
+			return nil, fmt.Errorf("%w: invalid timestamp %q", ErrLine, fields[2])
+		}
+		sec, frac := math.Modf(sec)
+		t := time.Unix(int64(sec), int64(frac*float64(time.Second)))
+		ts = &t
+	}
+
+	metric, err := mapping.Metric(name, labels, v)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrLine, err)
+	}
+	metric.Time = ts
+	return metric, nil
+}
+
+// parsePath splits a tagged path into the metric name and labels.
+func parsePath(path string) (string, monitor.Labels, error) {
+	name, tags, tagged := strings.Cut(path, ";")
+	if name == "" {
+		return "", nil, fmt.Errorf("%w: empty path", ErrLine)
+	}
+	if !tagged {
+		return name, nil, nil
+	}
+
+	labels := monitor.Labels{}
+	for _, tag := range strings.Split(tags, ";") {
+		k, v, ok := strings.Cut(tag, "=")
+		if !ok || v == "" {
+			return "", nil, fmt.Errorf("%w: invalid tag %q", ErrLine, tag)
+		}
+		labels[k] = v
+	}
+	if err := labels.Validate(); err != nil {
+		return "", nil, fmt.Errorf("%w: %w", ErrLine, err)
+	}
+	return name, labels, nil
+}
@@ -0,0 +1,68 @@
+package graphite
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	monitor "github.com/a-tho/monitor/internal"
+)
+
+func TestParseLine(t *testing.T) {
+	mapping := monitor.TypeMapping{{Pattern: "*.count", Type: "counter"}}
+	value, delta := 0.5, int64(3)
+	ts := time.Unix(1700000000, 0)
+	fractional := time.Unix(1700000000, 250000000)
+
+	tests := []struct {
+		name    string
+		line    string
+		want    *monitor.Metrics
+		wantErr bool
+	}{
+		{
+			name: "gauge",
+			line: "servers.web1.load 0.5 1700000000",
+			want: &monitor.Metrics{ID: "servers.web1.load", MType: "gauge", Value: &value, Time: &ts},
+		},
+		{
+			name: "counter",
+			line: "requests.count 3 1700000000",
+			want: &monitor.Metrics{ID: "requests.count", MType: "counter", Delta: &delta, Time: &ts},
+		},
+		{
+			name: "tagged",
+			line: "load;host=web1;dc=eu 0.5 1700000000",
+			want: &monitor.Metrics{ID: "load", MType: "gauge", Value: &value, Labels: monitor.Labels{"host": "web1", "dc": "eu"}, Time: &ts},
+		},
+		{
+			name: "fractional timestamp",
+			line: "servers.web1.load 0.5 1700000000.25",
+			want: &monitor.Metrics{ID: "servers.web1.load", MType: "gauge", Value: &value, Time: &fractional},
+		},
+		{
+			name: "no timestamp",
+			line: "servers.web1.load 0.5",
+			want: &monitor.Metrics{ID: "servers.web1.load", MType: "gauge", Value: &value},
+		},
+		{name: "no value", line: "servers.web1.load", wantErr: true},
+		{name: "invalid value", line: "servers.web1.load high 1700000000", wantErr: true},
+		{name: "invalid timestamp", line: "servers.web1.load 0.5 now", wantErr: true},
+		{name: "timestamp out of range", line: "servers.web1.load 0.5 1e300", wantErr: true},
+		{name: "fractional counter", line: "requests.count 0.5 1700000000", wantErr: true},
+		{name: "invalid tag", line: "load;host 0.5 1700000000", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseLine(tt.line, mapping)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrLine)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
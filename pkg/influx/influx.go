@@ -0,0 +1,177 @@
+// Package influx parses the InfluxDB line protocol into metrics.
+//
+// A line measurement[,tag=value...] field=value[,field=value...] [timestamp]
+// yields a metric per numeric field, named measurement_field, or measurement
+// for a field named value. Tags become labels. String and boolean fields are
+// skipped. The timestamp tells when the values were measured; without it they
+// are taken as of their arrival.
+package influx
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	monitor "github.com/a-tho/monitor/internal"
+)
+
+// valueField is the field that names its metric after the measurement alone.
+const valueField = "value"
+
+var ErrLine = errors.New("malformed line protocol")
+
+// Precisions are the units of the timestamps by the names of the precision
+// parameter of the /write endpoint.
+var Precisions = map[string]time.Duration{
+	"ns": time.Nanosecond,
+	"us": time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+}
+
+// ParseLine parses a line into the metrics of its numeric fields, typed by
+// mapping. The timestamp counts units of precision since the Unix epoch. Empty
+// lines and comments yield no metrics.
+func ParseLine(line string, precision time.Duration, mapping monitor.TypeMapping) ([]*monitor.Metrics, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil, nil
+	}
+
+	sections := split(line, ' ', true)
+	if len(sections) < 2 || len(sections) > 3 {
+		return nil, fmt.Errorf("%w: %q", ErrLine, line)
+	}
+	var ts *time.Time
+	if len(sections) == 3 {
+		n, err := strconv.ParseInt(sections[2], 10, 64)
+		if err != nil || n > math.MaxInt64/int64(precision) || n < math.MinInt64/int64(precision) {
+			return nil, fmt.Errorf("%w: invalid timestamp %q", ErrLine, sections[2])
+		}
+		t := time.Unix(0, n*int64(precision))
+		ts = &t
+	}
+
+	series := split(sections[0], ',', false)
+	measurement := unescape(series[0])
+	if measurement == "" {
+		return nil, fmt.Errorf("%w: no measurement in %q", ErrLine, line)
+	}
+	var labels monitor.Labels
+	for _, tag := range series[1:] {
+		k, v, ok := cut(tag)
+		if !ok || k == "" || v == "" {
+			return nil, fmt.Errorf("%w: invalid tag %q", ErrLine, tag)
+		}
+		if labels == nil {
+			labels = monitor.Labels{}
+		}
+		labels[k] = v
+	}
+	if err := labels.Validate(); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrLine, err)
+	}
+
+	var metrics []*monitor.Metrics
+	for _, field := range split(sections[1], ',', true) {
+		k, v, ok := cut(field)
+		if !ok || k == "" || v == "" {
+			return nil, fmt.Errorf("%w: invalid field %q", ErrLine, field)
+		}
+
+		value, numeric, err := parseValue(v)
+		if err != nil {
+			return nil, fmt.Errorf("%w: field %s: %w", ErrLine, k, err)
+		}
+		if !numeric {
+			continue
+		}
+
+		name := measurement
+		if k != valueField {
+			name += "_" + k
+		}
+		metric, err := mapping.Metric(name, labels, value)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrLine, err)
+		}
+		metric.Time = ts
+		metrics = append(metrics, metric)
+	}
+	return metrics, nil
+}
+
+// parseValue parses a field value, telling whether it is numeric.
+func parseValue(v string) (float64, bool, error) {
+	switch {
+	case strings.HasPrefix(v, `"`):
+		if len(v) < 2 || !strings.HasSuffix(v, `"`) {
+			return 0, false, fmt.Errorf("unterminated string %s", v)
+		}
+		return 0, false, nil
+	case v == "t" || v == "T" || v == "true" || v == "True" || v == "TRUE" ||
+		v == "f" || v == "F" || v == "false" || v == "False" || v == "FALSE":
+		return 0, false, nil
+	case strings.HasSuffix(v, "i"):
+		n, err := strconv.ParseInt(v[:len(v)-1], 10, 64)
+		return float64(n), err == nil, err
+	case strings.HasSuffix(v, "u"):
+		n, err := strconv.ParseUint(v[:len(v)-1], 10, 64)
+		return float64(n), err == nil, err
+	}
+
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, false, err
+	}
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, false, fmt.Errorf("invalid value %s", v)
+	}
+	return f, true, nil
+}
+
+// split splits s around the separators sep that are not escaped, nor quoted
+// if quotes are recognized. The parts keep their escapes.
+func split(s string, sep byte, quotes bool) []string {
+	var (
+		parts  []string
+		start  int
+		quoted bool
+	)
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\':
+			i++ // skip the escaped character
+		case c == '"' && quotes:
+			quoted = !quoted
+		case c == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// cut splits an escaped key=value pair, unescaping the key and, unless it is
+// a quoted string, the value.
+func cut(s string) (string, string, bool) {
+	parts := split(s, '=', true)
+	if len(parts) < 2 {
+		return "", "", false
+	}
+	k := unescape(parts[0])
+	v := strings.Join(parts[1:], "=")
+	if !strings.HasPrefix(v, `"`) {
+		v = unescape(v)
+	}
+	return k, v, true
+}
+
+var unescaper = strings.NewReplacer(`\,`, ",", `\ `, " ", `\=`, "=", `\"`, `"`, `\\`, `\`)
+
+func unescape(s string) string {
+	return unescaper.Replace(s)
+}
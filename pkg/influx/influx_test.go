@@ -0,0 +1,82 @@
+package influx
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	monitor "github.com/a-tho/monitor/internal"
+)
+
+func TestParseLine(t *testing.T) {
+	mapping := monitor.TypeMapping{{Pattern: "*_requests", Type: "counter"}}
+	gauge := func(v float64) *float64 { return &v }
+	counter := func(v int64) *int64 { return &v }
+	ts := time.Unix(1700000000, 0)
+
+	tests := []struct {
+		name      string
+		line      string
+		precision time.Duration
+		want      []*monitor.Metrics
+		wantErr   bool
+	}{
+		{
+			name: "fields",
+			line: "cpu,host=web1,region=eu usage=0.5,cores=4i 1700000000000000000",
+			want: []*monitor.Metrics{
+				{ID: "cpu_usage", MType: "gauge", Value: gauge(0.5), Labels: monitor.Labels{"host": "web1", "region": "eu"}, Time: &ts},
+				{ID: "cpu_cores", MType: "gauge", Value: gauge(4), Labels: monitor.Labels{"host": "web1", "region": "eu"}, Time: &ts},
+			},
+		},
+		{
+			name:      "precision",
+			line:      "cpu usage=0.5 1700000000",
+			precision: time.Second,
+			want:      []*monitor.Metrics{{ID: "cpu_usage", MType: "gauge", Value: gauge(0.5), Time: &ts}},
+		},
+		{
+			name: "value field",
+			line: "temperature value=21.5",
+			want: []*monitor.Metrics{{ID: "temperature", MType: "gauge", Value: gauge(21.5)}},
+		},
+		{
+			name: "counter",
+			line: "http requests=12u",
+			want: []*monitor.Metrics{{ID: "http_requests", MType: "counter", Delta: counter(12)}},
+		},
+		{
+			name: "escapes and strings",
+			line: `disk\ io,path=/var\,log reads=3,status="ok, all=good",healthy=t`,
+			want: []*monitor.Metrics{{ID: "disk io_reads", MType: "gauge", Value: gauge(3), Labels: monitor.Labels{"path": "/var,log"}}},
+		},
+		{name: "comment", line: "# cpu usage=1"},
+		{name: "empty", line: "  "},
+		{name: "no fields", line: "cpu,host=web1", wantErr: true},
+		{name: "invalid field", line: "cpu usage", wantErr: true},
+		{name: "invalid value", line: "cpu usage=high", wantErr: true},
+		{name: "unterminated string", line: `cpu status="ok`, wantErr: true},
+		{name: "invalid timestamp", line: "cpu usage=1 now", wantErr: true},
+		{name: "timestamp out of range", line: "cpu usage=1 9223372036854775807", precision: time.Second, wantErr: true},
+		{name: "invalid tag", line: "cpu,host usage=1", wantErr: true},
+		{name: "invalid label", line: "cpu,host-name=web1 usage=1", wantErr: true},
+		{name: "fractional counter", line: "http requests=1.5", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			precision := tt.precision
+			if precision == 0 {
+				precision = time.Nanosecond
+			}
+			got, err := ParseLine(tt.line, precision, mapping)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrLine)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
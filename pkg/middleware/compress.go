@@ -2,6 +2,7 @@
 package middleware
 
 import (
+	"bytes"
 	"compress/gzip"
 	"io"
 	"net/http"
@@ -74,7 +75,9 @@ func (r *decompReaderCloser) Close() error {
 }
 
 // WithCompressing adds support for request and response compression.
-func WithCompressing(handler func(w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
+// Requests inflating past max bytes are rejected, none if max is not
+// positive.
+func WithCompressing(handler func(w http.ResponseWriter, r *http.Request), max int64) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Decompress request if necessary
 		encodings := r.Header.Values(contentEncoding)
@@ -84,6 +87,16 @@ func WithCompressing(handler func(w http.ResponseWriter, r *http.Request)) http.
 			if err == nil {
 				defer decompBody.Close()
 				r.Body = decompBody
+
+				// Inflate up front to stop gzip bombs
+				if max > 0 {
+					body, err := readLimited(decompBody, max)
+					if err != nil {
+						readError(w, err)
+						return
+					}
+					r.Body = io.NopCloser(bytes.NewReader(body))
+				}
 			}
 		}
 
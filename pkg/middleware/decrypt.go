@@ -0,0 +1,48 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"io"
+	"net/http"
+
+	"github.com/a-tho/monitor/pkg/encryption"
+)
+
+const (
+	errEncryption = "unsupported encryption"
+	errDecrypt    = "undecryptable request body"
+)
+
+// WithDecrypting adds support for request bodies encrypted for key. Bodies
+// that are not marked encrypted pass as is, so that clients can switch to
+// encryption one by one.
+func WithDecrypting(handler func(w http.ResponseWriter, r *http.Request), key *rsa.PrivateKey) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		scheme := r.Header.Get(encryption.Header)
+		if scheme == "" {
+			handler(w, r)
+			return
+		}
+		if key == nil || scheme != encryption.Scheme {
+			http.Error(w, errEncryption, http.StatusBadRequest)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			readError(w, err)
+			return
+		}
+		body, err = encryption.Decrypt(key, body)
+		if err != nil {
+			http.Error(w, errDecrypt, http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+		r.Header.Del(encryption.Header)
+
+		handler(w, r)
+	}
+}
@@ -0,0 +1,154 @@
+package middleware
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultReplayWindow is how far request timestamps may be off by default.
+const DefaultReplayWindow = 5 * time.Minute
+
+var (
+	ErrUnknownKey = errors.New("unknown signing key")
+	ErrReplay     = errors.New("replayed or stale request")
+)
+
+// A Keyring holds the keys requests may be signed with, told apart by the
+// KeyIDHeader, so that keys can be rotated one client at a time. Requests
+// without a key ID use the primary key, which also signs the responses to
+// unsigned requests.
+//
+// Requests stamped with TimestampHeader and NonceHeader are only accepted
+// within the replay window of their timestamp, and once. In strict mode every
+// request that writes must be signed and stamped.
+type Keyring struct {
+	keys    map[string][]byte
+	primary string
+	strict  bool
+	window  time.Duration
+	now     func() time.Time
+
+	m         sync.Mutex
+	nonces    map[string]time.Time // until when they are remembered
+	lastPrune time.Time
+}
+
+// NewKeyring returns a keyring with the keys by ID and the primary key ID. The
+// replay window is DefaultReplayWindow if not positive.
+func NewKeyring(keys map[string][]byte, primary string, strict bool, window time.Duration) (*Keyring, error) {
+	if _, ok := keys[primary]; !ok {
+		return nil, fmt.Errorf("primary key %q: %w", primary, ErrUnknownKey)
+	}
+	if window <= 0 {
+		window = DefaultReplayWindow
+	}
+	return &Keyring{
+		keys:    keys,
+		primary: primary,
+		strict:  strict,
+		window:  window,
+		now:     time.Now,
+		nonces:  make(map[string]time.Time),
+	}, nil
+}
+
+// ParseKey decodes a base64 encoded key, nil if s is empty. A key that does
+// not decode is an error rather than no key, not to leave requests unsigned.
+func ParseKey(s string) ([]byte, error) {
+	if s == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(key) == 0 {
+		return nil, errors.New("invalid key: not base64")
+	}
+	return key, nil
+}
+
+// ParseKeys parses comma-separated id:key pairs, keys being base64 encoded.
+func ParseKeys(s string) (map[string][]byte, error) {
+	keys := make(map[string][]byte)
+	if s == "" {
+		return keys, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		id, encoded, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if !ok || id == "" {
+			return nil, fmt.Errorf("invalid key %q, want id:base64", pair)
+		}
+		key, err := ParseKey(encoded)
+		if err != nil || key == nil {
+			return nil, fmt.Errorf("invalid key %q: not base64", id)
+		}
+		if _, ok := keys[id]; ok {
+			return nil, fmt.Errorf("duplicate key %q", id)
+		}
+		keys[id] = key
+	}
+	return keys, nil
+}
+
+// id returns the ID of the key the request with the key ID id is signed
+// with, the primary one if id is empty.
+func (k *Keyring) id(id string) string {
+	if id == "" {
+		return k.primary
+	}
+	return id
+}
+
+// key returns the key with the ID, the primary one if id is empty.
+func (k *Keyring) key(id string) ([]byte, bool) {
+	key, ok := k.keys[k.id(id)]
+	return key, ok
+}
+
+// check accepts the timestamp, in Unix seconds, and the nonce of a request if
+// the timestamp is within the replay window and the nonce was not seen in it.
+func (k *Keyring) check(timestamp, nonce string) error {
+	sec, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || nonce == "" {
+		return ErrReplay
+	}
+	now := k.now()
+	t := time.Unix(sec, 0)
+	if t.Before(now.Add(-k.window)) || t.After(now.Add(k.window)) {
+		return ErrReplay
+	}
+
+	k.m.Lock()
+	defer k.m.Unlock()
+
+	if now.Sub(k.lastPrune) >= k.window {
+		for n, until := range k.nonces {
+			if now.After(until) {
+				delete(k.nonces, n)
+			}
+		}
+		k.lastPrune = now
+	}
+	if _, ok := k.nonces[nonce]; ok {
+		return ErrReplay
+	}
+	// Past this, the timestamp gives the request away
+	k.nonces[nonce] = t.Add(k.window)
+	return nil
+}
+
+// Sign returns the signature of a request body with the key, covering the
+// timestamp and nonce if any.
+func Sign(key []byte, timestamp, nonce string, body []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	if timestamp != "" || nonce != "" {
+		mac.Write([]byte(timestamp + "\n" + nonce + "\n"))
+	}
+	mac.Write(body)
+	return mac.Sum(nil)
+}
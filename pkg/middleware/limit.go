@@ -0,0 +1,57 @@
+package middleware
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+)
+
+const errBodyTooLarge = "request body too large"
+
+// WithBodyLimit rejects request bodies longer than max bytes as they come
+// over the wire, with no limit if max is not positive.
+func WithBodyLimit(handler func(w http.ResponseWriter, r *http.Request), max int64) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if max <= 0 {
+			handler(w, r)
+			return
+		}
+		if r.ContentLength > max {
+			http.Error(w, errBodyTooLarge, http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		body, err := readLimited(r.Body, max)
+		if err != nil {
+			readError(w, err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		handler(w, r)
+	}
+}
+
+// readLimited reads all of r, failing with an *http.MaxBytesError past max
+// bytes.
+func readLimited(r io.Reader, max int64) ([]byte, error) {
+	body, err := io.ReadAll(io.LimitReader(r, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > max {
+		return nil, &http.MaxBytesError{Limit: max}
+	}
+	return body, nil
+}
+
+// readError reports the failure to read a request body.
+func readError(w http.ResponseWriter, err error) {
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		http.Error(w, errBodyTooLarge, http.StatusRequestEntityTooLarge)
+		return
+	}
+	http.Error(w, errReadBody, http.StatusBadRequest)
+}
@@ -30,6 +30,13 @@ func (w *logResponseWriter) WriteHeader(code int) {
 	w.data.code = code
 }
 
+// Flush lets streaming handlers flush through the logging.
+func (w *logResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
 // WithLogging adds support for request and response logging.
 func WithLogging(handler func(w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,124 @@
+package middleware
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// pruneInterval is how often the buckets of idle clients are dropped.
+	pruneInterval = time.Minute
+
+	errRateLimit = "too many requests"
+)
+
+// A RateLimiter keeps a token bucket per client: every request takes a token,
+// and tokens come back at a steady rate up to the burst size.
+type RateLimiter struct {
+	rate  float64 // tokens per second
+	burst float64
+	key   func(r *http.Request) string
+	now   func() time.Time
+
+	m         sync.Mutex
+	buckets   map[string]*bucket
+	lastPrune time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time // when tokens was up to date
+}
+
+// NewRateLimiter returns a limiter letting each client make rate requests per
+// second, and up to burst at once. Clients are told apart by key.
+func NewRateLimiter(rate float64, burst int, key func(r *http.Request) string) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		key:     key,
+		now:     time.Now,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// Allow takes a token from the bucket of client, telling whether there was
+// one and otherwise how long until there is.
+func (l *RateLimiter) Allow(client string) (bool, time.Duration) {
+	now := l.now()
+
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	if now.Sub(l.lastPrune) >= pruneInterval {
+		l.prune(now)
+	}
+
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// prune drops the buckets that have filled up again, l.m must be held.
+func (l *RateLimiter) prune(now time.Time) {
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	for client, b := range l.buckets {
+		if now.Sub(b.last) >= full {
+			delete(l.buckets, client)
+		}
+	}
+	l.lastPrune = now
+}
+
+// ClientIP tells clients apart by the address they connect from.
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// RealIP returns a key telling clients apart by RealIPHeader when they
+// connect through one of the proxies, which must set the header, and by
+// ClientIP otherwise, as anyone else can set the header to anything.
+func RealIP(proxies []*net.IPNet) func(r *http.Request) string {
+	return func(r *http.Request) string {
+		return clientAddr(r, proxies)
+	}
+}
+
+// WithRateLimit rejects the requests of clients going over the limits of l,
+// with no limits if l is nil.
+func WithRateLimit(handler func(w http.ResponseWriter, r *http.Request), l *RateLimiter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if l == nil {
+			handler(w, r)
+			return
+		}
+
+		if ok, wait := l.Allow(l.key(r)); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, errRateLimit, http.StatusTooManyRequests)
+			return
+		}
+		handler(w, r)
+	}
+}
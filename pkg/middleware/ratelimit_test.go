@@ -0,0 +1,84 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := NewRateLimiter(2, 3, ClientIP)
+	l.now = func() time.Time { return now }
+
+	// The burst goes through at once, then a token comes every half second
+	for i := 0; i < 3; i++ {
+		ok, _ := l.Allow("10.0.0.1")
+		assert.True(t, ok, "request %d", i)
+	}
+	ok, wait := l.Allow("10.0.0.1")
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, wait)
+
+	// Clients have buckets of their own
+	ok, _ = l.Allow("10.0.0.2")
+	assert.True(t, ok)
+
+	now = now.Add(500 * time.Millisecond)
+	ok, _ = l.Allow("10.0.0.1")
+	assert.True(t, ok)
+	ok, _ = l.Allow("10.0.0.1")
+	assert.False(t, ok)
+
+	// Buckets of idle clients are dropped once full
+	now = now.Add(pruneInterval)
+	l.Allow("10.0.0.3")
+	assert.Len(t, l.buckets, 1)
+}
+
+func TestWithRateLimit(t *testing.T) {
+	// Test requests come from 192.0.2.1
+	_, proxy, err := net.ParseCIDR("192.0.2.0/24")
+	require.NoError(t, err)
+	l := NewRateLimiter(1, 1, RealIP([]*net.IPNet{proxy}))
+	handler := WithRateLimit(func(w http.ResponseWriter, r *http.Request) {}, l)
+
+	tests := []struct {
+		realIP     string
+		code       int
+		retryAfter string
+	}{
+		{realIP: "10.0.0.1", code: http.StatusOK},
+		{realIP: "10.0.0.1", code: http.StatusTooManyRequests, retryAfter: "1"},
+		{realIP: "10.0.0.2", code: http.StatusOK},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set(RealIPHeader, tt.realIP)
+		w := httptest.NewRecorder()
+		handler(w, r)
+		assert.Equal(t, tt.code, w.Code, tt.realIP)
+		assert.Equal(t, tt.retryAfter, w.Header().Get("Retry-After"), tt.realIP)
+	}
+}
+
+func TestWithRateLimitSpoofed(t *testing.T) {
+	// Without proxies the header is not trusted, a new value on every
+	// request does not get a new bucket
+	l := NewRateLimiter(1, 1, RealIP(nil))
+	handler := WithRateLimit(func(w http.ResponseWriter, r *http.Request) {}, l)
+
+	for i, want := range []int{http.StatusOK, http.StatusTooManyRequests, http.StatusTooManyRequests} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set(RealIPHeader, "10.0.0."+strconv.Itoa(i))
+		w := httptest.NewRecorder()
+		handler(w, r)
+		assert.Equal(t, want, w.Code, "request %d", i)
+	}
+}
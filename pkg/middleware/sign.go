@@ -2,21 +2,40 @@ package middleware
 
 import (
 	"bytes"
+	"context"
 	"crypto/hmac"
-	"crypto/sha256"
 	"encoding/base64"
 	"io"
 	"net/http"
 )
 
 const (
-	bodySignature = "HashSHA256"
+	// SignatureHeader carries the base64 encoded HMAC-SHA256 of the body.
+	SignatureHeader = "HashSHA256"
+	// KeyIDHeader names the key a request is signed with.
+	KeyIDHeader = "KeyID"
+	// TimestampHeader carries the Unix time a request was signed at.
+	TimestampHeader = "Timestamp"
+	// NonceHeader carries a value unique to a signed request.
+	NonceHeader = "Nonce"
 
 	errReadBody  = "unreadable request body"
 	errWriteBody = "failed to write response body"
 	errSignature = "invalid signature"
+	errUnsigned  = "unsigned request"
+	errKeyID     = "unknown signing key"
+	errReplay    = "replayed or stale request"
 )
 
+type keyIDKey struct{}
+
+// KeyIDFrom returns the ID of the key the request of ctx was verified with,
+// false if it was not signed.
+func KeyIDFrom(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(keyIDKey{}).(string)
+	return id, ok
+}
+
 type hashResponseWriter struct {
 	body bytes.Buffer
 	http.ResponseWriter
@@ -32,62 +51,84 @@ func (hrw *hashResponseWriter) Write(p []byte) (n int, err error) {
 	return hrw.body.Write(p)
 }
 
-// WithSigning adds support for request and response signing.
-func WithSigning(handler func(w http.ResponseWriter, r *http.Request), key []byte) http.HandlerFunc {
+// WithSigning adds support for request and response signing with the keys of
+// keyring, none if nil.
+func WithSigning(handler func(w http.ResponseWriter, r *http.Request), keyring *Keyring) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if len(key) > 0 {
-			// Check signature if body is not empty
-			// 1. recreate signature if body is not empty
-			body, err := io.ReadAll(r.Body)
+		if keyring == nil {
+			handler(w, r)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			readError(w, err)
+			return
+		}
+
+		// Check signature if any
+		// 1. pick the key the request is signed with
+		key, ok := keyring.key(r.Header.Get(KeyIDHeader))
+		signGotEncoded := r.Header.Get(SignatureHeader)
+		if signGotEncoded == "" {
+			// Reads need no signature
+			if keyring.strict && (len(body) > 0 || (r.Method != http.MethodGet && r.Method != http.MethodHead)) {
+				http.Error(w, errUnsigned, http.StatusUnauthorized)
+				return
+			}
+			if !ok {
+				key, _ = keyring.key("")
+			}
+		} else {
+			if !ok {
+				http.Error(w, errKeyID, http.StatusBadRequest)
+				return
+			}
+			timestamp, nonce := r.Header.Get(TimestampHeader), r.Header.Get(NonceHeader)
+			stamped := timestamp != "" || nonce != ""
+			if keyring.strict && !stamped {
+				http.Error(w, errReplay, http.StatusBadRequest)
+				return
+			}
+			// 2. recreate signature and compare it to the received one
+			signGot, err := base64.StdEncoding.DecodeString(signGotEncoded)
 			if err != nil {
-				http.Error(w, errReadBody, http.StatusBadRequest)
+				http.Error(w, errSignature, http.StatusBadRequest)
+				return
+			}
+			if !hmac.Equal(signGot, Sign(key, timestamp, nonce, body)) {
+				http.Error(w, errSignature, http.StatusBadRequest)
 				return
 			}
-			if len(body) != 0 {
-				signWant := hash(body, key)
-				// 2. retrieve received signature
-				signGotEncoded := r.Header.Values(bodySignature)
-				if len(signGotEncoded) != 0 {
-					signGot, err := base64.StdEncoding.DecodeString(signGotEncoded[0])
-					if err != nil {
-						http.Error(w, errSignature, http.StatusBadRequest)
-						return
-					}
-					// 3. compare the two
-					if !hmac.Equal(signGot, signWant) {
-						http.Error(w, errReadBody, http.StatusBadRequest)
-						return
-					}
+			// 3. only then remember the nonce
+			if stamped {
+				if err := keyring.check(timestamp, nonce); err != nil {
+					http.Error(w, errReplay, http.StatusBadRequest)
+					return
 				}
 			}
-			// 4. put the body back to let the handler use it
-			r.Body = io.NopCloser(bytes.NewBuffer(body))
 
-			// Prepare response body to be able to sign it
-			hashW := newHashResponseWriter(w)
+			r = r.WithContext(context.WithValue(r.Context(), keyIDKey{}, keyring.id(r.Header.Get(KeyIDHeader))))
+		}
+		// 4. put the body back to let the handler use it
+		r.Body = io.NopCloser(bytes.NewBuffer(body))
 
-			handler(hashW, r)
+		// Prepare response body to be able to sign it
+		hashW := newHashResponseWriter(w)
 
-			// Sign response body
-			// 1. add response body signature
-			body = hashW.body.Bytes()
-			sign := hash(body, key)
-			signEncoded := base64.StdEncoding.EncodeToString(sign)
-			w.Header().Add(bodySignature, signEncoded)
-			// 2. send the body that we have been caching so far
-			_, err = io.Copy(w, &hashW.body)
-			if err != nil {
-				http.Error(w, errWriteBody, http.StatusInternalServerError)
-				return
-			}
-		} else {
-			handler(w, r)
+		handler(hashW, r)
+
+		// Sign response body with the key of the request, known by now
+		// 1. add response body signature
+		body = hashW.body.Bytes()
+		sign := Sign(key, "", "", body)
+		signEncoded := base64.StdEncoding.EncodeToString(sign)
+		w.Header().Add(SignatureHeader, signEncoded)
+		// 2. send the body that we have been caching so far
+		_, err = io.Copy(w, &hashW.body)
+		if err != nil {
+			http.Error(w, errWriteBody, http.StatusInternalServerError)
+			return
 		}
 	}
 }
-
-func hash(value []byte, key []byte) []byte {
-	hash := hmac.New(sha256.New, key)
-	hash.Write(value)
-	return hash.Sum(nil)
-}
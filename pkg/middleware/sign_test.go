@@ -0,0 +1,182 @@
+package middleware
+
+import (
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithSigning(t *testing.T) {
+	keys := map[string][]byte{"old": []byte("old secret"), "new": []byte("new secret")}
+	now := time.Unix(1700000000, 0)
+	stamp := strconv.FormatInt(now.Unix(), 10)
+	stale := strconv.FormatInt(now.Add(-time.Hour).Unix(), 10)
+
+	type request struct {
+		method    string
+		body      string
+		keyID     string
+		key       string // to sign with, unsigned if empty
+		timestamp string
+		nonce     string
+	}
+	tests := []struct {
+		name     string
+		strict   bool
+		requests []request
+		codes    []int
+	}{
+		{
+			name:     "key ids",
+			requests: []request{{body: "a", keyID: "old", key: "old secret"}, {body: "a", key: "new secret"}, {body: "a", keyID: "new", key: "old secret"}},
+			codes:    []int{http.StatusOK, http.StatusOK, http.StatusBadRequest},
+		},
+		{
+			name:     "unknown key id",
+			requests: []request{{body: "a", keyID: "older", key: "old secret"}},
+			codes:    []int{http.StatusBadRequest},
+		},
+		{
+			name:     "lenient",
+			requests: []request{{body: "a"}, {body: "a", key: "new secret"}},
+			codes:    []int{http.StatusOK, http.StatusOK},
+		},
+		{
+			name:   "strict",
+			strict: true,
+			requests: []request{
+				{body: "a"},
+				{method: http.MethodGet},
+				{body: "a", key: "new secret"},
+				{body: "a", key: "new secret", timestamp: stamp, nonce: "1"},
+			},
+			codes: []int{http.StatusUnauthorized, http.StatusOK, http.StatusBadRequest, http.StatusOK},
+		},
+		{
+			name: "replay",
+			requests: []request{
+				{body: "a", key: "new secret", timestamp: stamp, nonce: "1"},
+				{body: "a", key: "new secret", timestamp: stamp, nonce: "1"},
+				{body: "a", key: "new secret", timestamp: stamp, nonce: "2"},
+				{body: "a", key: "new secret", timestamp: stale, nonce: "3"},
+			},
+			codes: []int{http.StatusOK, http.StatusBadRequest, http.StatusOK, http.StatusBadRequest},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keyring, err := NewKeyring(keys, "new", tt.strict, time.Minute)
+			require.NoError(t, err)
+			keyring.now = func() time.Time { return now }
+			handler := WithSigning(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				w.Write(body)
+			}, keyring)
+
+			for i, req := range tt.requests {
+				method := req.method
+				if method == "" {
+					method = http.MethodPost
+				}
+				r := httptest.NewRequest(method, "/", strings.NewReader(req.body))
+				if req.keyID != "" {
+					r.Header.Set(KeyIDHeader, req.keyID)
+				}
+				if req.timestamp != "" {
+					r.Header.Set(TimestampHeader, req.timestamp)
+					r.Header.Set(NonceHeader, req.nonce)
+				}
+				if req.key != "" {
+					sum := Sign([]byte(req.key), req.timestamp, req.nonce, []byte(req.body))
+					r.Header.Set(SignatureHeader, base64.StdEncoding.EncodeToString(sum))
+				}
+				w := httptest.NewRecorder()
+				handler(w, r)
+
+				require.Equal(t, tt.codes[i], w.Code, "request %d: %s", i, w.Body.String())
+				if w.Code == http.StatusOK {
+					// The response is signed with the key of the request
+					key, _ := keyring.key(req.keyID)
+					want := base64.StdEncoding.EncodeToString(Sign(key, "", "", []byte(req.body)))
+					assert.Equal(t, want, w.Header().Get(SignatureHeader), "request %d", i)
+				}
+			}
+		})
+	}
+}
+
+func TestKeyIDFrom(t *testing.T) {
+	keyring, err := NewKeyring(map[string][]byte{"old": []byte("old secret"), "new": []byte("new secret")}, "new", false, 0)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		keyID  string
+		key    string // to sign with, unsigned if empty
+		want   string
+		signed bool
+	}{
+		{name: "unsigned"},
+		{name: "key id", keyID: "old", key: "old secret", want: "old", signed: true},
+		{name: "primary key", key: "new secret", want: "new", signed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				got    string
+				signed bool
+			)
+			handler := WithSigning(func(w http.ResponseWriter, r *http.Request) {
+				got, signed = KeyIDFrom(r.Context())
+			}, keyring)
+
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("a"))
+			if tt.keyID != "" {
+				r.Header.Set(KeyIDHeader, tt.keyID)
+			}
+			if tt.key != "" {
+				sum := Sign([]byte(tt.key), "", "", []byte("a"))
+				r.Header.Set(SignatureHeader, base64.StdEncoding.EncodeToString(sum))
+			}
+			handler(httptest.NewRecorder(), r)
+
+			assert.Equal(t, tt.signed, signed)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	keys, err := ParseKeys("2023:b2xk, 2024:bmV3")
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]byte{"2023": []byte("old"), "2024": []byte("new")}, keys)
+
+	for _, s := range []string{"b2xk", ":b2xk", "2023:???", "2023:b2xk,2023:bmV3"} {
+		_, err := ParseKeys(s)
+		assert.Error(t, err, s)
+	}
+
+	_, err = NewKeyring(keys, "2025", false, 0)
+	assert.ErrorIs(t, err, ErrUnknownKey)
+}
+
+func TestParseKey(t *testing.T) {
+	key, err := ParseKey("b2xk")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("old"), key)
+
+	key, err = ParseKey("")
+	require.NoError(t, err)
+	assert.Nil(t, key)
+
+	_, err = ParseKey("not base64")
+	assert.Error(t, err)
+}
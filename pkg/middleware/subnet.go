@@ -0,0 +1,57 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+)
+
+const (
+	// RealIPHeader carries the address of the client sending the request.
+	RealIPHeader = "X-Real-IP"
+
+	errUntrusted = "untrusted client address"
+)
+
+// WithTrustedSubnet only lets through requests from clients in subnet, all of
+// them if subnet is nil. The client address is the address of the connection.
+// Clients can set RealIPHeader to anything, so the header is only taken
+// instead when the connection comes from one of the proxies, which must then
+// set it themselves.
+func WithTrustedSubnet(handler func(w http.ResponseWriter, r *http.Request), subnet *net.IPNet, proxies []*net.IPNet) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if subnet == nil {
+			handler(w, r)
+			return
+		}
+
+		if ip := net.ParseIP(clientAddr(r, proxies)); ip == nil || !subnet.Contains(ip) {
+			http.Error(w, errUntrusted, http.StatusForbidden)
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+// clientAddr returns the address of the client, the one in RealIPHeader if the
+// connection comes from one of the proxies and ClientIP otherwise.
+func clientAddr(r *http.Request, proxies []*net.IPNet) string {
+	addr := ClientIP(r)
+	if realIP := r.Header.Get(RealIPHeader); realIP != "" && inSubnets(proxies, net.ParseIP(addr)) {
+		return realIP
+	}
+	return addr
+}
+
+// inSubnets tells whether the address is within one of the subnets.
+func inSubnets(subnets []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, subnet := range subnets {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,77 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	monitor "github.com/a-tho/monitor/internal"
+)
+
+const (
+	// AuthorizationHeader carries the bearer token of the client.
+	AuthorizationHeader = "Authorization"
+
+	bearerPrefix = "Bearer "
+
+	errUnauthorized = "missing or invalid bearer token"
+	errScope        = "token lacks the scope"
+	errLookupToken  = "failed to look up token"
+)
+
+type tokenKey struct{}
+
+// WithScope only lets through requests bearing a token of tokens that grants
+// scope, all of them if tokens is nil. The token is then available to the
+// handler through TokenFrom.
+func WithScope(handler func(w http.ResponseWriter, r *http.Request), tokens monitor.TokenStore, scope monitor.Scope) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if tokens == nil {
+			handler(w, r)
+			return
+		}
+
+		secret, ok := bearer(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, errUnauthorized, http.StatusUnauthorized)
+			return
+		}
+		token, err := tokens.LookupToken(r.Context(), secret)
+		if errors.Is(err, monitor.ErrUnknownToken) {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			http.Error(w, errUnauthorized, http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			http.Error(w, errLookupToken, http.StatusInternalServerError)
+			return
+		}
+		if !token.Has(scope) {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope="%s"`, scope))
+			http.Error(w, errScope, http.StatusForbidden)
+			return
+		}
+
+		handler(w, r.WithContext(context.WithValue(r.Context(), tokenKey{}, token)))
+	}
+}
+
+// TokenFrom returns the token the request of ctx was let through with, false
+// if tokens are not in use.
+func TokenFrom(ctx context.Context) (monitor.Token, bool) {
+	token, ok := ctx.Value(tokenKey{}).(monitor.Token)
+	return token, ok
+}
+
+// bearer returns the bearer token of the request.
+func bearer(r *http.Request) (string, bool) {
+	auth := r.Header.Get(AuthorizationHeader)
+	if len(auth) < len(bearerPrefix) || !strings.EqualFold(auth[:len(bearerPrefix)], bearerPrefix) {
+		return "", false
+	}
+	secret := strings.TrimSpace(auth[len(bearerPrefix):])
+	return secret, secret != ""
+}
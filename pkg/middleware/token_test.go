@@ -0,0 +1,69 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	monitor "github.com/a-tho/monitor/internal"
+)
+
+type failingStore struct{}
+
+func (failingStore) LookupToken(context.Context, string) (monitor.Token, error) {
+	return monitor.Token{}, errors.New("connection refused")
+}
+
+func TestWithScope(t *testing.T) {
+	tokens := monitor.TokenFile{
+		monitor.HashToken("reader"): {Name: "dashboard", Scopes: []monitor.Scope{monitor.ScopeRead}},
+	}
+
+	tests := []struct {
+		name   string
+		tokens monitor.TokenStore
+		auth   string
+		code   int
+	}{
+		{name: "no tokens", code: http.StatusOK},
+		{name: "granted", tokens: tokens, auth: "Bearer reader", code: http.StatusOK},
+		{name: "case insensitive scheme", tokens: tokens, auth: "bearer reader", code: http.StatusOK},
+		{name: "missing", tokens: tokens, code: http.StatusUnauthorized},
+		{name: "not bearer", tokens: tokens, auth: "Basic cmVhZGVy", code: http.StatusUnauthorized},
+		{name: "unknown", tokens: tokens, auth: "Bearer writer", code: http.StatusUnauthorized},
+		{name: "store failure", tokens: failingStore{}, auth: "Bearer reader", code: http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var seen monitor.Token
+			handler := WithScope(func(w http.ResponseWriter, r *http.Request) {
+				seen, _ = TokenFrom(r.Context())
+			}, tt.tokens, monitor.ScopeRead)
+
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.auth != "" {
+				r.Header.Set(AuthorizationHeader, tt.auth)
+			}
+			w := httptest.NewRecorder()
+			handler(w, r)
+
+			assert.Equal(t, tt.code, w.Code)
+			if tt.tokens != nil && tt.code == http.StatusOK {
+				assert.Equal(t, "dashboard", seen.Name)
+			}
+		})
+	}
+
+	// A token lacking the scope is known but forbidden
+	handler := WithScope(func(http.ResponseWriter, *http.Request) {}, tokens, monitor.ScopeWrite)
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	r.Header.Set(AuthorizationHeader, "Bearer reader")
+	w := httptest.NewRecorder()
+	handler(w, r)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Header().Get("WWW-Authenticate"), "insufficient_scope")
+}
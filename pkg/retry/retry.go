@@ -8,7 +8,8 @@ import (
 )
 
 type retriableError struct {
-	err error
+	err   error
+	after time.Duration
 }
 
 type retriableFunc func(context.Context) error
@@ -19,6 +20,12 @@ func RetriableError(err error) *retriableError {
 	return &retriableError{err: err}
 }
 
+// RetriableAfter returns a retriable error that asks to wait d before the
+// retry instead of the default interval.
+func RetriableAfter(err error, d time.Duration) *retriableError {
+	return &retriableError{err: err, after: d}
+}
+
 func (e retriableError) Error() string {
 	if e.err == nil {
 		return "retriable: <nil>"
@@ -32,12 +39,12 @@ func (e retriableError) Unwrap() error {
 
 // Do performs up to three retries with 1, 3 and 5 seconds. f is expected to
 // wrap retriable errors with RetriableError method to let Do know that a retry
-// should be performed.
+// should be performed, or with RetriableAfter to wait as long as it asks.
 func Do(ctx context.Context, f retriableFunc) error {
 	intervals := []time.Duration{1 * time.Second, 3 * time.Second, 5 * time.Second}
 
 	var err error
-	for _, interval := range intervals {
+	for i := 0; ; i++ {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
@@ -49,11 +56,18 @@ func Do(ctx context.Context, f retriableFunc) error {
 			return nil
 		}
 
-		var rerr retriableError
+		var rerr *retriableError
 		if !errors.As(err, &rerr) {
 			return err
 		}
+		if i == len(intervals) {
+			break
+		}
 
+		interval := intervals[i]
+		if rerr.after > 0 {
+			interval = rerr.after
+		}
 		timer := time.NewTimer(interval)
 		select {
 		case <-timer.C:
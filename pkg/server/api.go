@@ -0,0 +1,194 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	mw "github.com/a-tho/monitor/pkg/middleware"
+)
+
+// An APIError is an error the handlers respond with. The versioned routes
+// get it as the JSON body of the response, the others its message as plain
+// text.
+type APIError struct {
+	// Code identifies the error for programs
+	Code string `json:"code"`
+	// Message describes the error for people
+	Message string `json:"message"`
+	// Field is the request field at fault, if any
+	Field string `json:"field,omitempty"`
+	// Index is the item of a batch at fault, if any
+	Index *int `json:"index,omitempty"`
+
+	status int
+}
+
+// The errors the handlers respond with. Storage failures are reported with
+// storageError.
+var (
+	apiMetricPath    = apiError(http.StatusBadRequest, "invalid_path", errMetricPath, TypePath)
+	apiMetricType    = apiError(http.StatusBadRequest, "invalid_type", errMetricType, TypeQuery)
+	apiMetricName    = apiError(http.StatusBadRequest, "invalid_name", errMetricName, "id")
+	apiMetricValue   = apiError(http.StatusBadRequest, "invalid_value", errMetricValue, ValuePath)
+	apiMetricHTML    = apiError(http.StatusInternalServerError, "render_failed", errMetricHTML, "")
+	apiBatchKey      = apiError(http.StatusBadRequest, "invalid_idempotency_key", errBatchKey, IdempotencyKeyHeader)
+	apiBatchBusy     = apiError(http.StatusConflict, "batch_pending", errBatchBusy, IdempotencyKeyHeader)
+	apiBuckets       = apiError(http.StatusBadRequest, "bucket_mismatch", errBuckets, HistogramPath)
+	apiTimeRange     = apiError(http.StatusBadRequest, "invalid_time_range", errTimeRange, FromQuery)
+	apiMatchers      = apiError(http.StatusBadRequest, "invalid_matchers", errMatchers, MatchQuery)
+	apiLineProtocol  = apiError(http.StatusBadRequest, "invalid_line_protocol", errLineProtocol, "")
+	apiPrecision     = apiError(http.StatusBadRequest, "invalid_precision", errPrecision, PrecisionQuery)
+	apiQuery         = apiError(http.StatusBadRequest, "invalid_query", errQuery, "")
+	apiQueryCursor   = apiError(http.StatusBadRequest, "invalid_cursor", errQueryCursor, CursorQuery)
+	apiStreaming     = apiError(http.StatusInternalServerError, "streaming_unsupported", errStreaming, "")
+	apiFilter        = apiError(http.StatusBadRequest, "invalid_filter", errFilter, "")
+	apiForbiddenName = apiError(http.StatusForbidden, "forbidden_name", errForbiddenName, "id")
+	apiAuditQuery    = apiError(http.StatusBadRequest, "invalid_audit_query", errAuditQuery, "")
+)
+
+// apiError returns an error with the status code, code and message, caused
+// by the request field if not empty.
+func apiError(status int, code, message, field string) *APIError {
+	return &APIError{Code: code, Message: message, Field: field, status: status}
+}
+
+// storageError returns the error of a storage failure with the message.
+func storageError(message string) *APIError {
+	return apiError(http.StatusInternalServerError, "storage_failed", message, "")
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+// on returns the error as caused by the request field.
+func (e *APIError) on(field string) *APIError {
+	err := *e
+	err.Field = field
+	return &err
+}
+
+// at returns the error as caused by the item i of a batch.
+func (e *APIError) at(i int) *APIError {
+	err := *e
+	err.Index = &i
+	return &err
+}
+
+// detailed returns the error with the details after its message.
+func (e *APIError) detailed(format string, a ...any) *APIError {
+	err := *e
+	err.Message += ": " + fmt.Sprintf(format, a...)
+	return &err
+}
+
+// errorKey is the context key of the APIError a handler responded with.
+type errorKey struct{}
+
+// fail responds with the error, an internal server error unless it is an
+// APIError.
+func fail(w http.ResponseWriter, r *http.Request, err error) {
+	var e *APIError
+	if !errors.As(err, &e) {
+		e = apiError(http.StatusInternalServerError, "internal_server_error", http.StatusText(http.StatusInternalServerError), "")
+	}
+	if held, ok := r.Context().Value(errorKey{}).(**APIError); ok {
+		*held = e
+	}
+	http.Error(w, e.Message, e.status)
+}
+
+// statusError returns the error for the status code and message of an error
+// response that did not come from fail, such as the ones of the middleware.
+func statusError(status int, message string) *APIError {
+	code := strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_")
+	return apiError(status, code, message, "")
+}
+
+// writeError responds with the JSON error.
+func writeError(w http.ResponseWriter, e *APIError) {
+	w.Header().Set(contentType, typeApplicationJSON)
+	w.WriteHeader(e.status)
+	json.NewEncoder(w).Encode(e)
+}
+
+// errorResponseWriter holds back plain text error responses, for them to be
+// rewritten as JSON.
+type errorResponseWriter struct {
+	http.ResponseWriter
+	status int // of the error held back, 0 if none
+	body   bytes.Buffer
+}
+
+func (w *errorResponseWriter) WriteHeader(status int) {
+	if status >= http.StatusBadRequest && strings.HasPrefix(w.Header().Get(contentType), "text/plain") {
+		w.status = status
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *errorResponseWriter) Write(p []byte) (int, error) {
+	if w.status != 0 {
+		return w.body.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush lets streaming handlers flush through.
+func (w *errorResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok && w.status == 0 {
+		flusher.Flush()
+	}
+}
+
+// message returns the message of the error held back.
+func (w *errorResponseWriter) message() string {
+	var body io.Reader = &w.body
+	if w.Header().Get(contentEncoding) == encodingGzip {
+		zr, err := gzip.NewReader(body)
+		if err != nil {
+			return http.StatusText(w.status)
+		}
+		body = zr
+	}
+	message, err := io.ReadAll(body)
+	if err != nil {
+		return http.StatusText(w.status)
+	}
+	return strings.TrimSpace(string(message))
+}
+
+// withJSONErrors turns the plain text errors of the handlers and middleware
+// into APIError bodies on the versioned routes. The handlers' errors are
+// rendered as they reported them to fail, the others after their status.
+func withJSONErrors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, APIPath+"/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var failed *APIError
+		ew := &errorResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(ew, r.WithContext(context.WithValue(r.Context(), errorKey{}, &failed)))
+		if ew.status == 0 {
+			return
+		}
+
+		if failed == nil || failed.status != ew.status {
+			failed = statusError(ew.status, ew.message())
+		}
+		w.Header().Del(contentEncoding)
+		// The signature is of the plain text body
+		w.Header().Del(mw.SignatureHeader)
+		writeError(w, failed)
+	})
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	mw "github.com/a-tho/monitor/pkg/middleware"
+	"github.com/a-tho/monitor/pkg/storage"
+)
+
+func TestServerAPIErrors(t *testing.T) {
+	metrics, err := storage.New(context.Background(), storage.Options{}, "memory://")
+	require.NoError(t, err)
+	_, subnet, err := net.ParseCIDR("10.0.0.0/8")
+	require.NoError(t, err)
+	_, loopback, err := net.ParseCIDR("127.0.0.0/8")
+	require.NoError(t, err)
+
+	// The test client poses as a proxy
+	srv := httptest.NewServer(NewServer(metrics, "", WithTrustedSubnet(subnet), WithTrustedProxies(loopback)))
+	defer srv.Close()
+
+	trusted := map[string]string{mw.RealIPHeader: "10.0.0.1", contentType: typeApplicationJSON}
+	second := 1
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		headers map[string]string
+		body    string
+		code    int
+		want    APIError
+	}{
+		{
+			name:    "invalid type",
+			method:  http.MethodPost,
+			path:    "/" + UpdPath + "/",
+			headers: trusted,
+			body:    `{"id":"Alloc","type":"meter","value":1}`,
+			code:    http.StatusBadRequest,
+			want:    APIError{Code: "invalid_type", Message: errMetricType, Field: TypeQuery},
+		},
+		{
+			name:    "counter delta",
+			method:  http.MethodPost,
+			path:    "/" + UpdPath + "/",
+			headers: trusted,
+			body:    `{"id":"PollCount","type":"counter","value":1}`,
+			code:    http.StatusBadRequest,
+			want:    APIError{Code: "invalid_value", Message: errMetricValue, Field: "delta"},
+		},
+		{
+			name:    "batch item",
+			method:  http.MethodPost,
+			path:    "/" + UpdsPath + "/",
+			headers: trusted,
+			body:    `[{"id":"Alloc","type":"gauge","value":1},{"id":"PollCount","type":"counter"}]`,
+			code:    http.StatusBadRequest,
+			want:    APIError{Code: "invalid_value", Message: errMetricValue, Field: "delta", Index: &second},
+		},
+		{
+			name:    "compressed response",
+			method:  http.MethodPost,
+			path:    "/" + UpdPath + "/",
+			headers: map[string]string{mw.RealIPHeader: "10.0.0.1", contentType: typeApplicationJSON, acceptEncoding: encodingGzip},
+			body:    `{"id":"Alloc","type":"gauge"}`,
+			code:    http.StatusBadRequest,
+			want:    APIError{Code: "invalid_value", Message: errMetricValue, Field: ValuePath},
+		},
+		{
+			name:    "detailed message",
+			method:  http.MethodPost,
+			path:    "/" + WritePath,
+			headers: trusted,
+			body:    "cpu usage=high",
+			code:    http.StatusBadRequest,
+			want:    APIError{Code: "invalid_line_protocol"},
+		},
+		{
+			name:    "middleware",
+			method:  http.MethodPost,
+			path:    "/" + UpdsPath + "/",
+			headers: map[string]string{mw.RealIPHeader: "192.168.0.1", contentType: typeApplicationJSON},
+			body:    `[]`,
+			code:    http.StatusForbidden,
+			want:    APIError{Code: "forbidden", Message: "untrusted client address"},
+		},
+		{
+			name:   "not found",
+			method: http.MethodGet,
+			path:   "/" + ValuePath + "/" + GaugePath + "/Alloc",
+			code:   http.StatusNotFound,
+			want:   APIError{Code: "not_found", Message: notFoundResponse[:len(notFoundResponse)-1]},
+		},
+		{
+			name:   "method not allowed",
+			method: http.MethodPut,
+			path:   "/" + UpdPath + "/",
+			code:   http.StatusMethodNotAllowed,
+			want:   APIError{Code: "method_not_allowed", Message: "Method Not Allowed"},
+		},
+		{
+			name:   "no route",
+			method: http.MethodGet,
+			path:   "/nowhere",
+			code:   http.StatusNotFound,
+			want:   APIError{Code: "not_found", Message: notFoundResponse[:len(notFoundResponse)-1]},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, srv.URL+APIPath+tt.path, strings.NewReader(tt.body))
+			require.NoError(t, err)
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			// Keep the transport from decompressing the body on its own
+			req.Header.Set(acceptEncoding, tt.headers[acceptEncoding])
+			resp, err := srv.Client().Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+
+			assert.Equal(t, tt.code, resp.StatusCode)
+			assert.Equal(t, typeApplicationJSON, resp.Header.Get(contentType))
+			assert.Empty(t, resp.Header.Get(contentEncoding))
+
+			var got APIError
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&got))
+			if tt.want.Message == "" {
+				assert.True(t, strings.HasPrefix(got.Message, errLineProtocol), got.Message)
+				got.Message = ""
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestServerAPIRoutes(t *testing.T) {
+	metrics, err := storage.New(context.Background(), storage.Options{}, "memory://")
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(NewServer(metrics, ""))
+	defer srv.Close()
+
+	headers := map[string]string{contentType: typeApplicationJSON}
+	resp, body := testRequest(t, srv, http.MethodPost, APIPath+"/"+UpdPath+"/", headers,
+		strings.NewReader(`{"id":"PollCount","type":"counter","delta":3}`))
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.JSONEq(t, `{"id":"PollCount","type":"counter","value":3}`, body)
+
+	// The legacy routes keep their plain text errors
+	resp, body = testRequest(t, srv, http.MethodPost, "/"+UpdPath+"/", headers,
+		strings.NewReader(`{"id":"PollCount","type":"meter","delta":3}`))
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, errMetricType+"\n", body)
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	monitor "github.com/a-tho/monitor/internal"
+	mw "github.com/a-tho/monitor/pkg/middleware"
+)
+
+const (
+	// defaultAuditLimit and maxAuditLimit bound the number of audit records
+	// returned at once.
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+
+	errAuditQuery = "invalid audit query"
+	errAuditTrail = "failed to read audit log"
+)
+
+// Audit handles requests for the audit records of the metric writes, oldest
+// first, selected by the query parameters:
+//
+//	metric  metric name or series key (all metrics by default)
+//	from    beginning of the time range (RFC 3339)
+//	to      end of the time range (RFC 3339), now by default
+//	limit   number of records, up to 1000 (100 by default)
+func (s *server) Audit(w http.ResponseWriter, r *http.Request) {
+	q, err := parseAuditQuery(r)
+	if err != nil {
+		fail(w, r, err)
+		return
+	}
+	if token, ok := mw.TokenFrom(r.Context()); ok {
+		q.Prefix = token.Prefix
+	}
+
+	records, err := s.audit.AuditTrail(r.Context(), q)
+	if err != nil {
+		fail(w, r, storageError(errAuditTrail))
+		return
+	}
+	if records == nil {
+		records = []monitor.AuditRecord{}
+	}
+
+	w.Header().Add(contentType, typeApplicationJSON)
+	enc := json.NewEncoder(w)
+	enc.Encode(records)
+}
+
+// parseAuditQuery builds an audit query from the query parameters.
+func parseAuditQuery(r *http.Request) (monitor.AuditQuery, error) {
+	params := r.URL.Query()
+	q := monitor.AuditQuery{Metric: params.Get(MetricQuery), Limit: defaultAuditLimit}
+
+	var err error
+	if q.From, q.To, err = timeRange(r); err != nil {
+		return q, apiTimeRange
+	}
+
+	if limitStr := params.Get(LimitQuery); limitStr != "" {
+		limit, err := strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 || limit > maxAuditLimit {
+			return q, apiAuditQuery.detailed("limit must be within 1 and %d", maxAuditLimit).on(LimitQuery)
+		}
+		q.Limit = limit
+	}
+	return q, nil
+}
+
+// record adds the records of the metrics written on behalf of the request to
+// the audit log, changes telling how each of them changed its series as the
+// storage saw it (see CommitBatch). The write is done by then, so failing to
+// record it is only logged.
+func (s *server) record(r *http.Request, batch []*monitor.Metrics, changes []monitor.Change) {
+	if s.audit == nil || len(batch) == 0 {
+		return
+	}
+
+	client := monitor.AuditRecord{
+		Time:   time.Now().UTC(),
+		IP:     mw.ClientIP(r),
+		RealIP: r.Header.Get(mw.RealIPHeader),
+	}
+	client.KeyID, _ = mw.KeyIDFrom(r.Context())
+	if token, ok := mw.TokenFrom(r.Context()); ok {
+		client.Token = token.Name
+	}
+
+	records := make([]monitor.AuditRecord, len(batch))
+	for i, metric := range batch {
+		record := client
+		record.ID, record.MType = metric.Key(), metric.MType
+		record.Old, record.New = changes[i].Old, changes[i].New
+		records[i] = record
+	}
+
+	// The client going away must not keep the write off the log
+	if err := s.audit.Audit(context.Background(), records...); err != nil {
+		log.Err(err).Int("records", len(records)).Msg("Failed to record audit")
+	}
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	monitor "github.com/a-tho/monitor/internal"
+	"github.com/a-tho/monitor/pkg/audit"
+	mw "github.com/a-tho/monitor/pkg/middleware"
+	"github.com/a-tho/monitor/pkg/storage"
+)
+
+func TestServerAudit(t *testing.T) {
+	metrics, err := storage.New(context.Background(), storage.Options{}, "memory://")
+	require.NoError(t, err)
+	_, err = metrics.SetGauge(context.Background(), "load", 1)
+	require.NoError(t, err)
+
+	auditLog, err := audit.OpenFile(filepath.Join(t.TempDir(), "audit.log"), 0, 0)
+	require.NoError(t, err)
+	defer auditLog.Close()
+
+	tokens := monitor.TokenFile{
+		monitor.HashToken("agent"): {Name: "agent", Scopes: []monitor.Scope{monitor.ScopeWrite}},
+		monitor.HashToken("admin"): {Name: "admin", Scopes: []monitor.Scope{monitor.ScopeAdmin}},
+	}
+	srv := httptest.NewServer(NewServer(metrics, "", WithAuditLog(auditLog), WithTokens(tokens)))
+	defer srv.Close()
+
+	writes := []struct {
+		path string
+		body string
+	}{
+		{path: "/update/gauge/load/2"},
+		{path: "/update/", body: `{"id":"hits","type":"counter","delta":3}`},
+		{path: "/updates/", body: `[{"id":"hits","type":"counter","delta":4},{"id":"load","type":"gauge","value":5}]`},
+		{path: "/updates/?results=true", body: `[{"id":"hits","type":"counter","delta":1},{"id":"load","type":"gauge"}]`},
+		{path: "/write", body: "load value=6"},
+	}
+	for _, write := range writes {
+		headers := map[string]string{
+			contentType:            typeApplicationJSON,
+			mw.AuthorizationHeader: "Bearer agent",
+			mw.RealIPHeader:        "192.168.0.7",
+		}
+		resp, _ := testRequest(t, srv, http.MethodPost, write.path, headers, strings.NewReader(write.body))
+		resp.Body.Close()
+		require.Less(t, resp.StatusCode, http.StatusBadRequest, write.path)
+	}
+
+	getTrail := func(t *testing.T, query string) []monitor.AuditRecord {
+		resp, body := testRequest(t, srv, http.MethodGet, "/audit/"+query, map[string]string{mw.AuthorizationHeader: "Bearer admin"}, nil)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var records []monitor.AuditRecord
+		require.NoError(t, json.Unmarshal([]byte(body), &records))
+		return records
+	}
+
+	records := getTrail(t, "")
+	require.Len(t, records, 6, "the rejected item is not recorded")
+	for _, record := range records {
+		assert.Equal(t, "127.0.0.1", record.IP)
+		assert.Equal(t, "192.168.0.7", record.RealIP)
+		assert.Equal(t, "agent", record.Token)
+		assert.False(t, record.Time.IsZero())
+	}
+
+	first := records[0]
+	assert.Equal(t, "load", first.ID)
+	assert.Equal(t, GaugePath, first.MType)
+	require.NotNil(t, first.Old)
+	assert.Equal(t, 1.0, *first.Old.Value)
+	assert.Equal(t, 2.0, *first.New.Value)
+
+	// Counters hold the accumulated values
+	hits := getTrail(t, "?metric=hits")
+	require.Len(t, hits, 3)
+	assert.Nil(t, hits[0].Old, "new series")
+	assert.Equal(t, int64(3), *hits[0].New.Delta)
+	assert.Equal(t, int64(3), *hits[1].Old.Delta)
+	assert.Equal(t, int64(7), *hits[1].New.Delta)
+	assert.Equal(t, int64(8), *hits[2].New.Delta)
+
+	// Line protocol writes are audited too
+	last := records[len(records)-1]
+	assert.Equal(t, "load", last.ID)
+	assert.Equal(t, 5.0, *last.Old.Value)
+	assert.Equal(t, 6.0, *last.New.Value)
+
+	assert.Len(t, getTrail(t, "?metric=load&limit=1"), 1)
+	assert.Empty(t, getTrail(t, "?to=2000-01-01T00:00:00Z"))
+
+	// Only admins read the audit log
+	resp, _ := testRequest(t, srv, http.MethodGet, "/audit/", map[string]string{mw.AuthorizationHeader: "Bearer agent"}, nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	resp, _ = testRequest(t, srv, http.MethodGet, "/audit/?limit=0", map[string]string{mw.AuthorizationHeader: "Bearer admin"}, nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
@@ -0,0 +1,27 @@
+package server
+
+import (
+	"context"
+
+	monitor "github.com/a-tho/monitor/internal"
+	mw "github.com/a-tho/monitor/pkg/middleware"
+)
+
+const errForbiddenName = "metric name outside of the token prefix"
+
+// permitted tells whether the token of the request of ctx, if any, may act
+// upon the metric name or series key.
+func permitted(ctx context.Context, name string) bool {
+	token, ok := mw.TokenFrom(ctx)
+	return !ok || token.Permits(name)
+}
+
+// tokenMatchers returns the matchers narrowing down a listing to the series
+// the token of the request of ctx may read.
+func tokenMatchers(ctx context.Context) monitor.Matchers {
+	token, ok := mw.TokenFrom(ctx)
+	if !ok {
+		return nil
+	}
+	return token.Matchers()
+}
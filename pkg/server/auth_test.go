@@ -0,0 +1,90 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	monitor "github.com/a-tho/monitor/internal"
+	"github.com/a-tho/monitor/pkg/storage"
+)
+
+func TestServerTokens(t *testing.T) {
+	metrics, err := storage.New(context.Background(), storage.Options{}, "memory://")
+	require.NoError(t, err)
+	_, err = metrics.SetGauge(context.Background(), "app.load", 1)
+	require.NoError(t, err)
+	_, err = metrics.SetGauge(context.Background(), "db.load", 2)
+	require.NoError(t, err)
+
+	tokens, err := monitor.ParseTokens(strings.NewReader(strings.Join([]string{
+		"dashboard " + monitor.HashToken("dash") + " read",
+		"app-dashboard " + monitor.HashToken("app-dash") + " read app.",
+		"agent " + monitor.HashToken("agent") + " write",
+		"app-agent " + monitor.HashToken("app-agent") + " write app.",
+		"admin " + monitor.HashToken("admin") + " admin",
+	}, "\n")))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(NewServer(metrics, "", WithTokens(tokens)))
+	defer srv.Close()
+
+	tests := []struct {
+		name   string
+		token  string
+		method string
+		path   string
+		body   string
+		code   int
+		want   string
+	}{
+		{name: "no token", method: http.MethodGet, path: "/value/gauge/app.load", code: http.StatusUnauthorized},
+		{name: "unknown token", token: "nope", method: http.MethodGet, path: "/value/gauge/app.load", code: http.StatusUnauthorized},
+		{name: "read", token: "dash", method: http.MethodGet, path: "/value/gauge/db.load", code: http.StatusOK, want: "2"},
+		{name: "read all", token: "dash", method: http.MethodGet, path: "/", code: http.StatusOK, want: "db.load"},
+		{name: "read without write", token: "dash", method: http.MethodPost, path: "/update/gauge/app.load/3", code: http.StatusForbidden},
+		{name: "read in prefix", token: "app-dash", method: http.MethodGet, path: "/value/gauge/app.load", code: http.StatusOK, want: "1"},
+		{name: "read out of prefix", token: "app-dash", method: http.MethodGet, path: "/value/gauge/db.load", code: http.StatusForbidden},
+		{name: "write without read", token: "agent", method: http.MethodGet, path: "/value/gauge/app.load", code: http.StatusForbidden},
+		{name: "write", token: "agent", method: http.MethodPost, path: "/updates/", body: `[{"id":"db.load","type":"gauge","value":4}]`, code: http.StatusOK},
+		{name: "write in prefix", token: "app-agent", method: http.MethodPost, path: "/updates/", body: `[{"id":"app.load","type":"gauge","value":5}]`, code: http.StatusOK},
+		{name: "write out of prefix", token: "app-agent", method: http.MethodPost, path: "/updates/", body: `[{"id":"app.load","type":"gauge","value":6},{"id":"db.load","type":"gauge","value":6}]`, code: http.StatusForbidden},
+		{name: "delete without admin", token: "agent", method: http.MethodDelete, path: "/value/gauge/db.load", code: http.StatusForbidden},
+		{name: "admin reads", token: "admin", method: http.MethodGet, path: "/value/gauge/db.load", code: http.StatusOK, want: "4"},
+		{name: "admin deletes", token: "admin", method: http.MethodDelete, path: "/value/gauge/db.load", code: http.StatusOK},
+		{name: "ping", method: http.MethodGet, path: "/ping", code: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := map[string]string{contentType: typeApplicationJSON}
+			if tt.token != "" {
+				headers["Authorization"] = "Bearer " + tt.token
+			}
+			resp, body := testRequest(t, srv, tt.method, tt.path, headers, strings.NewReader(tt.body))
+			resp.Body.Close()
+			assert.Equal(t, tt.code, resp.StatusCode)
+			assert.Contains(t, body, tt.want)
+		})
+	}
+
+	// The rejected batch left no trace
+	v, ok := metrics.GetGauge(context.Background(), "app.load")
+	require.True(t, ok)
+	assert.Equal(t, monitor.Gauge(5), v)
+
+	// Listings only show the metrics of the prefix
+	_, err = metrics.SetGauge(context.Background(), "db.load", 7)
+	require.NoError(t, err)
+	for _, path := range []string{"/", "/" + MetricsPath, "/" + QueryPath + "/"} {
+		resp, body := testRequest(t, srv, http.MethodGet, path, map[string]string{"Authorization": "Bearer app-dash"}, nil)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode, path)
+		assert.Contains(t, body, "app", path)
+		assert.NotContains(t, body, "db", path)
+	}
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+
+	monitor "github.com/a-tho/monitor/internal"
+)
+
+const (
+	errExposition = "failed to expose metrics"
+
+	typeTextExposition = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+// Metrics handles requests for all gauges and counters in the Prometheus
+// text exposition format.
+func (s *server) Metrics(w http.ResponseWriter, r *http.Request) {
+	gauges, err := readSeries(r.Context(), s.metrics.StringGauge)
+	if err != nil {
+		fail(w, r, storageError(errExposition))
+		return
+	}
+	counters, err := readSeries(r.Context(), s.metrics.StringCounter)
+	if err != nil {
+		fail(w, r, storageError(errExposition))
+		return
+	}
+
+	w.Header().Add(contentType, typeTextExposition)
+	families := make(map[string]string)
+	writeFamilies(w, GaugePath, gauges, families)
+	writeFamilies(w, CounterPath, counters, families)
+}
+
+// exposedSeries is a series with its name sanitized for exposition.
+type exposedSeries struct {
+	id     string
+	name   string
+	labels monitor.Labels
+	value  float64
+}
+
+// readSeries reads the series of one metric type from the JSON object
+// produced by stringer, sorted by name and labels. Series whose keys cannot
+// be parsed, or that the token of the request may not read, are skipped.
+func readSeries(ctx context.Context, stringer func(context.Context) (string, error)) ([]exposedSeries, error) {
+	enc, err := stringer(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var values map[string]float64
+	if err = json.Unmarshal([]byte(enc), &values); err != nil {
+		return nil, err
+	}
+
+	series := make([]exposedSeries, 0, len(values))
+	for key, value := range values {
+		name, labels, err := monitor.ParseSeriesKey(key)
+		if err != nil || !permitted(ctx, name) {
+			continue
+		}
+		series = append(series, exposedSeries{id: name, name: sanitizeName(name), labels: labels, value: value})
+	}
+	sort.Slice(series, func(i, j int) bool {
+		if series[i].name != series[j].name {
+			return series[i].name < series[j].name
+		}
+		if li, lj := series[i].labels.String(), series[j].labels.String(); li != lj {
+			return li < lj
+		}
+		return series[i].id < series[j].id
+	})
+	return series, nil
+}
+
+// writeFamilies writes the sorted series of the metric type typ, preceding
+// each metric family with its HELP and TYPE lines. Names may collide once
+// sanitized: families already written with another type, recorded in
+// families, are skipped, and so are series repeating the name and labels of
+// the previous one.
+func writeFamilies(w io.Writer, typ string, series []exposedSeries, families map[string]string) {
+	for i, s := range series {
+		if other, ok := families[s.name]; ok && other != typ {
+			log.Warn().Str("metric", s.id).Str("type", typ).Str("family", s.name).
+				Msgf("metric family already exposed as a %s, skipped", other)
+			continue
+		}
+		if i == 0 || series[i-1].name != s.name {
+			families[s.name] = typ
+			fmt.Fprintf(w, "# HELP %s The %s %s.\n", s.name, typ, s.name)
+			fmt.Fprintf(w, "# TYPE %s %s\n", s.name, typ)
+		} else if formatLabels(series[i-1].labels) == formatLabels(s.labels) {
+			log.Warn().Str("metric", s.id).Str("type", typ).Str("family", s.name).
+				Msgf("series already exposed as %s, skipped", series[i-1].id)
+			continue
+		}
+		fmt.Fprintf(w, "%s%s %s\n", s.name, formatLabels(s.labels), formatValue(s.value))
+	}
+}
+
+// sanitizeName replaces the characters not allowed in Prometheus metric names
+// with underscores.
+func sanitizeName(name string) string {
+	var b strings.Builder
+	for i, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_', r == ':':
+		case r >= '0' && r <= '9':
+			if i == 0 {
+				b.WriteByte('_')
+			}
+		default:
+			r = '_'
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// formatLabels formats labels as {name="value",...} sorted by name, escaping
+// values as the exposition format requires.
+func formatLabels(labels monitor.Labels) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	escaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `%s="%s"`, name, escaper.Replace(labels[name]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	monitor "github.com/a-tho/monitor/internal"
+	"github.com/a-tho/monitor/pkg/storage"
+)
+
+func TestServerMetricsHandler(t *testing.T) {
+	ctx := context.Background()
+	metrics, err := storage.New(ctx, storage.Options{}, "memory://")
+	require.NoError(t, err)
+	metrics.SetGauge(ctx, `CPUutilization{cpu="1"}`, monitor.Gauge(12.5))
+	metrics.SetGauge(ctx, `CPUutilization{cpu="0"}`, monitor.Gauge(3))
+	metrics.SetGauge(ctx, `Path{dir="C:\\ \"x\""}`, monitor.Gauge(1))
+	metrics.AddCounter(ctx, "Poll.Count", monitor.Counter(5))
+
+	srv := httptest.NewServer(NewServer(metrics, ""))
+	defer srv.Close()
+
+	resp, respBody := testRequest(t, srv, http.MethodGet, "/"+MetricsPath, nil, nil)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, typeTextExposition, resp.Header.Get(contentType))
+	assert.Equal(t, `# HELP CPUutilization The gauge CPUutilization.
+# TYPE CPUutilization gauge
+CPUutilization{cpu="0"} 3
+CPUutilization{cpu="1"} 12.5
+# HELP Path The gauge Path.
+# TYPE Path gauge
+Path{dir="C:\\ \"x\""} 1
+# HELP Poll_Count The counter Poll_Count.
+# TYPE Poll_Count counter
+Poll_Count 5
+`, respBody)
+}
+
+func TestServerMetricsHandlerCollisions(t *testing.T) {
+	ctx := context.Background()
+	metrics, err := storage.New(ctx, storage.Options{}, "memory://")
+	require.NoError(t, err)
+	metrics.SetGauge(ctx, "Requests", monitor.Gauge(3))
+	metrics.AddCounter(ctx, "Requests", monitor.Counter(7))
+	metrics.SetGauge(ctx, `Heap.Alloc{host="a"}`, monitor.Gauge(1))
+	metrics.SetGauge(ctx, `Heap_Alloc{host="a"}`, monitor.Gauge(2))
+	metrics.SetGauge(ctx, `Heap_Alloc{host="b"}`, monitor.Gauge(4))
+
+	srv := httptest.NewServer(NewServer(metrics, ""))
+	defer srv.Close()
+
+	resp, respBody := testRequest(t, srv, http.MethodGet, "/"+MetricsPath, nil, nil)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, `# HELP Heap_Alloc The gauge Heap_Alloc.
+# TYPE Heap_Alloc gauge
+Heap_Alloc{host="a"} 1
+Heap_Alloc{host="b"} 4
+# HELP Requests The gauge Requests.
+# TYPE Requests gauge
+Requests 3
+`, respBody)
+}
+
+func TestSanitizeName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: "Alloc", want: "Alloc"},
+		{name: "http.requests-total", want: "http_requests_total"},
+		{name: "9lives", want: "_9lives"},
+		{name: "ns:metric_1", want: "ns:metric_1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, sanitizeName(tt.name))
+		})
+	}
+}
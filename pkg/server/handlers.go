@@ -4,8 +4,11 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
+	"net/url"
 	"strconv"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 
@@ -13,7 +16,8 @@ import (
 )
 
 const (
-	batchSize = 1000
+	// maxIdempotencyKeyLen bounds the length of batch idempotency keys
+	maxIdempotencyKeyLen = 128
 
 	errPostMethod  = "use POST for saving metrics"
 	errMetricPath  = "invalid metric path"
@@ -23,6 +27,17 @@ const (
 	errMetricHTML  = "failed to generate HTML page with metrics"
 	errDecompress  = "failed to decompress request body"
 	errSetGauge    = "failed to set gauge value"
+	errAddCounter  = "failed to add counter value"
+	errTimeRange   = "invalid time range"
+	errHistory     = "failed to get metric history"
+	errMatchers    = "invalid label matchers"
+	errBuckets     = "histogram buckets do not match"
+	errAddMetric   = "failed to add metric value"
+	errDelete      = "failed to delete metric"
+	errBatchKey    = "invalid idempotency key"
+	errClaimBatch  = "failed to check idempotency key"
+	errBatchBusy   = "batch with this idempotency key is being applied"
+	errApplyBatch  = "failed to apply batch, no metrics were saved"
 
 	// HTML
 	metricsTemplate = `
@@ -53,38 +68,60 @@ const (
 // UpdateLegacy handles requests for adding a metrics instance.
 func (s *server) UpdateLegacy(w http.ResponseWriter, r *http.Request) {
 	typ := chi.URLParam(r, TypePath)
-	name := chi.URLParam(r, NamePath)
 	value := chi.URLParam(r, ValuePath)
-	if name == "" {
+	if chi.URLParam(r, NamePath) == "" {
 		http.NotFound(w, r)
 		return
 	}
+	name, err := seriesKey(r)
+	if err != nil {
+		fail(w, r, apiMetricName)
+		return
+	}
+	if !permitted(r.Context(), name) {
+		fail(w, r, apiForbiddenName)
+		return
+	}
 
+	update := monitor.Metrics{ID: name, MType: typ}
+	var errMsg string
 	switch typ {
 	case GaugePath:
 		v, err := strconv.ParseFloat(value, 64)
 		if err != nil {
-			http.Error(w, errMetricValue, http.StatusBadRequest)
-			return
-		}
-		_, err = s.metrics.SetGauge(r.Context(), name, monitor.Gauge(v))
-		if err != nil {
-			http.Error(w, errSetGauge, http.StatusInternalServerError)
+			fail(w, r, apiMetricValue)
 			return
 		}
+		update.Value, errMsg = &v, errSetGauge
 	case CounterPath:
 		v, err := strconv.ParseInt(value, 10, 64)
 		if err != nil {
-			http.Error(w, errMetricValue, http.StatusBadRequest)
+			fail(w, r, apiMetricValue)
 			return
 		}
-		_, err = s.metrics.AddCounter(r.Context(), name, monitor.Counter(v))
+		update.Delta, errMsg = &v, errAddCounter
+	case SummaryPath:
+		// A single observation fits in the URL, histograms need the buckets
+		// and go through the JSON handlers
+		v, err := strconv.ParseFloat(value, 64)
 		if err != nil {
-			http.Error(w, errSetGauge, http.StatusInternalServerError)
+			fail(w, r, apiMetricValue)
 			return
 		}
+		update.Summary, errMsg = &monitor.Summary{Observations: []float64{v}}, errAddMetric
 	default:
-		http.Error(w, errMetricPath, http.StatusBadRequest)
+		fail(w, r, apiMetricPath)
+		return
+	}
+
+	if _, err := s.update(r, &update, errMsg); err != nil {
+		fail(w, r, err)
+		return
+	}
+
+	// Split the labels back out of the series key
+	if err = update.Normalize(); err == nil {
+		s.hub.Publish(&update)
 	}
 }
 
@@ -99,7 +136,15 @@ func (s *server) Update(w http.ResponseWriter, r *http.Request) {
 	dec := json.NewDecoder(r.Body)
 	err := dec.Decode(&input)
 	if err != nil {
-		http.Error(w, errMetricValue, http.StatusBadRequest)
+		fail(w, r, apiMetricValue.on(""))
+		return
+	}
+	if err = input.Normalize(); err != nil {
+		fail(w, r, apiMetricName)
+		return
+	}
+	if !permitted(r.Context(), input.ID) {
+		fail(w, r, apiForbiddenName)
 		return
 	}
 
@@ -108,117 +153,190 @@ func (s *server) Update(w http.ResponseWriter, r *http.Request) {
 	case GaugePath:
 
 		if input.Value == nil {
-			http.Error(w, errMetricValue, http.StatusBadRequest)
+			fail(w, r, apiMetricValue.on("value"))
 			return
 		}
-		_, err = s.metrics.SetGauge(r.Context(), input.ID, monitor.Gauge(*input.Value))
-		if err != nil {
-			http.Error(w, errSetGauge, http.StatusInternalServerError)
+		if _, err := s.update(r, &input, errSetGauge); err != nil {
+			fail(w, r, err)
 			return
 		}
+		s.hub.Publish(&input)
 
 		respValue = *input.Value
 
 	case CounterPath:
 
 		if input.Delta == nil {
-			http.Error(w, errMetricValue, http.StatusBadRequest)
+			fail(w, r, apiMetricValue.on("delta"))
 			return
 		}
-		_, err = s.metrics.AddCounter(r.Context(), input.ID, monitor.Counter(*input.Delta))
+		change, err := s.update(r, &input, errAddCounter)
 		if err != nil {
-			http.Error(w, errSetGauge, http.StatusInternalServerError)
+			fail(w, r, err)
 			return
 		}
+		s.hub.Publish(&input)
 
 		input.Delta = nil
-		counter, _ := s.metrics.GetCounter(r.Context(), input.ID)
-		respValue = float64(counter)
+		if change.New != nil && change.New.Delta != nil {
+			respValue = float64(*change.New.Delta)
+		}
+
+	case HistogramPath, SummaryPath:
+
+		if err := s.addDistribution(r, &input); err != nil {
+			fail(w, r, err)
+			return
+		}
+		s.hub.Publish(&input)
+		s.distribution(r.Context(), &input)
 
 	default:
-		http.Error(w, errMetricType, http.StatusBadRequest)
+		fail(w, r, apiMetricType)
 		return
 	}
 
-	input.Value = &respValue
+	if input.MType == GaugePath || input.MType == CounterPath {
+		input.Value = &respValue
+	}
 	w.Header().Add(contentType, typeApplicationJSON)
 	enc := json.NewEncoder(w)
 	enc.Encode(input)
 }
 
-// Updates handles requests for adding many metrics instances at once.
+// Updates handles requests for adding many metrics instances at once. A batch
+// carrying the idempotency key of a recently applied one is acknowledged
+// without being applied again, with 204 and no results if they were asked
+// for, as they are not kept. One carrying the key of a batch still being
+// applied is answered 409 for the client to retry later.
 func (s *server) Updates(w http.ResponseWriter, r *http.Request) {
 	if r.Header.Get(contentType) != typeApplicationJSON {
 		http.NotFound(w, r)
 		return
 	}
 
-	dec := json.NewDecoder(r.Body)
+	results, _ := strconv.ParseBool(r.URL.Query().Get(ResultsQuery))
+	key := r.Header.Get(IdempotencyKeyHeader)
+	if key != "" {
+		if len(key) > maxIdempotencyKeyLen {
+			fail(w, r, apiBatchKey)
+			return
+		}
+		state, err := s.metrics.ClaimBatch(r.Context(), key)
+		if err != nil {
+			fail(w, r, storageError(errClaimBatch))
+			return
+		}
+		switch state {
+		case monitor.BatchApplied:
+			w.Header().Set(IdempotentReplayedHeader, "true")
+			if results {
+				w.WriteHeader(http.StatusNoContent)
+			}
+			return
+		case monitor.BatchPending:
+			w.Header().Set("Retry-After", "1")
+			fail(w, r, apiBatchBusy)
+			return
+		}
+	}
 
-	token, err := dec.Token()
-	if err != nil || token.(json.Delim) != '[' {
-		http.Error(w, errMetricValue, http.StatusBadRequest)
+	if results {
+		s.updatesWithResults(w, r, key)
 		return
 	}
 
-	batchGauge := make([]*monitor.Metrics, 0, batchSize)
-	batchCounter := make([]*monitor.Metrics, 0, batchSize)
-	for dec.More() {
-		metric := &monitor.Metrics{}
-		if err = dec.Decode(metric); err != nil {
-			http.Error(w, errMetricValue, http.StatusBadRequest)
-			return
+	if err := s.applyUpdates(r.Context(), r, key); err != nil {
+		// Let the client retry a batch that did not get through
+		if key != "" {
+			s.metrics.ReleaseBatch(context.Background(), key)
 		}
+		fail(w, r, err)
+	}
+}
 
-		switch metric.MType {
-		case GaugePath:
-			if metric.Value == nil {
-				http.Error(w, errMetricValue, http.StatusBadRequest)
-				return
-			}
-			batchGauge = append(batchGauge, metric)
-			if len(batchGauge) >= batchSize {
-				_, err = s.metrics.SetGaugeBatch(r.Context(), batchGauge)
-				if err != nil {
-					http.Error(w, errMetricValue, http.StatusBadRequest)
-					return
-				}
-				batchGauge = batchGauge[:0]
-			}
+// applyUpdates decodes a JSON array of metrics from the request body and
+// applies them all at once along with the idempotency key, if any, so that a
+// rejected batch leaves no trace. On failure it returns the error to report,
+// pointing at the item at fault if any.
+func (s *server) applyUpdates(ctx context.Context, r *http.Request, key string) error {
+	dec := json.NewDecoder(r.Body)
 
-		case CounterPath:
-			if metric.Delta == nil {
-				http.Error(w, errMetricValue, http.StatusBadRequest)
-				return
-			}
-			batchCounter = append(batchCounter, metric)
-			if len(batchCounter) >= batchSize {
-				_, err = s.metrics.AddCounterBatch(r.Context(), batchCounter)
-				if err != nil {
-					http.Error(w, errMetricValue, http.StatusBadRequest)
-					return
-				}
-				batchCounter = batchCounter[:0]
-			}
+	token, err := dec.Token()
+	if err != nil || token != json.Delim('[') {
+		return apiMetricValue.on("")
+	}
 
-		default:
-			http.Error(w, errMetricType, http.StatusBadRequest)
-			return
+	var batch []*monitor.Metrics
+	for i := 0; dec.More(); i++ {
+		metric := &monitor.Metrics{}
+		if err = dec.Decode(metric); err != nil {
+			return apiMetricValue.on("").at(i)
+		}
+		if err := checkUpdate(metric); err != nil {
+			return err.at(i)
+		}
+		if !permitted(ctx, metric.ID) {
+			return apiForbiddenName.at(i)
 		}
+		batch = append(batch, metric)
 	}
+	if _, err = dec.Token(); err != nil {
+		return apiMetricValue.on("")
+	}
+	if len(batch) == 0 && key == "" {
+		return nil
+	}
+
+	if _, err := s.commit(r, key, batch, errApplyBatch); err != nil {
+		return err
+	}
+	s.hub.Publish(batch...)
+	return nil
+}
 
-	if len(batchGauge) > 0 {
-		s.metrics.SetGaugeBatch(r.Context(), batchGauge)
+// checkUpdate normalizes a metric update and checks that it carries a value
+// of its type, returning the error naming the field at fault otherwise.
+func checkUpdate(metric *monitor.Metrics) *APIError {
+	if err := metric.Normalize(); err != nil {
+		return apiMetricName
 	}
-	if len(batchCounter) > 0 {
-		s.metrics.AddCounterBatch(r.Context(), batchCounter)
+
+	switch metric.MType {
+	case GaugePath:
+		if metric.Value == nil {
+			return apiMetricValue.on("value")
+		}
+	case CounterPath:
+		if metric.Delta == nil {
+			return apiMetricValue.on("delta")
+		}
+	case HistogramPath:
+		if !validDistribution(metric) {
+			return apiMetricValue.on("histogram")
+		}
+	case SummaryPath:
+		if !validDistribution(metric) {
+			return apiMetricValue.on("summary")
+		}
+	default:
+		return apiMetricType
 	}
+	return nil
 }
 
 // ValueLegacy handles requests for getting a metrics instance.
 func (s *server) ValueLegacy(w http.ResponseWriter, r *http.Request) {
-	typ := chi.URLParam(r, "type")
-	name := chi.URLParam(r, "name")
+	typ := chi.URLParam(r, TypePath)
+	name, err := seriesKey(r)
+	if err != nil {
+		fail(w, r, apiMetricName)
+		return
+	}
+	if !permitted(r.Context(), name) {
+		fail(w, r, apiForbiddenName)
+		return
+	}
 
 	switch typ {
 	case GaugePath:
@@ -237,8 +355,21 @@ func (s *server) ValueLegacy(w http.ResponseWriter, r *http.Request) {
 		}
 		v := strconv.FormatInt(int64(value), 10)
 		w.Write([]byte(v))
+	case HistogramPath, SummaryPath:
+		metric := monitor.Metrics{ID: name, MType: typ}
+		if !s.distribution(r.Context(), &metric) {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Add(contentType, typeApplicationJSON)
+		enc := json.NewEncoder(w)
+		if typ == HistogramPath {
+			enc.Encode(metric.Histogram)
+		} else {
+			enc.Encode(metric.Summary)
+		}
 	default:
-		http.Error(w, errMetricPath, http.StatusBadRequest)
+		fail(w, r, apiMetricPath)
 	}
 }
 
@@ -253,18 +384,26 @@ func (s *server) Value(w http.ResponseWriter, r *http.Request) {
 	dec := json.NewDecoder(r.Body)
 	err := dec.Decode(&input)
 	if err != nil {
-		http.Error(w, errMetricValue, http.StatusBadRequest)
+		fail(w, r, apiMetricValue.on(""))
 		return
 	}
 
 	if input.ID == "" {
-		http.Error(w, errMetricName, http.StatusBadRequest)
+		fail(w, r, apiMetricName)
+		return
+	}
+	if err = input.Normalize(); err != nil {
+		fail(w, r, apiMetricName)
+		return
+	}
+	if !permitted(r.Context(), input.ID) {
+		fail(w, r, apiForbiddenName)
 		return
 	}
 	switch input.MType {
 	case GaugePath:
 
-		val, ok := s.metrics.GetGauge(r.Context(), input.ID)
+		val, ok := s.metrics.GetGauge(r.Context(), input.Key())
 		if !ok {
 			http.NotFound(w, r)
 			return
@@ -274,7 +413,7 @@ func (s *server) Value(w http.ResponseWriter, r *http.Request) {
 
 	case CounterPath:
 
-		count, ok := s.metrics.GetCounter(r.Context(), input.ID)
+		count, ok := s.metrics.GetCounter(r.Context(), input.Key())
 		if !ok {
 			http.NotFound(w, r)
 			return
@@ -282,8 +421,15 @@ func (s *server) Value(w http.ResponseWriter, r *http.Request) {
 		countInt := int64(count)
 		input.Delta = &countInt
 
+	case HistogramPath, SummaryPath:
+
+		if !s.distribution(r.Context(), &input) {
+			http.NotFound(w, r)
+			return
+		}
+
 	default:
-		http.Error(w, errMetricType, http.StatusBadRequest)
+		fail(w, r, apiMetricType)
 		return
 	}
 
@@ -292,17 +438,59 @@ func (s *server) Value(w http.ResponseWriter, r *http.Request) {
 	enc.Encode(input)
 }
 
-// All handles requests for getting all metrics instances at once.
+// Delete handles requests for removing a metrics instance along with its
+// history.
+func (s *server) Delete(w http.ResponseWriter, r *http.Request) {
+	typ := chi.URLParam(r, TypePath)
+	name, err := seriesKey(r)
+	if err != nil {
+		fail(w, r, apiMetricName)
+		return
+	}
+	if !permitted(r.Context(), name) {
+		fail(w, r, apiForbiddenName)
+		return
+	}
+
+	switch typ {
+	case GaugePath, CounterPath, HistogramPath, SummaryPath:
+	default:
+		fail(w, r, apiMetricPath)
+		return
+	}
+
+	_, err = s.metrics.Delete(r.Context(), typ, name)
+	if errors.Is(err, monitor.ErrNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		fail(w, r, storageError(errDelete))
+		return
+	}
+}
+
+// All handles requests for getting all metrics instances at once, optionally
+// narrowed down by a selector in the match query parameter, e.g.
+// CPUutilization{cpu=~"0|1"}.
 func (s *server) All(w http.ResponseWriter, r *http.Request) {
+	matchers, err := monitor.ParseMatchers(r.URL.Query().Get(MatchQuery))
+	if err != nil {
+		fail(w, r, apiMatchers)
+		return
+	}
+
+	matchers = append(matchers, tokenMatchers(r.Context())...)
+
 	var gaugeBuf bytes.Buffer
-	if err := s.metrics.WriteAllGauge(r.Context(), &gaugeBuf); err != nil {
-		http.Error(w, errMetricHTML, http.StatusInternalServerError)
+	if err := s.metrics.WriteAllGauge(r.Context(), &gaugeBuf, matchers...); err != nil {
+		fail(w, r, apiMetricHTML)
 		return
 	}
 
 	var counterBuf bytes.Buffer
-	if err := s.metrics.WriteAllCounter(r.Context(), &counterBuf); err != nil {
-		http.Error(w, errMetricHTML, http.StatusInternalServerError)
+	if err := s.metrics.WriteAllCounter(r.Context(), &counterBuf, matchers...); err != nil {
+		fail(w, r, apiMetricHTML)
 		return
 	}
 
@@ -315,9 +503,165 @@ func (s *server) All(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(pageFooter))
 }
 
+// History handles requests for getting the values of a metrics instance
+// recorded between the optional from and to query parameters (RFC 3339).
+func (s *server) History(w http.ResponseWriter, r *http.Request) {
+	typ := chi.URLParam(r, TypePath)
+	name, err := seriesKey(r)
+	if err != nil {
+		fail(w, r, apiMetricName)
+		return
+	}
+	if !permitted(r.Context(), name) {
+		fail(w, r, apiForbiddenName)
+		return
+	}
+
+	from, to, err := timeRange(r)
+	if err != nil {
+		fail(w, r, apiTimeRange)
+		return
+	}
+
+	var samples []monitor.Sample
+	switch typ {
+	case GaugePath:
+		samples, err = s.metrics.GaugeHistory(r.Context(), name, from, to)
+	case CounterPath:
+		samples, err = s.metrics.CounterHistory(r.Context(), name, from, to)
+	default:
+		fail(w, r, apiMetricPath)
+		return
+	}
+	if err != nil {
+		fail(w, r, storageError(errHistory))
+		return
+	}
+	if samples == nil {
+		samples = []monitor.Sample{}
+	}
+
+	w.Header().Add(contentType, typeApplicationJSON)
+	enc := json.NewEncoder(w)
+	enc.Encode(samples)
+}
+
+// addDistribution validates the histogram or summary carried by the metric
+// and merges it into the stored one on behalf of the request. On failure it
+// returns the error to report.
+func (s *server) addDistribution(r *http.Request, metric *monitor.Metrics) error {
+	if !validDistribution(metric) {
+		return apiMetricValue.on(metric.MType)
+	}
+	_, err := s.update(r, metric, errAddMetric)
+	return err
+}
+
+// update applies a single metric on behalf of the request and records it in
+// the audit log, returning how it changed its series. On failure it returns
+// the error to report, a storage error with errMsg unless histogram buckets
+// do not match.
+func (s *server) update(r *http.Request, metric *monitor.Metrics, errMsg string) (monitor.Change, error) {
+	changes, err := s.commit(r, "", []*monitor.Metrics{metric}, errMsg)
+	if err != nil {
+		return monitor.Change{}, err
+	}
+	return changes[0], nil
+}
+
+// commit applies a batch along with its idempotency key, if any, on behalf of
+// the request and records it in the audit log, returning how every metric
+// changed its series. On failure it returns the error to report, a storage
+// error with errMsg unless histogram buckets do not match.
+func (s *server) commit(r *http.Request, key string, batch []*monitor.Metrics, errMsg string) ([]monitor.Change, error) {
+	changes, err := s.metrics.CommitBatch(r.Context(), key, batch)
+	switch {
+	case errors.Is(err, monitor.ErrBucketMismatch):
+		return nil, apiBuckets
+	case err != nil:
+		return nil, storageError(errMsg)
+	}
+	s.record(r, batch, changes)
+	return changes, nil
+}
+
+// validDistribution tells whether the metric carries a valid histogram or
+// summary according to its type.
+func validDistribution(metric *monitor.Metrics) bool {
+	switch metric.MType {
+	case HistogramPath:
+		return metric.Histogram != nil && metric.Histogram.Validate() == nil
+	case SummaryPath:
+		return metric.Summary != nil && metric.Summary.Validate() == nil
+	}
+	return false
+}
+
+// distribution fills in the stored histogram or summary of the metric. The
+// quantiles of a summary are computed on the way, and its observations are
+// left out. It reports whether the metric was found.
+func (s *server) distribution(ctx context.Context, metric *monitor.Metrics) bool {
+	switch metric.MType {
+	case HistogramPath:
+		h, ok := s.metrics.GetHistogram(ctx, metric.Key())
+		if !ok {
+			return false
+		}
+		metric.Histogram, metric.Summary = &h, nil
+	case SummaryPath:
+		sum, ok := s.metrics.GetSummary(ctx, metric.Key())
+		if !ok {
+			return false
+		}
+		sum.ComputeQuantiles(monitor.DefaultQuantiles())
+		sum.Observations = nil
+		metric.Histogram, metric.Summary = nil, &sum
+	default:
+		return false
+	}
+	return true
+}
+
+// seriesKey builds the series key from the name URL parameter, which may
+// carry labels as in CPUutilization{cpu="3"}.
+func seriesKey(r *http.Request) (string, error) {
+	name, err := url.PathUnescape(chi.URLParam(r, NamePath))
+	if err != nil {
+		return "", err
+	}
+
+	metric := monitor.Metrics{ID: name}
+	if err = metric.Normalize(); err != nil {
+		return "", err
+	}
+	return metric.Key(), nil
+}
+
+// timeRange parses the from and to query parameters, which default to the
+// beginning of time and now respectively.
+func timeRange(r *http.Request) (from, to time.Time, err error) {
+	to = time.Now()
+
+	query := r.URL.Query()
+	if fromStr := query.Get(FromQuery); fromStr != "" {
+		if from, err = time.Parse(time.RFC3339, fromStr); err != nil {
+			return
+		}
+	}
+	if toStr := query.Get(ToQuery); toStr != "" {
+		if to, err = time.Parse(time.RFC3339, toStr); err != nil {
+			return
+		}
+	}
+	if to.Before(from) {
+		err = errors.New("to precedes from")
+	}
+	return
+}
+
 func (s *server) Ping(w http.ResponseWriter, r *http.Request) {
 	if err := s.metrics.PingContext(context.TODO()); err != nil {
-		http.Error(w, "ping unsuccessful", http.StatusInternalServerError)
+		fail(w, r, storageError("ping unsuccessful"))
 	}
 	w.Write(nil)
 }
@@ -4,9 +4,12 @@ import (
 	"bytes"
 	"compress/gzip"
 	"context"
+	"crypto/rand"
+	"crypto/rsa"
 	"encoding/json"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"strconv"
@@ -19,6 +22,8 @@ import (
 	"github.com/stretchr/testify/require"
 
 	monitor "github.com/a-tho/monitor/internal"
+	"github.com/a-tho/monitor/pkg/encryption"
+	mw "github.com/a-tho/monitor/pkg/middleware"
 	"github.com/a-tho/monitor/pkg/storage"
 )
 
@@ -174,7 +179,7 @@ func TestServerUpdLegacyHandler(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			metrics, err := storage.New(context.Background(), "", "", 5, false)
+			metrics, err := storage.New(context.Background(), storage.Options{StoreInterval: 5}, "memory://")
 			if assert.NoError(t, err) {
 				srv := httptest.NewServer(NewServer(metrics, ""))
 				defer srv.Close()
@@ -294,11 +299,47 @@ func TestServerUpdHandler(t *testing.T) {
 				counter:     "{}",
 			},
 		},
+		{
+			name: "valid gauge request with labels",
+			request: request{
+				method: http.MethodPost,
+				path:   "/" + UpdPath + "/",
+				body: strings.NewReader(
+					`{"id":"CPUutilization","type":"gauge","value":3,"labels":{"cpu":"1"}}`,
+				),
+				headers: map[string]string{contentType: typeApplicationJSON},
+			},
+			want: want{
+				code:        http.StatusOK,
+				respBody:    `{"id":"CPUutilization","type":"gauge","value":3,"labels":{"cpu":"1"}}` + "\n",
+				contentType: typeApplicationJSON,
+				gauge:       `{"CPUutilization{cpu=\"1\"}": 3}`,
+				counter:     "{}",
+			},
+		},
+		{
+			name: "invalid label name",
+			request: request{
+				method: http.MethodPost,
+				path:   "/" + UpdPath + "/",
+				body: strings.NewReader(
+					`{"id":"CPUutilization","type":"gauge","value":3,"labels":{"1cpu":"1"}}`,
+				),
+				headers: map[string]string{contentType: typeApplicationJSON},
+			},
+			want: want{
+				code:        http.StatusBadRequest,
+				respBody:    errMetricName + "\n",
+				contentType: textPlain,
+				gauge:       `{}`,
+				counter:     "{}",
+			},
+		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			metrics, err := storage.New(context.Background(), "", "", 5, false)
+			metrics, err := storage.New(context.Background(), storage.Options{StoreInterval: 5}, "memory://")
 			if assert.NoError(t, err) {
 				srv := httptest.NewServer(NewServer(metrics, ""))
 				defer srv.Close()
@@ -330,6 +371,224 @@ func TestServerUpdHandler(t *testing.T) {
 	}
 }
 
+func TestServerHistoryHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		path       string
+		wantCode   int
+		wantDeltas []int64
+	}{
+		{
+			name:       "counter history",
+			path:       "/" + HistoryPath + "/" + CounterPath + "/" + "Nile",
+			wantCode:   http.StatusOK,
+			wantDeltas: []int64{3, 5},
+		},
+		{
+			name:       "no such metric",
+			path:       "/" + HistoryPath + "/" + CounterPath + "/" + "Amazon",
+			wantCode:   http.StatusOK,
+			wantDeltas: []int64{},
+		},
+		{
+			name:     "wrong metric type",
+			path:     "/" + HistoryPath + "/" + "wrongtype" + "/" + "Nile",
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "invalid time range",
+			path:     "/" + HistoryPath + "/" + CounterPath + "/" + "Nile?" + FromQuery + "=yesterday",
+			wantCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metrics, err := storage.New(context.Background(), storage.Options{}, "memory://")
+			require.NoError(t, err)
+			metrics.AddCounter(context.Background(), "Nile", monitor.Counter(3))
+			metrics.AddCounter(context.Background(), "Nile", monitor.Counter(2))
+
+			srv := httptest.NewServer(NewServer(metrics, ""))
+			defer srv.Close()
+
+			resp, respBody := testRequest(t, srv, http.MethodGet, tt.path, nil, nil)
+			defer resp.Body.Close()
+
+			assert.Equal(t, tt.wantCode, resp.StatusCode)
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+
+			var samples []monitor.Sample
+			require.NoError(t, json.Unmarshal([]byte(respBody), &samples))
+			deltas := make([]int64, 0, len(samples))
+			for _, sample := range samples {
+				require.NotNil(t, sample.Delta)
+				deltas = append(deltas, *sample.Delta)
+			}
+			assert.Equal(t, tt.wantDeltas, deltas)
+		})
+	}
+}
+
+func TestServerDistributionHandlers(t *testing.T) {
+	metrics, err := storage.New(context.Background(), storage.Options{}, "memory://")
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(NewServer(metrics, ""))
+	defer srv.Close()
+
+	headers := map[string]string{contentType: typeApplicationJSON, contentEncoding: encodingGzip}
+	buckets := []float64{0.1, 1}
+	batch := []monitor.Metrics{
+		{ID: "Latency", MType: HistogramPath, Histogram: &monitor.Histogram{
+			Buckets: buckets, Counts: []uint64{1, 2, 0}, Sum: 1.5, Count: 3,
+		}},
+		{ID: "Latency", MType: HistogramPath, Histogram: &monitor.Histogram{
+			Buckets: buckets, Counts: []uint64{0, 0, 1}, Sum: 2, Count: 1,
+		}},
+		{ID: "Size", MType: SummaryPath, Summary: &monitor.Summary{
+			Observations: []float64{4, 1, 3, 2},
+		}},
+	}
+	resp, _ := testRequest(t, srv, http.MethodPost, "/"+UpdsPath+"/", headers, compressJSONBody(t, batch))
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Histograms are merged
+	resp, respBody := testRequest(t, srv, http.MethodPost, "/"+ValuePath+"/", headers,
+		compressJSONBody(t, monitor.Metrics{ID: "Latency", MType: HistogramPath}))
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var metric monitor.Metrics
+	require.NoError(t, json.Unmarshal([]byte(respBody), &metric))
+	require.NotNil(t, metric.Histogram)
+	assert.Equal(t, []uint64{1, 2, 1}, metric.Histogram.Counts)
+	assert.Equal(t, uint64(4), metric.Histogram.Count)
+	assert.Equal(t, 3.5, metric.Histogram.Sum)
+
+	// Summaries come with quantiles
+	resp, respBody = testRequest(t, srv, http.MethodGet, "/"+ValuePath+"/"+SummaryPath+"/Size", nil, nil)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var summary monitor.Summary
+	require.NoError(t, json.Unmarshal([]byte(respBody), &summary))
+	assert.Equal(t, uint64(4), summary.Count)
+	assert.Empty(t, summary.Observations)
+	require.Len(t, summary.Quantiles, len(monitor.DefaultQuantiles()))
+	assert.Equal(t, monitor.Quantile{Quantile: 0.5, Value: 2}, summary.Quantiles[0])
+
+	// Histograms with other buckets are rejected
+	mismatch := []monitor.Metrics{
+		{ID: "Latency", MType: HistogramPath, Histogram: &monitor.Histogram{
+			Buckets: []float64{5}, Counts: []uint64{1, 0}, Count: 1,
+		}},
+	}
+	resp, _ = testRequest(t, srv, http.MethodPost, "/"+UpdsPath+"/", headers, compressJSONBody(t, mismatch))
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestServerDeleteHandler(t *testing.T) {
+	tests := []struct {
+		name     string
+		path     string
+		wantCode int
+		wantLeft string
+	}{
+		{
+			name:     "existing gauge",
+			path:     "/" + ValuePath + "/" + GaugePath + "/" + "Apple",
+			wantCode: http.StatusOK,
+			wantLeft: `{"Peach": 4}`,
+		},
+		{
+			name:     "no such metric",
+			path:     "/" + ValuePath + "/" + GaugePath + "/" + "Plum",
+			wantCode: http.StatusNotFound,
+			wantLeft: `{"Apple": 3, "Peach": 4}`,
+		},
+		{
+			name:     "wrong metric type",
+			path:     "/" + ValuePath + "/" + "wrongtype" + "/" + "Apple",
+			wantCode: http.StatusBadRequest,
+			wantLeft: `{"Apple": 3, "Peach": 4}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metrics, err := storage.New(context.Background(), storage.Options{}, "memory://")
+			require.NoError(t, err)
+			metrics.SetGauge(context.Background(), "Apple", monitor.Gauge(3))
+			metrics.SetGauge(context.Background(), "Peach", monitor.Gauge(4))
+
+			srv := httptest.NewServer(NewServer(metrics, ""))
+			defer srv.Close()
+
+			resp, _ := testRequest(t, srv, http.MethodDelete, tt.path, nil, nil)
+			defer resp.Body.Close()
+
+			assert.Equal(t, tt.wantCode, resp.StatusCode)
+			gaugeJSON, err := metrics.StringGauge(context.Background())
+			assert.NoError(t, err)
+			assert.JSONEq(t, tt.wantLeft, gaugeJSON)
+		})
+	}
+}
+
+func TestServerUpdatesIdempotency(t *testing.T) {
+	metrics, err := storage.New(context.Background(), storage.Options{}, "memory://")
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(NewServer(metrics, ""))
+	defer srv.Close()
+
+	delta := int64(5)
+	batch := []monitor.Metrics{{ID: "PollCount", MType: CounterPath, Delta: &delta}}
+	headers := map[string]string{
+		contentType:          typeApplicationJSON,
+		contentEncoding:      encodingGzip,
+		IdempotencyKeyHeader: "batch-1",
+	}
+
+	// The second request is a retry of the first one
+	for i, wantReplayed := range []string{"", "true"} {
+		resp, _ := testRequest(t, srv, http.MethodPost, "/"+UpdsPath+"/", headers, compressJSONBody(t, batch))
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "request %d", i)
+		assert.Equal(t, wantReplayed, resp.Header.Get(IdempotentReplayedHeader), "request %d", i)
+	}
+	counter, _ := metrics.GetCounter(context.Background(), "PollCount")
+	assert.Equal(t, monitor.Counter(5), counter)
+
+	// A rejected batch does not use up its key
+	headers[IdempotencyKeyHeader] = "batch-2"
+	resp, _ := testRequest(t, srv, http.MethodPost, "/"+UpdsPath+"/", headers,
+		compressJSONBody(t, []monitor.Metrics{{ID: "PollCount", MType: CounterPath}}))
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp, _ = testRequest(t, srv, http.MethodPost, "/"+UpdsPath+"/", headers, compressJSONBody(t, batch))
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	counter, _ = metrics.GetCounter(context.Background(), "PollCount")
+	assert.Equal(t, monitor.Counter(10), counter)
+
+	// A retry of a batch still being applied is told to come back
+	_, err = metrics.ClaimBatch(context.Background(), "batch-3")
+	require.NoError(t, err)
+	headers[IdempotencyKeyHeader] = "batch-3"
+	resp, _ = testRequest(t, srv, http.MethodPost, "/"+UpdsPath+"/", headers, compressJSONBody(t, batch))
+	resp.Body.Close()
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+	assert.Equal(t, "1", resp.Header.Get("Retry-After"))
+	assert.Empty(t, resp.Header.Get(IdempotentReplayedHeader))
+	counter, _ = metrics.GetCounter(context.Background(), "PollCount")
+	assert.Equal(t, monitor.Counter(10), counter)
+}
+
 // func TestGetValHandler(t *testing.T) {
 // 	// I don't know what the best practices for initializing exernal storage is
 // 	// so I updated storage interface methods for modifying it: now they return
@@ -393,7 +652,7 @@ func TestServerUpdHandler(t *testing.T) {
 func BenchmarkUpdateGauge(b *testing.B) {
 	log.Logger = log.Logger.Level(zerolog.ErrorLevel)
 
-	metrics, err := storage.New(context.Background(), "", "", 5, false)
+	metrics, err := storage.New(context.Background(), storage.Options{StoreInterval: 5}, "memory://")
 	if assert.NoError(b, err) {
 		// Init the server to test
 		srv := httptest.NewServer(NewServer(metrics, ""))
@@ -427,7 +686,7 @@ func BenchmarkUpdateGauge(b *testing.B) {
 func BenchmarkUpdateCounter(b *testing.B) {
 	log.Logger = log.Logger.Level(zerolog.ErrorLevel)
 
-	metrics, err := storage.New(context.Background(), "", "", 5, false)
+	metrics, err := storage.New(context.Background(), storage.Options{StoreInterval: 5}, "memory://")
 	if assert.NoError(b, err) {
 		// Init the server to test
 		srv := httptest.NewServer(NewServer(metrics, ""))
@@ -453,7 +712,7 @@ func BenchmarkUpdateCounter(b *testing.B) {
 func BenchmarkUpdatesGaugeAdd(b *testing.B) {
 	log.Logger = log.Logger.Level(zerolog.ErrorLevel)
 
-	metrics, err := storage.New(context.Background(), "", "", 5, false)
+	metrics, err := storage.New(context.Background(), storage.Options{StoreInterval: 5}, "memory://")
 	if assert.NoError(b, err) {
 		// Init the server to test
 		srv := httptest.NewServer(NewServer(metrics, ""))
@@ -500,7 +759,7 @@ func BenchmarkUpdatesGaugeAdd(b *testing.B) {
 func BenchmarkUpdatesGaugeUpdate(b *testing.B) {
 	log.Logger = log.Logger.Level(zerolog.ErrorLevel)
 
-	metrics, err := storage.New(context.Background(), "", "", 5, false)
+	metrics, err := storage.New(context.Background(), storage.Options{StoreInterval: 5}, "memory://")
 	if assert.NoError(b, err) {
 		// Init the server to test
 		srv := httptest.NewServer(NewServer(metrics, ""))
@@ -542,7 +801,7 @@ func BenchmarkUpdatesGaugeUpdate(b *testing.B) {
 func BenchmarkAll(b *testing.B) {
 	log.Logger = log.Logger.Level(zerolog.ErrorLevel)
 
-	metrics, err := storage.New(context.Background(), "", "", 5, false)
+	metrics, err := storage.New(context.Background(), storage.Options{StoreInterval: 5}, "memory://")
 	if assert.NoError(b, err) {
 		// Init the server to test
 		srv := httptest.NewServer(NewServer(metrics, ""))
@@ -565,3 +824,105 @@ func BenchmarkAll(b *testing.B) {
 		}
 	}
 }
+
+func TestServerUpdatesEncrypted(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	metrics, err := storage.New(context.Background(), storage.Options{}, "memory://")
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(NewServer(metrics, "", WithPrivateKey(key)))
+	defer srv.Close()
+
+	delta := int64(5)
+	batch := []monitor.Metrics{{ID: "PollCount", MType: CounterPath, Delta: &delta}}
+	encrypt := func() io.Reader {
+		body, err := io.ReadAll(compressJSONBody(t, batch))
+		require.NoError(t, err)
+		body, err = encryption.Encrypt(&key.PublicKey, body)
+		require.NoError(t, err)
+		return bytes.NewReader(body)
+	}
+
+	tests := []struct {
+		name    string
+		scheme  string
+		body    io.Reader
+		code    int
+		counter monitor.Counter
+	}{
+		{name: "encrypted", scheme: encryption.Scheme, body: encrypt(), code: http.StatusOK, counter: 5},
+		{name: "plain", body: compressJSONBody(t, batch), code: http.StatusOK, counter: 10},
+		{name: "unknown scheme", scheme: "rot13", body: encrypt(), code: http.StatusBadRequest, counter: 10},
+		{name: "not encrypted", scheme: encryption.Scheme, body: compressJSONBody(t, batch), code: http.StatusBadRequest, counter: 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := map[string]string{contentType: typeApplicationJSON, contentEncoding: encodingGzip}
+			if tt.scheme != "" {
+				headers[encryption.Header] = tt.scheme
+			}
+			resp, _ := testRequest(t, srv, http.MethodPost, "/"+UpdsPath+"/", headers, tt.body)
+			resp.Body.Close()
+			assert.Equal(t, tt.code, resp.StatusCode)
+
+			counter, _ := metrics.GetCounter(context.Background(), "PollCount")
+			assert.Equal(t, tt.counter, counter)
+		})
+	}
+}
+
+func TestServerTrustedSubnet(t *testing.T) {
+	metrics, err := storage.New(context.Background(), storage.Options{}, "memory://")
+	require.NoError(t, err)
+	_, subnet, err := net.ParseCIDR("10.0.0.0/8")
+	require.NoError(t, err)
+	_, loopback, err := net.ParseCIDR("127.0.0.0/8")
+	require.NoError(t, err)
+
+	// The test client poses as a proxy
+	srv := httptest.NewServer(NewServer(metrics, "", WithTrustedSubnet(subnet), WithTrustedProxies(loopback)))
+	defer srv.Close()
+
+	legacy := "/" + UpdPath + "/" + CounterPath + "/PollCount/1"
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		realIP string
+		code   int
+	}{
+		{name: "trusted write", method: http.MethodPost, path: legacy, realIP: "10.1.2.3", code: http.StatusOK},
+		{name: "untrusted write", method: http.MethodPost, path: legacy, realIP: "192.168.1.1", code: http.StatusForbidden},
+		{name: "invalid address", method: http.MethodPost, path: legacy, realIP: "10.1.2", code: http.StatusForbidden},
+		{name: "connection address", method: http.MethodPost, path: legacy, code: http.StatusForbidden},
+		{name: "untrusted batch", method: http.MethodPost, path: "/" + UpdsPath + "/", realIP: "192.168.1.1", code: http.StatusForbidden},
+		{name: "untrusted delete", method: http.MethodDelete, path: "/" + ValuePath + "/" + CounterPath + "/PollCount", realIP: "192.168.1.1", code: http.StatusForbidden},
+		{name: "untrusted read", method: http.MethodGet, path: "/" + ValuePath + "/" + CounterPath + "/PollCount", realIP: "192.168.1.1", code: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := map[string]string{}
+			if tt.realIP != "" {
+				headers[mw.RealIPHeader] = tt.realIP
+			}
+			resp, _ := testRequest(t, srv, tt.method, tt.path, headers, nil)
+			resp.Body.Close()
+			assert.Equal(t, tt.code, resp.StatusCode)
+		})
+	}
+
+	// Without proxies the header is ignored, so that clients cannot claim a
+	// trusted address
+	direct := httptest.NewServer(NewServer(metrics, "", WithTrustedSubnet(subnet)))
+	defer direct.Close()
+	resp, _ := testRequest(t, direct, http.MethodPost, legacy, map[string]string{mw.RealIPHeader: "10.1.2.3"}, nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode, "spoofed address")
+
+	direct = httptest.NewServer(NewServer(metrics, "", WithTrustedSubnet(loopback)))
+	defer direct.Close()
+	resp, _ = testRequest(t, direct, http.MethodPost, legacy, map[string]string{mw.RealIPHeader: "192.168.1.1"}, nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "connection address")
+}
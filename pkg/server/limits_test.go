@@ -0,0 +1,86 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	mw "github.com/a-tho/monitor/pkg/middleware"
+	"github.com/a-tho/monitor/pkg/storage"
+)
+
+func TestServerBodyLimits(t *testing.T) {
+	metrics, err := storage.New(context.Background(), storage.Options{}, "memory://")
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(NewServer(metrics, "c2VjcmV0", WithBodyLimits(4096, 64<<10)))
+	defer srv.Close()
+
+	// A small body inflating way past the limit
+	var bomb bytes.Buffer
+	zw := gzip.NewWriter(&bomb)
+	_, err = zw.Write([]byte("[" + strings.Repeat(" ", 1<<20) + "]"))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	require.Less(t, bomb.Len(), 4096)
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		body    func() *bytes.Reader
+		code    int
+	}{
+		{
+			name:    "within limits",
+			headers: map[string]string{contentType: typeApplicationJSON},
+			body:    func() *bytes.Reader { return bytes.NewReader([]byte("[]")) },
+			code:    http.StatusOK,
+		},
+		{
+			name:    "too long",
+			headers: map[string]string{contentType: typeApplicationJSON},
+			body:    func() *bytes.Reader { return bytes.NewReader([]byte("[" + strings.Repeat(" ", 8192) + "]")) },
+			code:    http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:    "gzip bomb",
+			headers: map[string]string{contentType: typeApplicationJSON, contentEncoding: encodingGzip},
+			body:    func() *bytes.Reader { return bytes.NewReader(bomb.Bytes()) },
+			code:    http.StatusRequestEntityTooLarge,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, _ := testRequest(t, srv, http.MethodPost, "/"+UpdsPath+"/", tt.headers, tt.body())
+			resp.Body.Close()
+			assert.Equal(t, tt.code, resp.StatusCode)
+		})
+	}
+}
+
+func TestServerRateLimit(t *testing.T) {
+	metrics, err := storage.New(context.Background(), storage.Options{}, "memory://")
+	require.NoError(t, err)
+
+	limiter := mw.NewRateLimiter(0.001, 2, mw.ClientIP)
+	srv := httptest.NewServer(NewServer(metrics, "", WithRateLimit(limiter)))
+	defer srv.Close()
+
+	for i, code := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		resp, _ := testRequest(t, srv, http.MethodGet, "/ping", nil, nil)
+		resp.Body.Close()
+		assert.Equal(t, code, resp.StatusCode, "request %d", i)
+	}
+
+	resp, body := testRequest(t, srv, http.MethodGet, APIPath+"/ping", nil, nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Contains(t, body, `"code":"too_many_requests"`)
+}
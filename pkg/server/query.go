@@ -0,0 +1,154 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	monitor "github.com/a-tho/monitor/internal"
+)
+
+const (
+	// defaultQueryLimit and maxQueryLimit bound the page size of queries.
+	defaultQueryLimit = 100
+	maxQueryLimit     = 1000
+
+	errQuery       = "invalid query"
+	errQueryCursor = "invalid query cursor"
+	errQueryFailed = "failed to query metrics"
+)
+
+// A queryPage is the response to a query, Next being the cursor of the next
+// page if there may be one.
+type queryPage struct {
+	Metrics []monitor.Metrics `json:"metrics"`
+	Next    string            `json:"next,omitempty"`
+}
+
+// Query handles requests for the gauges and counters selected by the query
+// parameters, one page at a time:
+//
+//	type    metric type, may be repeated (all types by default)
+//	name    glob pattern the metric name must match
+//	regex   regular expression the metric name must match, instead of name
+//	match   label selector, e.g. {cpu=~"0|1"}
+//	sort    name (default) or value
+//	order   asc (default) or desc
+//	limit   page size, up to 1000 (100 by default)
+//	cursor  the next cursor of the previous page
+func (s *server) Query(w http.ResponseWriter, r *http.Request) {
+	q, err := parseQuery(r)
+	if err != nil {
+		fail(w, r, err)
+		return
+	}
+	q.Matchers = append(q.Matchers, tokenMatchers(r.Context())...)
+
+	// Fetch one more metric to know whether there is a next page
+	limit := q.Limit
+	q.Limit++
+
+	it, err := s.metrics.Query(r.Context(), q)
+	if err != nil {
+		fail(w, r, storageError(errQueryFailed))
+		return
+	}
+	defer it.Close()
+
+	page := queryPage{Metrics: []monitor.Metrics{}}
+	for it.Next() {
+		if len(page.Metrics) == limit {
+			page.Next, err = encodeCursor(page.Metrics[limit-1])
+			break
+		}
+		page.Metrics = append(page.Metrics, it.Metric())
+	}
+	if err == nil {
+		err = it.Err()
+	}
+	if err != nil {
+		fail(w, r, storageError(errQueryFailed))
+		return
+	}
+
+	w.Header().Add(contentType, typeApplicationJSON)
+	enc := json.NewEncoder(w)
+	enc.Encode(page)
+}
+
+// parseQuery builds a compiled query from the query parameters.
+func parseQuery(r *http.Request) (monitor.Query, error) {
+	params := r.URL.Query()
+	q := monitor.Query{
+		Types:  params[TypeQuery],
+		Name:   params.Get(NameQuery),
+		SortBy: params.Get(SortQuery),
+		Limit:  defaultQueryLimit,
+	}
+
+	if regex := params.Get(RegexQuery); regex != "" {
+		if q.Name != "" {
+			return q, apiQuery.detailed("name and regex are exclusive").on(RegexQuery)
+		}
+		q.Name, q.NameRegexp = regex, true
+	}
+
+	switch params.Get(OrderQuery) {
+	case "", "asc":
+	case "desc":
+		q.Desc = true
+	default:
+		return q, apiQuery.detailed("order must be asc or desc").on(OrderQuery)
+	}
+
+	if limitStr := params.Get(LimitQuery); limitStr != "" {
+		limit, err := strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 || limit > maxQueryLimit {
+			return q, apiQuery.detailed("limit must be within 1 and %d", maxQueryLimit).on(LimitQuery)
+		}
+		q.Limit = limit
+	}
+
+	matchers, err := monitor.ParseMatchers(params.Get(MatchQuery))
+	if err != nil {
+		return q, apiMatchers
+	}
+	q.Matchers = matchers
+
+	if cursor := params.Get(CursorQuery); cursor != "" {
+		if q.After, err = decodeCursor(cursor); err != nil {
+			return q, apiQueryCursor
+		}
+	}
+
+	if err = q.Compile(); err != nil {
+		return q, apiQuery.detailed("%v", err)
+	}
+	return q, nil
+}
+
+// encodeCursor returns the opaque cursor pointing at the metric.
+func encodeCursor(metric monitor.Metrics) (string, error) {
+	cursor, err := monitor.CursorOf(metric)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(cursor)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodeCursor(s string) (*monitor.Cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	var cursor monitor.Cursor
+	if err = json.Unmarshal(data, &cursor); err != nil {
+		return nil, err
+	}
+	return &cursor, nil
+}
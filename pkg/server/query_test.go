@@ -0,0 +1,100 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	monitor "github.com/a-tho/monitor/internal"
+	"github.com/a-tho/monitor/pkg/storage"
+)
+
+func TestServerQueryHandler(t *testing.T) {
+	ctx := context.Background()
+	metrics, err := storage.New(ctx, storage.Options{}, "memory://")
+	require.NoError(t, err)
+	metrics.SetGauge(ctx, `CPUutilization{cpu="0"}`, monitor.Gauge(30))
+	metrics.SetGauge(ctx, `CPUutilization{cpu="1"}`, monitor.Gauge(10))
+	metrics.SetGauge(ctx, "HeapAlloc", monitor.Gauge(20))
+	metrics.AddCounter(ctx, "PollCount", monitor.Counter(5))
+
+	srv := httptest.NewServer(NewServer(metrics, ""))
+	defer srv.Close()
+
+	tests := []struct {
+		name     string
+		query    url.Values
+		wantCode int
+		wantKeys [][]string // pages
+	}{
+		{
+			name:     "all by name",
+			query:    url.Values{},
+			wantCode: http.StatusOK,
+			wantKeys: [][]string{{`CPUutilization{cpu="0"}`, `CPUutilization{cpu="1"}`, "HeapAlloc", "PollCount"}},
+		},
+		{
+			name:     "gauges by value, paginated",
+			query:    url.Values{TypeQuery: {GaugePath}, SortQuery: {"value"}, OrderQuery: {"desc"}, LimitQuery: {"2"}},
+			wantCode: http.StatusOK,
+			wantKeys: [][]string{{`CPUutilization{cpu="0"}`, "HeapAlloc"}, {`CPUutilization{cpu="1"}`}},
+		},
+		{
+			name:     "glob and labels",
+			query:    url.Values{NameQuery: {"CPU*"}, MatchQuery: {`{cpu="1"}`}},
+			wantCode: http.StatusOK,
+			wantKeys: [][]string{{`CPUutilization{cpu="1"}`}},
+		},
+		{
+			name:     "regex",
+			query:    url.Values{RegexQuery: {"Heap.*|Poll.*"}, LimitQuery: {"1"}},
+			wantCode: http.StatusOK,
+			wantKeys: [][]string{{"HeapAlloc"}, {"PollCount"}},
+		},
+		{
+			name:     "unsupported type",
+			query:    url.Values{TypeQuery: {HistogramPath}},
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "invalid cursor",
+			query:    url.Values{CursorQuery: {"!"}},
+			wantCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var pages [][]string
+			query := tt.query
+			for {
+				resp, respBody := testRequest(t, srv, http.MethodGet, "/"+QueryPath+"/?"+query.Encode(), nil, nil)
+				resp.Body.Close()
+				require.Equal(t, tt.wantCode, resp.StatusCode)
+				if tt.wantCode != http.StatusOK {
+					return
+				}
+
+				var page queryPage
+				require.NoError(t, json.Unmarshal([]byte(respBody), &page))
+				keys := make([]string, len(page.Metrics))
+				for i, m := range page.Metrics {
+					keys[i] = m.Key()
+				}
+				pages = append(pages, keys)
+
+				if page.Next == "" {
+					break
+				}
+				query.Set(CursorQuery, page.Next)
+			}
+			assert.Equal(t, tt.wantKeys, pages)
+		})
+	}
+}
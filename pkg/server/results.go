@@ -0,0 +1,176 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	monitor "github.com/a-tho/monitor/internal"
+)
+
+// Item statuses.
+const (
+	ItemAccepted = "accepted"
+	ItemRejected = "rejected"
+)
+
+// An ItemResult tells what became of an item of a batch.
+type ItemResult struct {
+	Index  int    `json:"index"`
+	ID     string `json:"id,omitempty"`
+	MType  string `json:"type,omitempty"`
+	Status string `json:"status"`
+	// Error is the reason the item was rejected
+	Error string `json:"error,omitempty"`
+	// Counter is the value of an accepted counter once the batch is applied
+	Counter *int64 `json:"counter,omitempty"`
+}
+
+// updatesWithResults applies the valid items of a batch and responds with
+// the result of every item: 200 if all of them were accepted, 207 if only
+// some, and 400 if none.
+func (s *server) updatesWithResults(w http.ResponseWriter, r *http.Request, key string) {
+	status, results, err := s.applyItems(r.Context(), r, key)
+	if status != http.StatusOK && status != http.StatusMultiStatus && key != "" {
+		// Nothing got through, let the client retry
+		s.metrics.ReleaseBatch(context.Background(), key)
+	}
+	if err != nil {
+		fail(w, r, err)
+		return
+	}
+
+	w.Header().Add(contentType, typeApplicationJSON)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(results)
+}
+
+// applyItems decodes a JSON array of metrics from the request body and
+// applies the valid ones at once along with the idempotency key, if any. It
+// returns the status code along with either the result of every item or the
+// error that kept the batch from being read.
+func (s *server) applyItems(ctx context.Context, r *http.Request, key string) (int, []ItemResult, error) {
+	var items []json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&items); err != nil {
+		return http.StatusBadRequest, nil, apiMetricValue.on("")
+	}
+
+	results := make([]ItemResult, len(items))
+	var (
+		batch   []*monitor.Metrics
+		indices []int // of the batch items
+	)
+	for i, item := range items {
+		results[i] = ItemResult{Index: i, Status: ItemRejected}
+
+		metric := &monitor.Metrics{}
+		if err := json.Unmarshal(item, metric); err != nil {
+			results[i].Error = errMetricValue
+			continue
+		}
+		results[i].ID, results[i].MType = metric.ID, metric.MType
+		if err := checkUpdate(metric); err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+		if !permitted(ctx, metric.ID) {
+			results[i].Error = errForbiddenName
+			continue
+		}
+		results[i].ID = metric.Key()
+		batch = append(batch, metric)
+		indices = append(indices, i)
+	}
+
+	if len(batch) > 0 {
+		changes, err := s.metrics.CommitBatch(ctx, key, batch)
+		if errors.Is(err, monitor.ErrBucketMismatch) {
+			// Leave out the items that conflict and apply the others
+			for j, ok := range s.mergeable(ctx, batch) {
+				if !ok {
+					results[indices[j]].Error = errBuckets
+					indices[j] = -1
+				}
+			}
+			var rest []*monitor.Metrics
+			for j, i := range indices {
+				if i >= 0 {
+					rest = append(rest, batch[j])
+				}
+			}
+			changes, err = nil, nil
+			if len(rest) > 0 {
+				changes, err = s.metrics.CommitBatch(ctx, key, rest)
+			}
+		}
+		if err != nil {
+			return http.StatusInternalServerError, nil, storageError(errApplyBatch)
+		}
+
+		// The changes go with the accepted items, in order
+		var accepted []*monitor.Metrics
+		for j, i := range indices {
+			if i < 0 {
+				continue
+			}
+			results[i].Status = ItemAccepted
+			if batch[j].MType == CounterPath {
+				if change := changes[len(accepted)]; change.New != nil {
+					results[i].Counter = change.New.Delta
+				}
+			}
+			accepted = append(accepted, batch[j])
+		}
+		s.record(r, accepted, changes)
+		s.hub.Publish(accepted...)
+	}
+
+	if len(batch) == 0 && len(items) == 0 && key != "" {
+		// Nothing to apply, the key is applied all the same
+		if _, err := s.metrics.CommitBatch(ctx, key, nil); err != nil {
+			return http.StatusInternalServerError, nil, storageError(errApplyBatch)
+		}
+	}
+
+	var rejected int
+	for _, result := range results {
+		if result.Status == ItemRejected {
+			rejected++
+		}
+	}
+	switch {
+	case rejected == 0:
+		return http.StatusOK, results, nil
+	case rejected < len(results):
+		return http.StatusMultiStatus, results, nil
+	}
+	return http.StatusBadRequest, results, nil
+}
+
+// mergeable tells for every item of the batch whether it applies once the
+// preceding mergeable ones are, histograms having to match the buckets of
+// the stored series.
+func (s *server) mergeable(ctx context.Context, batch []*monitor.Metrics) []bool {
+	ok := make([]bool, len(batch))
+	probes := make(map[string]*monitor.Histogram)
+	for j, metric := range batch {
+		if metric.MType != HistogramPath {
+			ok[j] = true
+			continue
+		}
+
+		k := metric.Key()
+		probe, found := probes[k]
+		if !found {
+			probe = &monitor.Histogram{}
+			if h, stored := s.metrics.GetHistogram(ctx, k); stored {
+				probe.Buckets, probe.Counts = h.Buckets, make([]uint64, len(h.Counts))
+			}
+			probes[k] = probe
+		}
+		// A failed merge leaves the probe untouched
+		ok[j] = probe.Merge(*metric.Histogram) == nil
+	}
+	return ok
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	monitor "github.com/a-tho/monitor/internal"
+	"github.com/a-tho/monitor/pkg/storage"
+)
+
+func TestServerUpdatesResults(t *testing.T) {
+	ctx := context.Background()
+	metrics, err := storage.New(ctx, storage.Options{}, "memory://")
+	require.NoError(t, err)
+	_, err = metrics.AddCounter(ctx, "PollCount", 10)
+	require.NoError(t, err)
+	_, err = metrics.AddHistogram(ctx, "Latency", *monitor.NewHistogram([]float64{1}))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(NewServer(metrics, ""))
+	defer srv.Close()
+
+	counter := func(v int64) *int64 { return &v }
+	tests := []struct {
+		name string
+		body string
+		code int
+		want []ItemResult
+	}{
+		{
+			name: "all accepted",
+			body: `[{"id":"Alloc","type":"gauge","value":1},{"id":"PollCount","type":"counter","delta":5}]`,
+			code: http.StatusOK,
+			want: []ItemResult{
+				{Index: 0, ID: "Alloc", MType: GaugePath, Status: ItemAccepted},
+				{Index: 1, ID: "PollCount", MType: CounterPath, Status: ItemAccepted, Counter: counter(15)},
+			},
+		},
+		{
+			name: "partial success",
+			body: `[{"id":"PollCount","type":"counter","delta":1},{"id":"Alloc","type":"gauge"},{"id":"Alloc","type":"meter","value":1},{"id":"Alloc","type":"gauge","value":"high"}]`,
+			code: http.StatusMultiStatus,
+			want: []ItemResult{
+				{Index: 0, ID: "PollCount", MType: CounterPath, Status: ItemAccepted, Counter: counter(16)},
+				{Index: 1, ID: "Alloc", MType: GaugePath, Status: ItemRejected, Error: errMetricValue},
+				{Index: 2, ID: "Alloc", MType: "meter", Status: ItemRejected, Error: errMetricType},
+				{Index: 3, Status: ItemRejected, Error: errMetricValue},
+			},
+		},
+		{
+			name: "bucket mismatch",
+			body: `[{"id":"Latency","type":"histogram","histogram":{"buckets":[2],"counts":[1,0],"sum":1,"count":1}},{"id":"PollCount","type":"counter","delta":1}]`,
+			code: http.StatusMultiStatus,
+			want: []ItemResult{
+				{Index: 0, ID: "Latency", MType: HistogramPath, Status: ItemRejected, Error: errBuckets},
+				{Index: 1, ID: "PollCount", MType: CounterPath, Status: ItemAccepted, Counter: counter(17)},
+			},
+		},
+		{
+			name: "all rejected",
+			body: `[{"id":"Alloc","type":"gauge"}]`,
+			code: http.StatusBadRequest,
+			want: []ItemResult{{Index: 0, ID: "Alloc", MType: GaugePath, Status: ItemRejected, Error: errMetricValue}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := map[string]string{contentType: typeApplicationJSON}
+			resp, body := testRequest(t, srv, http.MethodPost, "/"+UpdsPath+"/?"+ResultsQuery+"=true", headers, strings.NewReader(tt.body))
+			resp.Body.Close()
+			require.Equal(t, tt.code, resp.StatusCode, body)
+
+			var got []ItemResult
+			require.NoError(t, json.Unmarshal([]byte(body), &got))
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	// Old clients get no body, and a trailing error rejects the batch
+	headers := map[string]string{contentType: typeApplicationJSON}
+	resp, body := testRequest(t, srv, http.MethodPost, "/"+UpdsPath+"/", headers,
+		strings.NewReader(`[{"id":"PollCount","type":"counter","delta":1}]`))
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Empty(t, body)
+	resp, _ = testRequest(t, srv, http.MethodPost, "/"+UpdsPath+"/", headers,
+		strings.NewReader(`[{"id":"PollCount","type":"counter","delta":1}`))
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	value, _ := metrics.GetCounter(ctx, "PollCount")
+	assert.Equal(t, monitor.Counter(18), value)
+
+	// A replayed batch has no results to report
+	headers[IdempotencyKeyHeader] = "batch-1"
+	path := "/" + UpdsPath + "/?" + ResultsQuery + "=true"
+	for i, want := range []int{http.StatusOK, http.StatusNoContent} {
+		resp, body = testRequest(t, srv, http.MethodPost, path, headers,
+			strings.NewReader(`[{"id":"PollCount","type":"counter","delta":1}]`))
+		resp.Body.Close()
+		require.Equal(t, want, resp.StatusCode, "request %d", i)
+		if want == http.StatusNoContent {
+			assert.Equal(t, "true", resp.Header.Get(IdempotentReplayedHeader))
+			assert.Empty(t, body)
+		}
+	}
+	value, _ = metrics.GetCounter(ctx, "PollCount")
+	assert.Equal(t, monitor.Counter(19), value)
+}
@@ -3,65 +3,243 @@
 package server
 
 import (
-	"encoding/base64"
+	"crypto/rsa"
 	"fmt"
+	"net"
+	"net/http"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog/log"
 
 	monitor "github.com/a-tho/monitor/internal"
 	mw "github.com/a-tho/monitor/pkg/middleware"
+	"github.com/a-tho/monitor/pkg/stream"
 )
 
 type server struct {
-	metrics monitor.MetricRepo
+	metrics    monitor.MetricRepo
+	hub        *stream.Hub     // accepted updates
+	privateKey *rsa.PrivateKey // decrypts batches
+	trusted    *net.IPNet      // clients allowed to write
+	proxies    []*net.IPNet    // setting the client address in X-Real-IP
+	mapping    monitor.TypeMapping
+	tokens     monitor.TokenStore // grants access by scope
+	audit      monitor.AuditLog   // records writes
+
+	keyring     *mw.Keyring // signs requests and responses
+	limiter     *mw.RateLimiter
+	maxBody     int64 // bytes of a request body over the wire
+	maxInflated int64 // bytes of a decompressed request body
+}
+
+// An Option configures the server.
+type Option func(*server)
+
+// WithStreamHub makes the server publish accepted updates to hub, which the
+// caller may then close on shutdown to end the streams. By default the server
+// uses a hub of its own.
+func WithStreamHub(hub *stream.Hub) Option {
+	return func(s *server) {
+		s.hub = hub
+	}
+}
+
+// WithPrivateKey makes the server decrypt the batches encrypted for the
+// public half of key.
+func WithPrivateKey(key *rsa.PrivateKey) Option {
+	return func(s *server) {
+		s.privateKey = key
+	}
+}
+
+// WithTrustedSubnet only lets clients in subnet write metrics. Reads stay
+// open to everyone. The client address is the one of the connection, unless
+// it comes from a proxy given to WithTrustedProxies.
+func WithTrustedSubnet(subnet *net.IPNet) Option {
+	return func(s *server) {
+		s.trusted = subnet
+	}
+}
+
+// WithTrustedProxies makes the trusted subnet check the address in the
+// X-Real-IP header of the requests coming from proxies, which must set the
+// header, rather than the address of the proxy.
+func WithTrustedProxies(proxies ...*net.IPNet) Option {
+	return func(s *server) {
+		s.proxies = proxies
+	}
+}
+
+// WithTypeMapping types the metrics written in the InfluxDB line protocol,
+// which has no metric types. By default they are all gauges.
+func WithTypeMapping(mapping monitor.TypeMapping) Option {
+	return func(s *server) {
+		s.mapping = mapping
+	}
+}
+
+// WithTokens makes the server require a bearer token of tokens on every
+// route but /ping: reads need the read scope, updates the write scope and
+// deletions the admin scope. Tokens with a prefix only act upon the metrics
+// named with it.
+func WithTokens(tokens monitor.TokenStore) Option {
+	return func(s *server) {
+		s.tokens = tokens
+	}
+}
+
+// WithAuditLog makes the server record every write through the update
+// routes to log, and serve the records at AuditPath to admins.
+func WithAuditLog(log monitor.AuditLog) Option {
+	return func(s *server) {
+		s.audit = log
+	}
+}
+
+// WithKeyring makes the server check and sign with the keys of keyring,
+// rather than the single key NewServer is given.
+func WithKeyring(keyring *mw.Keyring) Option {
+	return func(s *server) {
+		s.keyring = keyring
+	}
+}
+
+// WithRateLimit makes the server reject the requests of clients going over
+// the limits of limiter with 429.
+func WithRateLimit(limiter *mw.RateLimiter) Option {
+	return func(s *server) {
+		s.limiter = limiter
+	}
+}
+
+// WithBodyLimits makes the server reject with 413 the request bodies longer
+// than maxBody bytes, or inflating past maxInflated bytes. Limits that are
+// not positive do not apply.
+func WithBodyLimits(maxBody, maxInflated int64) Option {
+	return func(s *server) {
+		s.maxBody = maxBody
+		s.maxInflated = maxInflated
+	}
 }
 
 // NewServer creates a new multiplexer with configured handlers
 func NewServer(
 	metrics monitor.MetricRepo,
 	signKeyStr string,
+	opts ...Option,
 ) *chi.Mux {
-	srv := server{metrics: metrics}
+	srv := server{metrics: metrics, hub: stream.NewHub()}
+	for _, opt := range opts {
+		opt(&srv)
+	}
 	mux := chi.NewRouter()
 
-	signKey, err := base64.StdEncoding.DecodeString(signKeyStr)
-	if err != nil {
-		signKey = []byte{}
+	if srv.keyring == nil {
+		srv.keyring = legacyKeyring(signKeyStr)
 	}
 
-	mux.Get("/", mw.WithLogging(mw.WithSigning(mw.WithCompressing(srv.All), signKey)))
+	// Limits apply to every route, before any body is read
+	mux.Use(withJSONErrors)
+	mux.Use(func(next http.Handler) http.Handler {
+		return mw.WithRateLimit(mw.WithBodyLimit(next.ServeHTTP, srv.maxBody), srv.limiter)
+	})
+
+	// The legacy routes come first, then the versioned ones
+	mux.Get("/", mw.WithLogging(mw.WithScope(mw.WithSigning(mw.WithCompressing(srv.All, srv.maxInflated), srv.keyring), srv.tokens, monitor.ScopeRead)))
 
 	path := fmt.Sprintf("/%s/{%s}/{%s}/{%s}", UpdPath, TypePath, NamePath, ValuePath)
-	mux.Post(path, mw.WithLogging(srv.UpdateLegacy))
+	mux.Post(path, mw.WithLogging(mw.WithScope(mw.WithTrustedSubnet(mw.WithSigning(srv.UpdateLegacy, srv.keyring), srv.trusted, srv.proxies), srv.tokens, monitor.ScopeWrite)))
+
+	srv.routes(mux)
+
+	mux.Route(APIPath, func(r chi.Router) {
+		r.MethodNotAllowed(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		})
+		srv.routes(r)
+	})
+
+	return mux
+}
+
+// legacyKeyring returns the keyring of the base64 encoded key used without a
+// key ID, nil if there is none. A key that does not decode is rejected and
+// logged, NewServer having no error to return; see config.Config.Keyring for
+// the check done on startup.
+func legacyKeyring(signKeyStr string) *mw.Keyring {
+	signKey, err := mw.ParseKey(signKeyStr)
+	if err != nil {
+		log.Error().Err(err).Msg("signing key rejected")
+		return nil
+	}
+	if signKey == nil {
+		return nil
+	}
+	keyring, _ := mw.NewKeyring(map[string][]byte{"": signKey}, "", false, 0)
+	return keyring
+}
 
-	path = fmt.Sprintf("/%s/", UpdPath)
-	mux.Post(path, mw.WithLogging(mw.WithSigning(mw.WithCompressing(srv.Update), signKey)))
+// routes registers the routes the legacy and versioned APIs share.
+func (s *server) routes(r chi.Router) {
+	path := fmt.Sprintf("/%s/", UpdPath)
+	r.Post(path, mw.WithLogging(mw.WithScope(mw.WithTrustedSubnet(mw.WithSigning(mw.WithCompressing(s.Update, s.maxInflated), s.keyring), s.trusted, s.proxies), s.tokens, monitor.ScopeWrite)))
 
 	path = fmt.Sprintf("/%s/", UpdsPath)
-	mux.Post(path, mw.WithLogging(mw.WithSigning(mw.WithCompressing(srv.Updates), signKey)))
+	r.Post(path, mw.WithLogging(mw.WithScope(mw.WithTrustedSubnet(mw.WithSigning(mw.WithDecrypting(mw.WithCompressing(s.Updates, s.maxInflated), s.privateKey), s.keyring), s.trusted, s.proxies), s.tokens, monitor.ScopeWrite)))
+
+	path = fmt.Sprintf("/%s", WritePath)
+	r.Post(path, mw.WithLogging(mw.WithScope(mw.WithTrustedSubnet(mw.WithSigning(mw.WithCompressing(s.Write, s.maxInflated), s.keyring), s.trusted, s.proxies), s.tokens, monitor.ScopeWrite)))
+
+	path = fmt.Sprintf("/%s/{%s}/{%s}", ValuePath, TypePath, NamePath)
+	r.Get(path, mw.WithLogging(mw.WithScope(s.ValueLegacy, s.tokens, monitor.ScopeRead)))
 
 	path = fmt.Sprintf("/%s/{%s}/{%s}", ValuePath, TypePath, NamePath)
-	mux.Get(path, mw.WithLogging(srv.ValueLegacy))
+	r.Delete(path, mw.WithLogging(mw.WithScope(mw.WithTrustedSubnet(mw.WithSigning(s.Delete, s.keyring), s.trusted, s.proxies), s.tokens, monitor.ScopeAdmin)))
 
 	path = fmt.Sprintf("/%s/", ValuePath)
-	mux.Post(path, mw.WithLogging(mw.WithSigning(mw.WithCompressing(srv.Value), signKey)))
+	r.Post(path, mw.WithLogging(mw.WithScope(mw.WithSigning(mw.WithCompressing(s.Value, s.maxInflated), s.keyring), s.tokens, monitor.ScopeRead)))
 
-	path = "/ping"
-	mux.Get(path, mw.WithLogging(mw.WithSigning(mw.WithCompressing(srv.Ping), signKey)))
+	path = fmt.Sprintf("/%s/{%s}/{%s}", HistoryPath, TypePath, NamePath)
+	r.Get(path, mw.WithLogging(mw.WithScope(mw.WithSigning(mw.WithCompressing(s.History, s.maxInflated), s.keyring), s.tokens, monitor.ScopeRead)))
 
-	return mux
+	path = fmt.Sprintf("/%s/", QueryPath)
+	r.Get(path, mw.WithLogging(mw.WithScope(mw.WithSigning(mw.WithCompressing(s.Query, s.maxInflated), s.keyring), s.tokens, monitor.ScopeRead)))
+
+	path = fmt.Sprintf("/%s/", StreamPath)
+	r.Get(path, mw.WithLogging(mw.WithScope(s.Stream, s.tokens, monitor.ScopeRead)))
+
+	path = fmt.Sprintf("/%s", MetricsPath)
+	r.Get(path, mw.WithLogging(mw.WithScope(mw.WithSigning(mw.WithCompressing(s.Metrics, s.maxInflated), s.keyring), s.tokens, monitor.ScopeRead)))
+
+	if s.audit != nil {
+		path = fmt.Sprintf("/%s/", AuditPath)
+		r.Get(path, mw.WithLogging(mw.WithScope(mw.WithSigning(mw.WithCompressing(s.Audit, s.maxInflated), s.keyring), s.tokens, monitor.ScopeAdmin)))
+	}
+
+	path = "/ping"
+	r.Get(path, mw.WithLogging(mw.WithSigning(mw.WithCompressing(s.Ping, s.maxInflated), s.keyring)))
 }
 
 const (
+	// APIPath is the prefix of the versioned API routes.
+	APIPath = "/api/v1"
+
 	// UpdPath is the path to update handler.
 	UpdPath = "update"
 	// UpdsPath is the path to updates handler.
 	UpdsPath = "updates"
 
+	// WritePath is the path to InfluxDB line protocol handler.
+	WritePath = "write"
+
 	// GaugePath is the path to gauge handler.
 	GaugePath = "gauge"
 	// CounterPath is the path to counter handler.
 	CounterPath = "counter"
+	// HistogramPath is the path to histogram handler.
+	HistogramPath = "histogram"
+	// SummaryPath is the path to summary handler.
+	SummaryPath = "summary"
 
 	// TypePath is the path to type handler.
 	TypePath = "type"
@@ -69,4 +247,51 @@ const (
 	NamePath = "name"
 	// ValuePath is the path to value handler.
 	ValuePath = "value"
+	// QueryPath is the path to query handler.
+	QueryPath = "query"
+	// StreamPath is the path to stream handler.
+	StreamPath = "stream"
+	// MetricsPath is the path to Prometheus exposition handler.
+	MetricsPath = "metrics"
+	// HistoryPath is the path to history handler.
+	HistoryPath = "history"
+	// AuditPath is the path to audit log handler.
+	AuditPath = "audit"
+
+	// IdempotencyKeyHeader carries a key identifying a batch of updates, so
+	// that a retried batch is not applied twice.
+	IdempotencyKeyHeader = "Idempotency-Key"
+	// IdempotentReplayedHeader is set on the response to a batch that was
+	// applied before and has not been applied again. The response is 204
+	// without item results when they are asked for with ResultsQuery.
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+
+	// FromQuery is the query parameter for the beginning of a time range.
+	FromQuery = "from"
+	// ToQuery is the query parameter for the end of a time range.
+	ToQuery = "to"
+	// MatchQuery is the query parameter for a series selector.
+	MatchQuery = "match"
+	// TypeQuery is the query parameter for a metric type.
+	TypeQuery = "type"
+	// MetricQuery is the query parameter for a metric name or series key.
+	MetricQuery = "metric"
+	// NameQuery is the query parameter for a metric name glob pattern.
+	NameQuery = "name"
+	// RegexQuery is the query parameter for a metric name regular expression.
+	RegexQuery = "regex"
+	// SortQuery is the query parameter for the order of the results.
+	SortQuery = "sort"
+	// OrderQuery is the query parameter for the direction of the order.
+	OrderQuery = "order"
+	// LimitQuery is the query parameter for the page size.
+	LimitQuery = "limit"
+	// CursorQuery is the query parameter for the page to start from.
+	CursorQuery = "cursor"
+	// ResultsQuery is the query parameter asking for the result of every
+	// item of a batch.
+	ResultsQuery = "results"
+	// PrecisionQuery is the query parameter for the unit of the line
+	// protocol timestamps, nanoseconds by default.
+	PrecisionQuery = "precision"
 )
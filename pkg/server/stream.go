@@ -0,0 +1,83 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/a-tho/monitor/pkg/stream"
+)
+
+const (
+	// heartbeatInterval is how often an idle stream sends a comment to keep
+	// the connection open.
+	heartbeatInterval = 15 * time.Second
+
+	errStreaming = "streaming unsupported"
+	errFilter    = "invalid stream filter"
+
+	typeEventStream = "text/event-stream"
+)
+
+// Stream handles requests for a live stream of accepted updates as
+// Server-Sent Events, optionally narrowed down by the type (may be repeated)
+// and name (glob pattern) query parameters. Each update comes as an "update"
+// event holding the metric as JSON. Updates missed because the client fell
+// behind are counted in a "dropped" event.
+func (s *server) Stream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		fail(w, r, apiStreaming)
+		return
+	}
+
+	query := r.URL.Query()
+	filter := stream.Filter{Types: query[TypeQuery], Name: query.Get(NameQuery)}
+	if err := filter.Validate(); err != nil {
+		fail(w, r, apiFilter)
+		return
+	}
+
+	sub := s.hub.Subscribe(filter, 0)
+	defer sub.Close()
+
+	w.Header().Set(contentType, typeEventStream)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		var err error
+		select {
+		case metric, ok := <-sub.C:
+			if !ok {
+				return // shutting down
+			}
+			if !permitted(r.Context(), metric.ID) {
+				continue
+			}
+			if dropped := sub.Dropped(); dropped > 0 {
+				_, err = fmt.Fprintf(w, "event: dropped\ndata: %d\n\n", dropped)
+			}
+			if err == nil {
+				var data []byte
+				if data, err = json.Marshal(metric); err == nil {
+					_, err = fmt.Fprintf(w, "event: update\ndata: %s\n\n", data)
+				}
+			}
+		case <-heartbeat.C:
+			_, err = fmt.Fprint(w, ": heartbeat\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
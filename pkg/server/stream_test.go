@@ -0,0 +1,56 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	monitor "github.com/a-tho/monitor/internal"
+	"github.com/a-tho/monitor/pkg/storage"
+)
+
+func TestServerStreamHandler(t *testing.T) {
+	metrics, err := storage.New(context.Background(), storage.Options{}, "memory://")
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(NewServer(metrics, ""))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		srv.URL+"/"+StreamPath+"/?"+TypeQuery+"="+CounterPath, nil)
+	require.NoError(t, err)
+	resp, err := srv.Client().Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, typeEventStream, resp.Header.Get(contentType))
+
+	// The gauge is filtered out
+	for _, path := range []string{"/update/gauge/Apple/3", "/update/counter/Nile/2"} {
+		resp, _ := testRequest(t, srv, http.MethodPost, path, nil, nil)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	r := bufio.NewReader(resp.Body)
+	event, err := r.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "event: update\n", event)
+	data, err := r.ReadString('\n')
+	require.NoError(t, err)
+
+	var metric monitor.Metrics
+	require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(data, "data: ")), &metric))
+	assert.Equal(t, "Nile", metric.ID)
+	require.NotNil(t, metric.Delta)
+	assert.Equal(t, int64(2), *metric.Delta)
+}
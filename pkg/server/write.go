@@ -0,0 +1,65 @@
+package server
+
+import (
+	"bufio"
+	"net/http"
+	"time"
+
+	monitor "github.com/a-tho/monitor/internal"
+	"github.com/a-tho/monitor/pkg/influx"
+)
+
+const (
+	// maxLineLen bounds the length of a line protocol line.
+	maxLineLen = 1 << 20
+
+	errLineProtocol = "invalid line protocol"
+	errPrecision    = "invalid timestamp precision"
+)
+
+// Write saves the metrics written in the InfluxDB line protocol, all of them
+// or none. Timestamps are in nanoseconds unless the precision parameter says
+// otherwise.
+func (s *server) Write(w http.ResponseWriter, r *http.Request) {
+	precision := time.Nanosecond
+	if p := r.URL.Query().Get(PrecisionQuery); p != "" {
+		var ok bool
+		if precision, ok = influx.Precisions[p]; !ok {
+			fail(w, r, apiPrecision)
+			return
+		}
+	}
+
+	var batch []*monitor.Metrics
+
+	scanner := bufio.NewScanner(r.Body)
+	scanner.Buffer(nil, maxLineLen)
+	for n := 1; scanner.Scan(); n++ {
+		metrics, err := influx.ParseLine(scanner.Text(), precision, s.mapping)
+		if err != nil {
+			fail(w, r, apiLineProtocol.detailed("line %d: %v", n, err))
+			return
+		}
+		for _, metric := range metrics {
+			if !permitted(r.Context(), metric.ID) {
+				fail(w, r, apiForbiddenName.detailed("line %d", n))
+				return
+			}
+		}
+		batch = append(batch, metrics...)
+	}
+	if err := scanner.Err(); err != nil {
+		fail(w, r, apiLineProtocol)
+		return
+	}
+
+	if len(batch) > 0 {
+		if _, err := s.commit(r, "", batch, errApplyBatch); err != nil {
+			fail(w, r, err)
+			return
+		}
+		s.hub.Publish(batch...)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
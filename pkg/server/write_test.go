@@ -0,0 +1,59 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	monitor "github.com/a-tho/monitor/internal"
+	"github.com/a-tho/monitor/pkg/storage"
+)
+
+func TestServerWriteHandler(t *testing.T) {
+	metrics, err := storage.New(context.Background(), storage.Options{}, "memory://")
+	require.NoError(t, err)
+
+	mapping := monitor.TypeMapping{{Pattern: "*_requests", Type: CounterPath}}
+	srv := httptest.NewServer(NewServer(metrics, "", WithTypeMapping(mapping)))
+	defer srv.Close()
+
+	body := "cpu,host=web1 usage=0.5 1700000000000000000\n\nhttp requests=3i\nhttp requests=2i\n"
+	resp, _ := testRequest(t, srv, http.MethodPost, "/"+WritePath, nil, strings.NewReader(body))
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	gauge, ok := metrics.GetGauge(context.Background(), `cpu_usage{host="web1"}`)
+	require.True(t, ok)
+	assert.Equal(t, monitor.Gauge(0.5), gauge)
+	counter, _ := metrics.GetCounter(context.Background(), "http_requests")
+	assert.Equal(t, monitor.Counter(5), counter)
+
+	// Values are recorded as of their timestamp, in the precision asked for
+	body = "disk free=7 1700000000\n"
+	resp, _ = testRequest(t, srv, http.MethodPost, "/"+WritePath+"?"+PrecisionQuery+"=s", nil, strings.NewReader(body))
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	measured := time.Unix(1700000000, 0)
+	samples, err := metrics.GaugeHistory(context.Background(), "disk_free", measured, measured)
+	require.NoError(t, err)
+	assert.Len(t, samples, 1)
+
+	resp, _ = testRequest(t, srv, http.MethodPost, "/"+WritePath+"?"+PrecisionQuery+"=fortnight", nil, strings.NewReader(body))
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// A bad line rejects the whole request
+	body = "http requests=3i\nhttp requests=oops\n"
+	resp, respBody := testRequest(t, srv, http.MethodPost, "/"+WritePath, nil, strings.NewReader(body))
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Contains(t, respBody, "line 2")
+	counter, _ = metrics.GetCounter(context.Background(), "http_requests")
+	assert.Equal(t, monitor.Counter(5), counter)
+}
@@ -0,0 +1,100 @@
+package statsd
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	monitor "github.com/a-tho/monitor/internal"
+)
+
+// StatsD metric types.
+const (
+	typeCounter   = "c"
+	typeGauge     = "g"
+	typeTimer     = "ms"
+	typeHistogram = "h"
+)
+
+var ErrLine = errors.New("malformed statsd line")
+
+// A sample is a single value read off a StatsD line.
+type sample struct {
+	name   string
+	labels monitor.Labels
+	typ    string
+	value  float64
+	// relative tells that a gauge value is to be added rather than set
+	relative bool
+	// rate is the fraction of the values the client sent, in (0, 1]
+	rate float64
+}
+
+// parseLine parses a line of the form name:value|type[|@rate][|#tag:value,...].
+func parseLine(line string) (sample, error) {
+	s := sample{rate: 1}
+
+	name, rest, ok := strings.Cut(line, ":")
+	if !ok || name == "" {
+		return s, fmt.Errorf("%w: %q", ErrLine, line)
+	}
+	s.name = name
+
+	fields := strings.Split(rest, "|")
+	if len(fields) < 2 {
+		return s, fmt.Errorf("%w: %q", ErrLine, line)
+	}
+
+	s.typ = fields[1]
+	switch s.typ {
+	case typeCounter, typeGauge, typeTimer, typeHistogram:
+	default:
+		return s, fmt.Errorf("%w: unknown type %q", ErrLine, s.typ)
+	}
+
+	value := fields[0]
+	if s.typ == typeGauge && (strings.HasPrefix(value, "+") || strings.HasPrefix(value, "-")) {
+		s.relative = true
+	}
+	var err error
+	if s.value, err = strconv.ParseFloat(value, 64); err != nil || math.IsNaN(s.value) || math.IsInf(s.value, 0) {
+		return s, fmt.Errorf("%w: invalid value %q", ErrLine, value)
+	}
+
+	for _, field := range fields[2:] {
+		switch {
+		case strings.HasPrefix(field, "@"):
+			s.rate, err = strconv.ParseFloat(field[1:], 64)
+			if err != nil || !(s.rate > 0 && s.rate <= 1) {
+				return s, fmt.Errorf("%w: invalid sample rate %q", ErrLine, field)
+			}
+		case strings.HasPrefix(field, "#"):
+			if s.labels, err = parseTags(field[1:]); err != nil {
+				return s, err
+			}
+		}
+	}
+	return s, nil
+}
+
+// parseTags turns DogStatsD tags into labels, tags without a value are
+// dropped.
+func parseTags(tags string) (monitor.Labels, error) {
+	labels := monitor.Labels{}
+	for _, tag := range strings.Split(tags, ",") {
+		name, value, ok := strings.Cut(tag, ":")
+		if !ok {
+			continue
+		}
+		labels[name] = value
+	}
+	if err := labels.Validate(); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrLine, err)
+	}
+	if len(labels) == 0 {
+		return nil, nil
+	}
+	return labels, nil
+}
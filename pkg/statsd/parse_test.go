@@ -0,0 +1,50 @@
+package statsd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	monitor "github.com/a-tho/monitor/internal"
+)
+
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		want    sample
+		wantErr bool
+	}{
+		{name: "counter", line: "requests:1|c", want: sample{name: "requests", typ: typeCounter, value: 1, rate: 1}},
+		{name: "sampled counter", line: "requests:2|c|@0.5", want: sample{name: "requests", typ: typeCounter, value: 2, rate: 0.5}},
+		{name: "gauge", line: "queue:12.5|g", want: sample{name: "queue", typ: typeGauge, value: 12.5, rate: 1}},
+		{name: "relative gauge up", line: "queue:+3|g", want: sample{name: "queue", typ: typeGauge, value: 3, relative: true, rate: 1}},
+		{name: "relative gauge down", line: "queue:-3|g", want: sample{name: "queue", typ: typeGauge, value: -3, relative: true, rate: 1}},
+		{name: "timer", line: "latency:320|ms", want: sample{name: "latency", typ: typeTimer, value: 320, rate: 1}},
+		{name: "histogram", line: "size:4|h", want: sample{name: "size", typ: typeHistogram, value: 4, rate: 1}},
+		{
+			name: "tags",
+			line: "requests:1|c|#code:200,canary",
+			want: sample{name: "requests", labels: monitor.Labels{"code": "200"}, typ: typeCounter, value: 1, rate: 1},
+		},
+		{name: "no value", line: "requests|c", wantErr: true},
+		{name: "no type", line: "requests:1", wantErr: true},
+		{name: "unknown type", line: "requests:1|s", wantErr: true},
+		{name: "invalid value", line: "requests:one|c", wantErr: true},
+		{name: "nan", line: "queue:NaN|g", wantErr: true},
+		{name: "zero rate", line: "requests:1|c|@0", wantErr: true},
+		{name: "invalid tag", line: "requests:1|c|#1code:200", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseLine(tt.line)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrLine)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
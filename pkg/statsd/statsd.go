@@ -0,0 +1,268 @@
+// Package statsd implements a StatsD listener feeding the metric repository.
+//
+// Counters are added up and gauges set, or shifted when the value is signed.
+// Timers, in milliseconds, and histograms are observed into histograms, timers
+// in seconds. Updates are coalesced in memory and written on every flush.
+package statsd
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	monitor "github.com/a-tho/monitor/internal"
+)
+
+const (
+	// DefaultFlushInterval is how often coalesced updates are written.
+	DefaultFlushInterval = time.Second
+
+	maxPacketSize = 65535
+)
+
+// A Listener receives StatsD packets over UDP.
+type Listener struct {
+	metrics       monitor.MetricRepo
+	conn          net.PacketConn
+	flushInterval time.Duration
+	buckets       []float64
+
+	m          sync.Mutex
+	gauges     map[string]*gaugeUpdate
+	counters   map[string]*counterUpdate
+	histograms map[string]*monitor.Histogram
+}
+
+type (
+	gaugeUpdate struct {
+		metric   monitor.Metrics
+		value    float64
+		relative bool // value is to be added to the stored gauge
+	}
+	counterUpdate struct {
+		metric monitor.Metrics
+		delta  float64 // scaled up by the sample rates
+	}
+)
+
+// Listen returns a listener on the UDP address addr, writing to metrics every
+// flushInterval, or DefaultFlushInterval if not positive. Timers and
+// histograms use the bucket upper bounds buckets, monitor.DefaultBuckets if
+// empty.
+func Listen(addr string, metrics monitor.MetricRepo, flushInterval time.Duration, buckets []float64) (*Listener, error) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if flushInterval <= 0 {
+		flushInterval = DefaultFlushInterval
+	}
+	if len(buckets) == 0 {
+		buckets = monitor.DefaultBuckets()
+	}
+	return &Listener{
+		metrics:       metrics,
+		conn:          conn,
+		flushInterval: flushInterval,
+		buckets:       buckets,
+		gauges:        make(map[string]*gaugeUpdate),
+		counters:      make(map[string]*counterUpdate),
+		histograms:    make(map[string]*monitor.Histogram),
+	}, nil
+}
+
+// Addr returns the address the listener receives packets on.
+func (l *Listener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+// Serve receives packets until ctx is done, then closes the listener and
+// flushes what is left.
+func (l *Listener) Serve(ctx context.Context) error {
+	go func() {
+		<-ctx.Done()
+		l.conn.Close()
+	}()
+
+	flushed := make(chan struct{})
+	go func() {
+		defer close(flushed)
+		l.flushEvery(ctx)
+	}()
+
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, _, err := l.conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				break
+			}
+			log.Err(err).Msg("Failed to read statsd packet")
+			continue
+		}
+		l.handle(string(buf[:n]))
+	}
+
+	<-flushed
+	l.flush(context.Background())
+	return nil
+}
+
+func (l *Listener) flushEvery(ctx context.Context) {
+	t := time.NewTicker(l.flushInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			l.flush(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// handle coalesces the lines of a packet into the pending updates.
+func (l *Listener) handle(packet string) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	for _, line := range strings.Split(packet, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		s, err := parseLine(line)
+		if err != nil {
+			log.Debug().Err(err).Msg("Skipping statsd line")
+			continue
+		}
+		l.add(s)
+	}
+}
+
+// add merges the sample into the pending updates, l.m must be held.
+func (l *Listener) add(s sample) {
+	metric := monitor.Metrics{ID: s.name, Labels: s.labels}
+	key := metric.Key()
+
+	// Storages apply batches by the metric type
+	switch s.typ {
+	case typeCounter:
+		update, ok := l.counters[key]
+		if !ok {
+			metric.MType = "counter"
+			update = &counterUpdate{metric: metric}
+			l.counters[key] = update
+		}
+		update.delta += s.value / s.rate
+
+	case typeGauge:
+		update, ok := l.gauges[key]
+		switch {
+		case !ok:
+			metric.MType = "gauge"
+			l.gauges[key] = &gaugeUpdate{metric: metric, value: s.value, relative: s.relative}
+		case s.relative:
+			update.value += s.value
+		default:
+			update.value, update.relative = s.value, false
+		}
+
+	case typeTimer, typeHistogram:
+		h, ok := l.histograms[key]
+		if !ok {
+			h = monitor.NewHistogram(l.buckets)
+			l.histograms[key] = h
+		}
+		v := s.value
+		if s.typ == typeTimer {
+			v /= 1000 // milliseconds to seconds
+		}
+		// Each sampled value stands for 1/rate of them
+		for i := math.Round(1 / s.rate); i > 0; i-- {
+			h.Observe(v)
+		}
+	}
+}
+
+// flush writes the pending updates.
+func (l *Listener) flush(ctx context.Context) {
+	l.m.Lock()
+	gauges, counters, histograms := l.gauges, l.counters, l.histograms
+	l.gauges = make(map[string]*gaugeUpdate)
+	l.counters = make(map[string]*counterUpdate)
+	l.histograms = make(map[string]*monitor.Histogram)
+	l.m.Unlock()
+
+	if len(gauges) > 0 {
+		batch := make([]*monitor.Metrics, 0, len(gauges))
+		for _, update := range gauges {
+			value := update.value
+			metric := update.metric
+			metric.Value, metric.Shift = &value, update.relative
+			batch = append(batch, &metric)
+		}
+		// Shifted gauges are added to as the storage commits them
+		if _, err := l.metrics.CommitBatch(ctx, "", batch); err != nil {
+			log.Err(err).Msg("Failed to flush statsd gauges")
+		}
+	}
+
+	if len(counters) > 0 {
+		batch := make([]*monitor.Metrics, 0, len(counters))
+		var leftovers []*counterUpdate
+		for _, update := range counters {
+			whole := math.Round(update.delta)
+			if whole != update.delta {
+				leftovers = append(leftovers, &counterUpdate{metric: update.metric, delta: update.delta - whole})
+			}
+			if whole == 0 {
+				continue
+			}
+			delta := int64(whole)
+			metric := update.metric
+			metric.Delta = &delta
+			batch = append(batch, &metric)
+		}
+		l.carry(leftovers)
+		if len(batch) > 0 {
+			if _, err := l.metrics.AddCounterBatch(ctx, batch); err != nil {
+				log.Err(err).Msg("Failed to flush statsd counters")
+			}
+		}
+	}
+
+	for key, h := range histograms {
+		if _, err := l.metrics.AddHistogram(ctx, key, *h); err != nil {
+			log.Err(err).Str("key", key).Msg("Failed to flush statsd histogram")
+		}
+	}
+}
+
+// carry adds the fractions of counter increments left over by a flush to the
+// pending updates, so that they add up over the next flushes.
+func (l *Listener) carry(leftovers []*counterUpdate) {
+	if len(leftovers) == 0 {
+		return
+	}
+
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	for _, leftover := range leftovers {
+		key := leftover.metric.Key()
+		if update, ok := l.counters[key]; ok {
+			update.delta += leftover.delta
+		} else {
+			l.counters[key] = leftover
+		}
+	}
+}
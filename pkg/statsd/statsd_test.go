@@ -0,0 +1,100 @@
+package statsd
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	monitor "github.com/a-tho/monitor/internal"
+	"github.com/a-tho/monitor/pkg/storage"
+)
+
+func TestListener(t *testing.T) {
+	// The file storage applies and logs batches by the metric type
+	addrs := []string{"memory://", "file://" + filepath.Join(t.TempDir(), "metrics-db.json")}
+	for _, addr := range addrs {
+		t.Run(addr, func(t *testing.T) {
+			testListener(t, addr)
+		})
+	}
+}
+
+func testListener(t *testing.T, addr string) {
+	ctx := context.Background()
+	metrics, err := storage.New(ctx, storage.Options{}, addr)
+	require.NoError(t, err)
+	defer metrics.Close()
+	_, err = metrics.SetGauge(ctx, "queue", 10)
+	require.NoError(t, err)
+
+	l, err := Listen("127.0.0.1:0", metrics, time.Hour, []float64{0.1, 1})
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(ctx)
+	served := make(chan error)
+	go func() { served <- l.Serve(ctx) }()
+
+	conn, err := net.Dial("udp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	for _, packet := range []string{
+		"requests:1|c\nrequests:2|c|@0.5",
+		"queue:+5|g\nqueue:-2|g",
+		"temp:20|g\ntemp:21|g",
+		"latency:50|ms\nlatency:500|ms|@0.5",
+		"requests:1|c|#code:500\nbogus",
+	} {
+		_, err := conn.Write([]byte(packet))
+		require.NoError(t, err)
+	}
+
+	// Everything sent is flushed on shutdown
+	require.Eventually(t, func() bool {
+		l.m.Lock()
+		defer l.m.Unlock()
+		return len(l.counters) == 2 && len(l.histograms) == 1
+	}, time.Second, 10*time.Millisecond)
+	cancel()
+	require.NoError(t, <-served)
+
+	counter, _ := metrics.GetCounter(context.Background(), "requests")
+	assert.Equal(t, monitor.Counter(5), counter)
+	counter, _ = metrics.GetCounter(context.Background(), `requests{code="500"}`)
+	assert.Equal(t, monitor.Counter(1), counter)
+
+	gauge, _ := metrics.GetGauge(context.Background(), "queue")
+	assert.Equal(t, monitor.Gauge(13), gauge)
+	gauge, _ = metrics.GetGauge(context.Background(), "temp")
+	assert.Equal(t, monitor.Gauge(21), gauge)
+
+	h, ok := metrics.GetHistogram(context.Background(), "latency")
+	require.True(t, ok)
+	assert.Equal(t, []uint64{1, 2, 0}, h.Counts)
+	assert.Equal(t, uint64(3), h.Count)
+}
+
+func TestListenerFlushFractions(t *testing.T) {
+	ctx := context.Background()
+	metrics, err := storage.New(ctx, storage.Options{}, "memory://")
+	require.NoError(t, err)
+	defer metrics.Close()
+
+	l, err := Listen("127.0.0.1:0", metrics, time.Hour, nil)
+	require.NoError(t, err)
+	defer l.conn.Close()
+
+	// Every sample stands for 2.5 hits, the halves add up over the flushes
+	for i := 0; i < 2; i++ {
+		l.m.Lock()
+		l.add(sample{name: "hits", typ: typeCounter, value: 1, rate: 0.4})
+		l.m.Unlock()
+		l.flush(ctx)
+	}
+
+	counter, _ := metrics.GetCounter(ctx, "hits")
+	assert.Equal(t, monitor.Counter(5), counter)
+}
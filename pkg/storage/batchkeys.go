@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	monitor "github.com/a-tho/monitor/internal"
+)
+
+const (
+	// batchKeyTTL is how long the idempotency key of an applied batch is
+	// remembered, long enough to cover the retries of a client.
+	batchKeyTTL = time.Hour
+	// batchClaimLease is how long a claimed batch may take to be applied
+	// before the key may be claimed again, as it is when the claim holder
+	// crashed midway.
+	batchClaimLease = time.Minute
+)
+
+// batchKeys remembers the idempotency keys of the batches being applied and
+// recently applied.
+type batchKeys struct {
+	applied map[string]time.Time
+	order   []batchClaim // applied keys, oldest first
+	pending map[string]time.Time
+}
+
+type batchClaim struct {
+	key  string
+	time time.Time
+}
+
+func newBatchKeys() *batchKeys {
+	return &batchKeys{applied: make(map[string]time.Time), pending: make(map[string]time.Time)}
+}
+
+// claim claims the key at t and tells its state. Applied keys older than
+// batchKeyTTL and claims older than batchClaimLease are forgotten on the way.
+func (b *batchKeys) claim(t time.Time, key string) monitor.BatchState {
+	for len(b.order) > 0 && t.Sub(b.order[0].time) >= batchKeyTTL {
+		oldest := b.order[0]
+		// The key may have been applied again since
+		if appliedAt, ok := b.applied[oldest.key]; ok && appliedAt.Equal(oldest.time) {
+			delete(b.applied, oldest.key)
+		}
+		b.order = b.order[1:]
+	}
+	for k, claimedAt := range b.pending {
+		if t.Sub(claimedAt) >= batchClaimLease {
+			delete(b.pending, k)
+		}
+	}
+
+	if _, ok := b.applied[key]; ok {
+		return monitor.BatchApplied
+	}
+	if _, ok := b.pending[key]; ok {
+		return monitor.BatchPending
+	}
+	b.pending[key] = t
+	return monitor.BatchNew
+}
+
+// commit records the key as applied at t.
+func (b *batchKeys) commit(t time.Time, key string) {
+	delete(b.pending, key)
+	b.applied[key] = t
+	b.order = append(b.order, batchClaim{key: key, time: t})
+}
+
+// release gives the claim of the key up so that the batch can be applied
+// again.
+func (b *batchKeys) release(key string) {
+	delete(b.pending, key)
+}
+
+// MarshalJSON encodes the applied keys, claims do not outlive the process.
+func (b *batchKeys) MarshalJSON() ([]byte, error) {
+	return json.Marshal(b.applied)
+}
+
+// UnmarshalJSON decodes the applied keys.
+func (b *batchKeys) UnmarshalJSON(data []byte) error {
+	applied := make(map[string]time.Time)
+	if err := json.Unmarshal(data, &applied); err != nil {
+		return err
+	}
+
+	order := make([]batchClaim, 0, len(applied))
+	for key, t := range applied {
+		order = append(order, batchClaim{key: key, time: t})
+	}
+	sort.Slice(order, func(i, j int) bool { return order[i].time.Before(order[j].time) })
+
+	b.applied, b.order, b.pending = applied, order, make(map[string]time.Time)
+	return nil
+}
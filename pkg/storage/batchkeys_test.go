@@ -0,0 +1,33 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	monitor "github.com/a-tho/monitor/internal"
+)
+
+func TestBatchKeysClaim(t *testing.T) {
+	keys := newBatchKeys()
+	start := time.Now()
+
+	assert.Equal(t, monitor.BatchNew, keys.claim(start, "a"))
+	assert.Equal(t, monitor.BatchPending, keys.claim(start.Add(time.Second), "a"), "being applied")
+	keys.commit(start.Add(time.Second), "a")
+	assert.Equal(t, monitor.BatchApplied, keys.claim(start.Add(time.Minute), "a"), "duplicate")
+	assert.Equal(t, monitor.BatchNew, keys.claim(start.Add(time.Minute), "b"))
+
+	keys.release("b")
+	assert.Equal(t, monitor.BatchNew, keys.claim(start.Add(2*time.Minute), "b"), "released")
+	// The claim holder crashed
+	assert.Equal(t, monitor.BatchNew, keys.claim(start.Add(2*time.Minute+batchClaimLease), "b"), "stale claim")
+	keys.commit(start.Add(3*time.Minute), "b")
+
+	// a expires, b was applied later and does not
+	later := start.Add(batchKeyTTL + 2*time.Minute)
+	assert.Equal(t, monitor.BatchNew, keys.claim(later, "a"), "expired")
+	assert.Equal(t, monitor.BatchApplied, keys.claim(later, "b"))
+	assert.Len(t, keys.applied, 1)
+}
@@ -0,0 +1,41 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	monitor "github.com/a-tho/monitor/internal"
+)
+
+// maxExpireInterval bounds how long an expired gauge may outlive its TTL.
+const maxExpireInterval = time.Minute
+
+// ExpireGauges removes the gauges of metrics that have not been updated
+// within ttl, checking every ttl or maxExpireInterval, whichever is shorter,
+// until ctx is done.
+func ExpireGauges(ctx context.Context, metrics monitor.MetricRepo, ttl time.Duration) {
+	interval := ttl
+	if interval > maxExpireInterval {
+		interval = maxExpireInterval
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			expired, err := metrics.ExpireGauges(ctx, time.Now().Add(-ttl))
+			if err != nil {
+				log.Err(err).Msg("Failed to expire gauges")
+				continue
+			}
+			if expired > 0 {
+				log.Info().Int("gauges", expired).Msg("Expired stale gauges")
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
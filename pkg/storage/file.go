@@ -0,0 +1,409 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	monitor "github.com/a-tho/monitor/internal"
+	"github.com/a-tho/monitor/pkg/retry"
+)
+
+// walSuffix is appended to the snapshot file path to name the write-ahead log.
+const walSuffix = ".wal"
+
+// FileStorage keeps metrics in memory and makes them durable with a snapshot
+// file and a write-ahead log (WAL) next to it. Every update is appended to the
+// log before it is applied, and the log is compacted into the snapshot every
+// store interval or once it grows too large. Each snapshot is also kept as a
+// timestamped copy, up to a configured number of the most recent ones.
+type FileStorage struct {
+	*MemStorage
+	path      string // snapshot file
+	snapshots int    // number of timestamped copies kept
+	wal       *wal
+	syncMode  bool // Whether every update is synced to disk
+	done      chan struct{}
+}
+
+func newFileStorage(ctx context.Context, addr *url.URL, opts Options) (monitor.MetricRepo, error) {
+	storage := FileStorage{
+		MemStorage: NewMemStorage(opts.HistorySize),
+		path:       filePath(addr),
+		snapshots:  opts.Snapshots,
+		syncMode:   opts.StoreInterval <= 0,
+		done:       make(chan struct{}),
+	}
+
+	err := retry.Do(ctx, func(ctx context.Context) (err error) {
+		storage.wal, err = openWAL(storage.path + walSuffix)
+		if err != nil {
+			return retry.RetriableError(err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case opts.RestoreSnapshot != "":
+		err = storage.restoreSnapshot(opts.RestoreSnapshot)
+	case opts.Restore:
+		err = storage.restore()
+	}
+	if err != nil {
+		storage.wal.Close()
+		return nil, err
+	}
+
+	// Start over from a compact state, which also discards the log of the
+	// previous run when not restoring
+	storage.m.Lock()
+	err = storage.compactLocked()
+	storage.m.Unlock()
+	if err != nil {
+		storage.wal.Close()
+		return nil, err
+	}
+
+	if !storage.syncMode {
+		go storage.memBackup(opts.StoreInterval)
+	}
+
+	log.Info().Msg("Initialized file storage successfully")
+
+	return &storage, nil
+}
+
+// filePath extracts the file path from addr, which may be absolute
+// ("file:///tmp/db.json") or relative ("file:db.json", "file://db.json").
+func filePath(addr *url.URL) string {
+	if addr.Opaque != "" {
+		return addr.Opaque
+	}
+	return addr.Host + addr.Path
+}
+
+// restore loads the latest snapshot and replays the log records that came
+// after it.
+func (s *FileStorage) restore() error {
+	snap := snapshot{MemStorage: NewMemStorage(s.historySize)}
+	if err := readSnapshot(s.path, &snap); err != nil {
+		return err
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.load(snap.MemStorage)
+
+	replayed, err := s.wal.replay(snap.Seq, func(rec walRecord) { s.apply(rec, nil) })
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrRestore, err)
+	}
+	log.Info().Int("records", replayed).Msg("Replayed write-ahead log")
+
+	if s.wal.seq < snap.Seq {
+		s.wal.seq = snap.Seq
+	}
+	return nil
+}
+
+// restoreSnapshot loads the snapshot named by which, see snapshotPath. The log
+// is not replayed as its records follow the latest snapshot rather than the
+// chosen one.
+func (s *FileStorage) restoreSnapshot(which string) error {
+	path, err := snapshotPath(s.path, which)
+	if err != nil {
+		return err
+	}
+
+	snap := snapshot{MemStorage: NewMemStorage(s.historySize)}
+	if err = readSnapshot(path, &snap); err != nil {
+		return err
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.load(snap.MemStorage)
+	s.wal.seq = snap.Seq
+
+	log.Info().Str("snapshot", path).Msg("Restored snapshot")
+
+	return nil
+}
+
+func (s *FileStorage) memBackup(storeInterval int) {
+	// Compact the log every storeInterval seconds until closed
+	t := time.NewTicker(time.Duration(storeInterval) * time.Second)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			if err := s.compact(); err != nil {
+				log.Err(err).Msg("Failed to compact write-ahead log")
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// SetGauge inserts or updates a gauge metric value v for the key k.
+func (s *FileStorage) SetGauge(_ context.Context, k string, v monitor.Gauge) (monitor.MetricRepo, error) {
+	value := float64(v)
+	return s, s.record([]*monitor.Metrics{{ID: k, MType: typeGauge, Value: &value}})
+}
+
+// SetGaugeBatch inserts or updates a gauge metrics batch.
+func (s *FileStorage) SetGaugeBatch(_ context.Context, batch []*monitor.Metrics) (monitor.MetricRepo, error) {
+	return s, s.record(batch)
+}
+
+// AddCounter adds a counter metric value v for the key k.
+func (s *FileStorage) AddCounter(_ context.Context, k string, v monitor.Counter) (monitor.MetricRepo, error) {
+	delta := int64(v)
+	return s, s.record([]*monitor.Metrics{{ID: k, MType: typeCounter, Delta: &delta}})
+}
+
+// AddCounterBatch adds a counter metrics batch.
+func (s *FileStorage) AddCounterBatch(_ context.Context, batch []*monitor.Metrics) (monitor.MetricRepo, error) {
+	return s, s.record(batch)
+}
+
+// AddHistogram merges the histogram v into the histogram for the key k.
+func (s *FileStorage) AddHistogram(_ context.Context, k string, v monitor.Histogram) (monitor.MetricRepo, error) {
+	return s, s.record([]*monitor.Metrics{{ID: k, MType: typeHistogram, Histogram: &v}})
+}
+
+// AddSummary adds the observations of v to the summary for the key k.
+func (s *FileStorage) AddSummary(_ context.Context, k string, v monitor.Summary) (monitor.MetricRepo, error) {
+	return s, s.record([]*monitor.Metrics{{ID: k, MType: typeSummary, Summary: &v}})
+}
+
+// ApplyBatch applies a batch of metrics of any type with a single log record.
+func (s *FileStorage) ApplyBatch(_ context.Context, batch []*monitor.Metrics) (monitor.MetricRepo, error) {
+	return s, s.record(batch)
+}
+
+// CommitBatch applies a batch like ApplyBatch, its idempotency key going in
+// the same log record.
+func (s *FileStorage) CommitBatch(_ context.Context, key string, batch []*monitor.Metrics) ([]monitor.Change, error) {
+	changes := make([]monitor.Change, len(batch))
+	if err := s.recordKeyed(key, batch, changes); err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// Delete removes the series k of the metric type mtype.
+func (s *FileStorage) Delete(_ context.Context, mtype, k string) (monitor.MetricRepo, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if !s.has(mtype, k) {
+		return s, monitor.ErrNotFound
+	}
+	return s, s.recordDeleteLocked([]*monitor.Metrics{{ID: k, MType: mtype}})
+}
+
+// DeleteBatch removes the series of the metrics batch, skipping missing ones.
+func (s *FileStorage) DeleteBatch(_ context.Context, batch []*monitor.Metrics) (monitor.MetricRepo, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	existing := make([]*monitor.Metrics, 0, len(batch))
+	for _, metric := range batch {
+		if s.has(metric.MType, metric.Key()) {
+			existing = append(existing, &monitor.Metrics{ID: metric.Key(), MType: metric.MType})
+		}
+	}
+	return s, s.recordDeleteLocked(existing)
+}
+
+// ExpireGauges removes the gauges last updated before the given time.
+func (s *FileStorage) ExpireGauges(_ context.Context, before time.Time) (int, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	expired := s.expiredGauges(before)
+	metrics := make([]*monitor.Metrics, len(expired))
+	for i, k := range expired {
+		metrics[i] = &monitor.Metrics{ID: k, MType: typeGauge}
+	}
+	if err := s.recordDeleteLocked(metrics); err != nil {
+		return 0, err
+	}
+	return len(expired), nil
+}
+
+// Close compacts the log one last time and closes it.
+func (s *FileStorage) Close() error {
+	close(s.done)
+
+	err := s.compact()
+
+	return errors.Join(err, s.wal.Close())
+}
+
+// load replaces the metrics with the restored ones, s.m must be held.
+func (s *FileStorage) load(restored *MemStorage) {
+	s.DataGauge = restored.DataGauge
+	s.DataCounter = restored.DataCounter
+	s.DataHistogram = restored.DataHistogram
+	s.DataSummary = restored.DataSummary
+	s.UpdatedGauge = restored.UpdatedGauge
+	s.BatchKeys = restored.BatchKeys
+
+	// Snapshots taken before update times were tracked have none, count the
+	// gauges as updated now rather than expiring them right away
+	now := time.Now()
+	for k := range s.DataGauge {
+		if _, ok := s.UpdatedGauge[k]; !ok {
+			s.UpdatedGauge[k] = now
+		}
+	}
+}
+
+// has tells whether the series k of the metric type mtype exists, s.m must be
+// held.
+func (s *FileStorage) has(mtype, k string) bool {
+	var ok bool
+	switch mtype {
+	case typeGauge:
+		_, ok = s.DataGauge[k]
+	case typeCounter:
+		_, ok = s.DataCounter[k]
+	case typeHistogram:
+		_, ok = s.DataHistogram[k]
+	case typeSummary:
+		_, ok = s.DataSummary[k]
+	}
+	return ok
+}
+
+// record appends the metrics to the log and then applies them.
+func (s *FileStorage) record(metrics []*monitor.Metrics) error {
+	return s.recordKeyed("", metrics, nil)
+}
+
+// recordKeyed is record for a batch with an idempotency key, if not empty.
+// The changes, if not nil, receive how every metric changed its series.
+func (s *FileStorage) recordKeyed(key string, metrics []*monitor.Metrics, changes []monitor.Change) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	// Only log what is sure to apply
+	if err := s.checkBatch(metrics); err != nil {
+		return err
+	}
+
+	return s.appendLocked(walRecord{Time: time.Now(), Metrics: s.unshift(metrics), Key: key}, changes)
+}
+
+// unshift returns the metrics with the gauges to shift set to the values they
+// shift to instead, as the log does not keep Shift, s.m must be held.
+func (s *FileStorage) unshift(metrics []*monitor.Metrics) []*monitor.Metrics {
+	var out []*monitor.Metrics
+	set := make(map[string]float64) // gauges set earlier in the batch
+	for i, metric := range metrics {
+		if metric.MType != typeGauge {
+			continue
+		}
+		k := metric.Key()
+		v := *metric.Value
+		if metric.Shift {
+			current, ok := set[k]
+			if !ok {
+				current = float64(s.DataGauge[k])
+			}
+			v += current
+
+			if out == nil {
+				out = append([]*monitor.Metrics(nil), metrics...)
+			}
+			unshifted := *metric
+			unshifted.Value, unshifted.Shift = &v, false
+			out[i] = &unshifted
+		}
+		set[k] = v
+	}
+	if out == nil {
+		return metrics
+	}
+	return out
+}
+
+// recordDeleteLocked appends a record deleting the series of the metrics to
+// the log and then applies it, s.m must be held.
+func (s *FileStorage) recordDeleteLocked(metrics []*monitor.Metrics) error {
+	if len(metrics) == 0 {
+		return nil
+	}
+	return s.appendLocked(walRecord{Time: time.Now(), Op: walOpDelete, Metrics: metrics}, nil)
+}
+
+// appendLocked appends the record to the log and applies it, compacting the
+// log if it has grown too large, s.m must be held.
+func (s *FileStorage) appendLocked(rec walRecord, changes []monitor.Change) error {
+	if err := s.wal.append(rec, s.syncMode); err != nil {
+		return err
+	}
+	s.apply(rec, changes)
+
+	if s.wal.size < walCompactSize {
+		return nil
+	}
+	return s.compactLocked()
+}
+
+// apply applies a log record, s.m must be held. The changes, if not nil,
+// receive how the updates changed their series.
+func (s *FileStorage) apply(rec walRecord, changes []monitor.Change) {
+	if rec.Op == walOpDelete {
+		for _, metric := range rec.Metrics {
+			s.deleteSeries(metric.MType, metric.Key())
+		}
+		return
+	}
+	s.applyBatch(rec.Time, rec.Metrics, changes)
+	if rec.Key != "" {
+		s.BatchKeys.commit(rec.Time, rec.Key)
+	}
+}
+
+// compact writes a snapshot and empties the log, whose records the snapshot
+// now includes. Nothing is written if the log is empty already.
+func (s *FileStorage) compact() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.wal.size == 0 {
+		return nil
+	}
+	return s.compactLocked()
+}
+
+// compactLocked is compact that writes a snapshot in any case, s.m must be
+// held.
+func (s *FileStorage) compactLocked() error {
+	// no real context here because write to the file needs to happen
+	// regardless of context canceling etc
+	return retry.Do(context.Background(), func(context.Context) error {
+		snap := snapshot{MemStorage: s.MemStorage, Seq: s.wal.seq}
+		if err := writeSnapshot(s.path, snap, s.snapshots); err != nil {
+			return retry.RetriableError(err)
+		}
+		if err := s.wal.truncate(); err != nil {
+			return retry.RetriableError(err)
+		}
+		return nil
+	})
+}
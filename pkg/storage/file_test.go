@@ -0,0 +1,235 @@
+package storage
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	monitor "github.com/a-tho/monitor/internal"
+	"github.com/a-tho/monitor/internal/rotate"
+)
+
+func TestFileStorageRestore(t *testing.T) {
+	addr := (&url.URL{Scheme: SchemeFile, Path: filepath.Join(t.TempDir(), "metrics.json")}).String()
+	ctx := context.Background()
+
+	s, err := New(ctx, Options{StoreInterval: 0}, addr)
+	require.NoError(t, err)
+	require.IsType(t, &FileStorage{}, s)
+
+	_, err = s.SetGauge(ctx, "Apple", monitor.Gauge(3))
+	require.NoError(t, err)
+	_, err = s.AddCounter(ctx, "Mississippi", monitor.Counter(5))
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	s, err = New(ctx, Options{StoreInterval: 0, Restore: true}, addr)
+	require.NoError(t, err)
+	defer s.Close()
+
+	gaugeJSON, err := s.StringGauge(ctx)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"Apple": 3}`, gaugeJSON)
+	counterJSON, err := s.StringCounter(ctx)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"Mississippi": 5}`, counterJSON)
+}
+
+func TestFileStorageReplayWAL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	addr := (&url.URL{Scheme: SchemeFile, Path: path}).String()
+	ctx := context.Background()
+
+	// A long store interval leaves every update in the log only
+	s, err := New(ctx, Options{StoreInterval: 3600}, addr)
+	require.NoError(t, err)
+
+	_, err = s.SetGauge(ctx, "Apple", monitor.Gauge(3))
+	require.NoError(t, err)
+	delta := int64(2)
+	_, err = s.AddCounterBatch(ctx, []*monitor.Metrics{
+		{ID: "Nile", MType: typeCounter, Delta: &delta},
+		{ID: "Nile", MType: typeCounter, Delta: &delta},
+	})
+	require.NoError(t, err)
+
+	// Simulate a crash that tore the last record
+	fs := s.(*FileStorage)
+	close(fs.done)
+	require.NoError(t, fs.wal.Close())
+	wal, err := os.OpenFile(path+walSuffix, os.O_WRONLY|os.O_APPEND, 0o644)
+	require.NoError(t, err)
+	_, err = wal.WriteString(`0badc0de {"seq":3,"metr`)
+	require.NoError(t, err)
+	require.NoError(t, wal.Close())
+
+	s, err = New(ctx, Options{StoreInterval: 3600, Restore: true}, addr)
+	require.NoError(t, err)
+	defer s.Close()
+
+	gaugeJSON, err := s.StringGauge(ctx)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"Apple": 3}`, gaugeJSON)
+	counterJSON, err := s.StringCounter(ctx)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"Nile": 4}`, counterJSON)
+}
+
+func TestFileStorageRestoreSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	addr := (&url.URL{Scheme: SchemeFile, Path: path}).String()
+	ctx := context.Background()
+
+	s, err := New(ctx, Options{StoreInterval: 0, Snapshots: 2}, addr)
+	require.NoError(t, err)
+	fs := s.(*FileStorage)
+
+	// Every compaction rotates a snapshot
+	for _, v := range []monitor.Gauge{1, 2, 3} {
+		_, err = s.SetGauge(ctx, "Apple", v)
+		require.NoError(t, err)
+		require.NoError(t, fs.compact())
+	}
+	require.NoError(t, s.Close())
+
+	snapshots, err := rotate.List(path)
+	require.NoError(t, err)
+	require.Len(t, snapshots, 2)
+
+	// The oldest snapshot kept has Apple set to 2
+	which := strings.TrimPrefix(snapshots[0], path+".")
+	s, err = New(ctx, Options{StoreInterval: 0, RestoreSnapshot: which}, addr)
+	require.NoError(t, err)
+	defer s.Close()
+
+	gaugeJSON, err := s.StringGauge(ctx)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"Apple": 2}`, gaugeJSON)
+}
+
+func TestFileStorageRestoreBatchKeys(t *testing.T) {
+	addr := (&url.URL{Scheme: SchemeFile, Path: filepath.Join(t.TempDir(), "metrics.json")}).String()
+	ctx := context.Background()
+
+	s, err := New(ctx, Options{StoreInterval: 3600}, addr)
+	require.NoError(t, err)
+	fs := s.(*FileStorage)
+
+	// One key goes in the snapshot, the other in the log only
+	delta := int64(2)
+	batch := []*monitor.Metrics{{ID: "Nile", MType: typeCounter, Delta: &delta}}
+	for _, key := range []string{"a", "b"} {
+		state, err := s.ClaimBatch(ctx, key)
+		require.NoError(t, err)
+		require.Equal(t, monitor.BatchNew, state)
+		_, err = s.CommitBatch(ctx, key, batch)
+		require.NoError(t, err)
+		if key == "a" {
+			require.NoError(t, fs.compact())
+		}
+	}
+	_, err = s.ClaimBatch(ctx, "c")
+	require.NoError(t, err)
+	close(fs.done)
+	require.NoError(t, fs.wal.Close())
+
+	s, err = New(ctx, Options{StoreInterval: 3600, Restore: true}, addr)
+	require.NoError(t, err)
+	defer s.Close()
+
+	for key, want := range map[string]monitor.BatchState{"a": monitor.BatchApplied, "b": monitor.BatchApplied, "c": monitor.BatchNew} {
+		state, err := s.ClaimBatch(ctx, key)
+		require.NoError(t, err)
+		assert.Equal(t, want, state, key)
+	}
+	counter, _ := s.GetCounter(ctx, "Nile")
+	assert.Equal(t, monitor.Counter(4), counter)
+}
+
+func TestFileStorageReplayShift(t *testing.T) {
+	addr := (&url.URL{Scheme: SchemeFile, Path: filepath.Join(t.TempDir(), "metrics.json")}).String()
+	ctx := context.Background()
+
+	s, err := New(ctx, Options{StoreInterval: 3600}, addr)
+	require.NoError(t, err)
+
+	set, down := 10.0, -2.0
+	batch := []*monitor.Metrics{
+		{ID: "depth", MType: typeGauge, Value: &set},
+		{ID: "depth", MType: typeGauge, Value: &down, Shift: true},
+	}
+	_, err = s.CommitBatch(ctx, "", batch)
+	require.NoError(t, err)
+
+	// Leave the batch in the log only, which keeps the shifted value
+	fs := s.(*FileStorage)
+	close(fs.done)
+	require.NoError(t, fs.wal.Close())
+
+	s, err = New(ctx, Options{StoreInterval: 3600, Restore: true}, addr)
+	require.NoError(t, err)
+	defer s.Close()
+
+	gauge, _ := s.GetGauge(ctx, "depth")
+	assert.Equal(t, monitor.Gauge(8), gauge)
+}
+
+func TestFileStorageRestoreCorrupted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	addr := (&url.URL{Scheme: SchemeFile, Path: path}).String()
+	require.NoError(t, os.WriteFile(path, []byte(`{"DataGauge": {"Apple"`), 0o644))
+
+	_, err := New(context.Background(), Options{Restore: true}, addr, "memory://")
+	assert.ErrorIs(t, err, ErrRestore)
+}
+
+func TestFileStorageReplayDelete(t *testing.T) {
+	addr := (&url.URL{Scheme: SchemeFile, Path: filepath.Join(t.TempDir(), "metrics.json")}).String()
+	ctx := context.Background()
+
+	s, err := New(ctx, Options{StoreInterval: 3600}, addr)
+	require.NoError(t, err)
+
+	_, err = s.SetGauge(ctx, "Apple", monitor.Gauge(3))
+	require.NoError(t, err)
+	_, err = s.SetGauge(ctx, "Peach", monitor.Gauge(4))
+	require.NoError(t, err)
+	_, err = s.AddCounter(ctx, "Nile", monitor.Counter(2))
+	require.NoError(t, err)
+
+	_, err = s.Delete(ctx, typeCounter, "Nile")
+	require.NoError(t, err)
+	_, err = s.Delete(ctx, typeCounter, "Amazon")
+	assert.ErrorIs(t, err, monitor.ErrNotFound)
+
+	// Only Peach is updated after the cutoff
+	cutoff := time.Now()
+	_, err = s.SetGauge(ctx, "Peach", monitor.Gauge(5))
+	require.NoError(t, err)
+	expired, err := s.ExpireGauges(ctx, cutoff)
+	require.NoError(t, err)
+	assert.Equal(t, 1, expired)
+
+	// Leave the deletions in the log only
+	fs := s.(*FileStorage)
+	close(fs.done)
+	require.NoError(t, fs.wal.Close())
+
+	s, err = New(ctx, Options{StoreInterval: 3600, Restore: true}, addr)
+	require.NoError(t, err)
+	defer s.Close()
+
+	gaugeJSON, err := s.StringGauge(ctx)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"Peach": 5}`, gaugeJSON)
+	counterJSON, err := s.StringCounter(ctx)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{}`, counterJSON)
+}
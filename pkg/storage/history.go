@@ -0,0 +1,58 @@
+package storage
+
+import (
+	"sort"
+	"time"
+
+	monitor "github.com/a-tho/monitor/internal"
+)
+
+// DefaultHistorySize is the number of samples kept per metric in memory
+// unless configured otherwise.
+const DefaultHistorySize = 1000
+
+type point[T monitor.Gauge | monitor.Counter] struct {
+	time  time.Time
+	value T
+}
+
+// ring is a fixed-size buffer of metric values, once it is full every new
+// value replaces the oldest one.
+type ring[T monitor.Gauge | monitor.Counter] struct {
+	points []point[T]
+	next   int  // position of the next value
+	full   bool // whether next has wrapped around at least once
+}
+
+func newRing[T monitor.Gauge | monitor.Counter](size int) *ring[T] {
+	return &ring[T]{points: make([]point[T], size)}
+}
+
+func (r *ring[T]) push(t time.Time, v T) {
+	r.points[r.next] = point[T]{time: t, value: v}
+	r.next++
+	if r.next == len(r.points) {
+		r.next = 0
+		r.full = true
+	}
+}
+
+// between returns the values recorded within [from, to] in chronological
+// order.
+func (r *ring[T]) between(from, to time.Time) []point[T] {
+	ordered := r.points[:r.next]
+	if r.full {
+		ordered = append(r.points[r.next:len(r.points):len(r.points)], ordered...)
+	}
+
+	var out []point[T]
+	for _, p := range ordered {
+		if p.time.Before(from) || p.time.After(to) {
+			continue
+		}
+		out = append(out, p)
+	}
+	// Values measured before their arrival are not pushed in order
+	sort.SliceStable(out, func(i, j int) bool { return out[i].time.Before(out[j].time) })
+	return out
+}
@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	monitor "github.com/a-tho/monitor/internal"
+)
+
+func TestRingBetween(t *testing.T) {
+	start := time.Date(2023, 8, 1, 0, 0, 0, 0, time.UTC)
+	at := func(sec int) time.Time { return start.Add(time.Duration(sec) * time.Second) }
+
+	tests := []struct {
+		name   string
+		pushed int
+		late   bool
+		from   time.Time
+		to     time.Time
+		want   []monitor.Gauge
+	}{
+		{
+			name:   "empty",
+			pushed: 0,
+			from:   at(0),
+			to:     at(10),
+			want:   nil,
+		},
+		{
+			name:   "not full",
+			pushed: 2,
+			from:   at(0),
+			to:     at(10),
+			want:   []monitor.Gauge{0, 1},
+		},
+		{
+			name:   "wrapped around",
+			pushed: 5,
+			from:   at(0),
+			to:     at(10),
+			want:   []monitor.Gauge{2, 3, 4},
+		},
+		{
+			name:   "narrow range",
+			pushed: 5,
+			from:   at(3),
+			to:     at(3),
+			want:   []monitor.Gauge{3},
+		},
+		{
+			name:   "out of order",
+			pushed: 2,
+			late:   true,
+			from:   at(-10),
+			to:     at(10),
+			want:   []monitor.Gauge{-1, 0, 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newRing[monitor.Gauge](3)
+			for i := 0; i < tt.pushed; i++ {
+				r.push(at(i), monitor.Gauge(i))
+			}
+			if tt.late {
+				r.push(at(-1), -1)
+			}
+
+			var got []monitor.Gauge
+			for _, p := range r.between(tt.from, tt.to) {
+				got = append(got, p.value)
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,542 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"html/template"
+	"io"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	monitor "github.com/a-tho/monitor/internal"
+)
+
+// MemStorage keeps metrics in memory.
+type MemStorage struct {
+	DataGauge     map[string]monitor.Gauge
+	DataCounter   map[string]monitor.Counter
+	DataHistogram map[string]*monitor.Histogram
+	DataSummary   map[string]*monitor.Summary
+	UpdatedGauge  map[string]time.Time // when each gauge was last set
+	m             sync.Mutex
+
+	// Recent values of each metric
+	historySize    int
+	historyGauge   map[string]*ring[monitor.Gauge]
+	historyCounter map[string]*ring[monitor.Counter]
+
+	// Idempotency keys of the batches being applied and recently applied,
+	// the latter being kept in snapshots
+	BatchKeys *batchKeys
+}
+
+// NewMemStorage returns an empty in-memory storage that keeps up to
+// historySize recent values of each metric, DefaultHistorySize if
+// historySize is not positive.
+func NewMemStorage(historySize int) *MemStorage {
+	if historySize <= 0 {
+		historySize = DefaultHistorySize
+	}
+	return &MemStorage{
+		DataGauge:      make(map[string]monitor.Gauge),
+		DataCounter:    make(map[string]monitor.Counter),
+		DataHistogram:  make(map[string]*monitor.Histogram),
+		DataSummary:    make(map[string]*monitor.Summary),
+		UpdatedGauge:   make(map[string]time.Time),
+		historySize:    historySize,
+		historyGauge:   make(map[string]*ring[monitor.Gauge]),
+		historyCounter: make(map[string]*ring[monitor.Counter]),
+		BatchKeys:      newBatchKeys(),
+	}
+}
+
+func newMemStorage(_ context.Context, _ *url.URL, opts Options) (monitor.MetricRepo, error) {
+	log.Info().Msg("Initialized memory storage successfully")
+
+	return NewMemStorage(opts.HistorySize), nil
+}
+
+// SetGauge inserts or updates a gauge metric value v for the key k.
+func (s *MemStorage) SetGauge(_ context.Context, k string, v monitor.Gauge) (monitor.MetricRepo, error) {
+	s.m.Lock()
+	now := time.Now()
+	s.setGauge(now, now, k, v)
+	s.m.Unlock()
+
+	return s, nil
+}
+
+// SetGaugeBatch inserts or updates a gauge metrics batch.
+func (s *MemStorage) SetGaugeBatch(_ context.Context, batch []*monitor.Metrics) (monitor.MetricRepo, error) {
+	now := time.Now()
+	s.m.Lock()
+	for _, metric := range batch {
+		s.setGauge(now, metric.SampledAt(now), metric.Key(), monitor.Gauge(*metric.Value)) // won't be nil, checked for it earlier
+	}
+	s.m.Unlock()
+
+	return s, nil
+}
+
+// AddCounter adds a counter metric value v for the key k.
+func (s *MemStorage) AddCounter(_ context.Context, k string, v monitor.Counter) (monitor.MetricRepo, error) {
+	s.m.Lock()
+	s.addCounter(time.Now(), k, v)
+	s.m.Unlock()
+
+	return s, nil
+}
+
+// AddCounterBatch adds a counter metrics batch.
+func (s *MemStorage) AddCounterBatch(_ context.Context, batch []*monitor.Metrics) (monitor.MetricRepo, error) {
+	now := time.Now()
+	s.m.Lock()
+	for _, metric := range batch {
+		s.addCounter(metric.SampledAt(now), metric.Key(), monitor.Counter(*metric.Delta)) // won't be nil, checked for it in the caller function
+	}
+	s.m.Unlock()
+
+	return s, nil
+}
+
+// setGauge sets the gauge as updated at t and records its value as measured
+// at sampled, s.m must be held.
+func (s *MemStorage) setGauge(t, sampled time.Time, k string, v monitor.Gauge) {
+	s.DataGauge[k] = v
+	s.UpdatedGauge[k] = t
+
+	history, ok := s.historyGauge[k]
+	if !ok {
+		history = newRing[monitor.Gauge](s.historySize)
+		s.historyGauge[k] = history
+	}
+	history.push(sampled, v)
+}
+
+// addCounter adds to the counter and records its new value as measured at t,
+// s.m must be held.
+func (s *MemStorage) addCounter(t time.Time, k string, v monitor.Counter) {
+	s.DataCounter[k] += v
+
+	history, ok := s.historyCounter[k]
+	if !ok {
+		history = newRing[monitor.Counter](s.historySize)
+		s.historyCounter[k] = history
+	}
+	history.push(t, s.DataCounter[k])
+}
+
+// GetGauge retrieves the gauge value for the key k.
+func (s *MemStorage) GetGauge(_ context.Context, k string) (v monitor.Gauge, ok bool) {
+	s.m.Lock()
+	v, ok = s.DataGauge[k]
+	s.m.Unlock()
+
+	return
+}
+
+// GetCounter retrieves the counter value for the key k.
+func (s *MemStorage) GetCounter(_ context.Context, k string) (v monitor.Counter, ok bool) {
+	s.m.Lock()
+	v, ok = s.DataCounter[k]
+	s.m.Unlock()
+
+	return
+}
+
+// StringGauge produces a JSON representation of gauge metrics kept in the
+// storage
+func (s *MemStorage) StringGauge(_ context.Context) (string, error) {
+	s.m.Lock()
+	out, err := json.Marshal(s.DataGauge)
+	s.m.Unlock()
+
+	return string(out), err
+}
+
+// StringCounter produces a JSON representation of counter metrics kept in the
+// storage
+func (s *MemStorage) StringCounter(_ context.Context) (string, error) {
+	s.m.Lock()
+	out, err := json.Marshal(s.DataCounter)
+	s.m.Unlock()
+
+	return string(out), err
+}
+
+// WriteAllGauge writes gauge metrics satisfying the matchers as HTML into
+// specified writer.
+func (s *MemStorage) WriteAllGauge(_ context.Context, wr io.Writer, matchers ...monitor.LabelMatcher) error {
+	tmpl, err := template.New("metrics").Parse(metricsTemplate)
+	if err != nil {
+		return err
+	}
+
+	s.m.Lock()
+	err = tmpl.Execute(wr, filter(s.DataGauge, matchers))
+	s.m.Unlock()
+
+	return err
+}
+
+// WriteAllCounter writes counter metrics satisfying the matchers as HTML into
+// specified writer.
+func (s *MemStorage) WriteAllCounter(_ context.Context, wr io.Writer, matchers ...monitor.LabelMatcher) error {
+	tmpl, err := template.New("metrics").Parse(metricsTemplate)
+	if err != nil {
+		return err
+	}
+
+	s.m.Lock()
+	err = tmpl.Execute(wr, filter(s.DataCounter, matchers))
+	s.m.Unlock()
+
+	return err
+}
+
+// AddHistogram merges the histogram v into the histogram for the key k.
+func (s *MemStorage) AddHistogram(_ context.Context, k string, v monitor.Histogram) (monitor.MetricRepo, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	return s, s.addHistogram(k, v)
+}
+
+// GetHistogram retrieves the histogram for the key k.
+func (s *MemStorage) GetHistogram(_ context.Context, k string) (v monitor.Histogram, ok bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	h, ok := s.DataHistogram[k]
+	if !ok {
+		return v, false
+	}
+	v = *h
+	v.Buckets = append([]float64(nil), h.Buckets...)
+	v.Counts = append([]uint64(nil), h.Counts...)
+	return v, true
+}
+
+// AddSummary adds the observations of v to the summary for the key k.
+func (s *MemStorage) AddSummary(_ context.Context, k string, v monitor.Summary) (monitor.MetricRepo, error) {
+	s.m.Lock()
+	s.addSummary(k, v)
+	s.m.Unlock()
+
+	return s, nil
+}
+
+// GetSummary retrieves the summary for the key k, with the observations kept
+// to compute quantiles.
+func (s *MemStorage) GetSummary(_ context.Context, k string) (v monitor.Summary, ok bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	sum, ok := s.DataSummary[k]
+	if !ok {
+		return v, false
+	}
+	v = *sum
+	v.Observations = append([]float64(nil), sum.Observations...)
+	return v, true
+}
+
+// addHistogram merges v into the histogram for k unless their buckets
+// differ, s.m must be held.
+func (s *MemStorage) addHistogram(k string, v monitor.Histogram) error {
+	h, ok := s.DataHistogram[k]
+	if !ok {
+		h = &monitor.Histogram{}
+	}
+	if err := h.Merge(v); err != nil {
+		return err
+	}
+	s.DataHistogram[k] = h
+	return nil
+}
+
+// ApplyBatch applies a batch of metrics of any type at once, or none of them
+// if a histogram cannot be merged.
+func (s *MemStorage) ApplyBatch(_ context.Context, batch []*monitor.Metrics) (monitor.MetricRepo, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if err := s.checkBatch(batch); err != nil {
+		return s, err
+	}
+	s.applyBatch(time.Now(), batch, nil)
+	return s, nil
+}
+
+// checkBatch tells whether all histograms of the batch can be merged, s.m
+// must be held.
+func (s *MemStorage) checkBatch(batch []*monitor.Metrics) error {
+	probes := make(map[string]*monitor.Histogram)
+	for _, metric := range batch {
+		if metric.MType != typeHistogram {
+			continue
+		}
+
+		k := metric.Key()
+		probe, ok := probes[k]
+		if !ok {
+			probe = &monitor.Histogram{}
+			if h, ok := s.DataHistogram[k]; ok {
+				probe.Buckets, probe.Counts = h.Buckets, make([]uint64, len(h.Counts))
+			}
+			probes[k] = probe
+		}
+		if err := probe.Merge(*metric.Histogram); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyBatch applies the metrics as updated at t, s.m must be held.
+// Histograms that cannot be merged are skipped, see checkBatch. The changes,
+// if not nil, receive how every metric changed its series.
+func (s *MemStorage) applyBatch(t time.Time, batch []*monitor.Metrics, changes []monitor.Change) {
+	for i, metric := range batch {
+		if changes != nil {
+			changes[i].Old = s.value(metric.MType, metric.Key())
+		}
+
+		switch metric.MType {
+		case typeGauge:
+			v := monitor.Gauge(*metric.Value)
+			if metric.Shift {
+				v += s.DataGauge[metric.Key()]
+			}
+			s.setGauge(t, metric.SampledAt(t), metric.Key(), v)
+		case typeCounter:
+			s.addCounter(metric.SampledAt(t), metric.Key(), monitor.Counter(*metric.Delta))
+		case typeHistogram:
+			if err := s.addHistogram(metric.Key(), *metric.Histogram); err != nil {
+				log.Err(err).Str("id", metric.Key()).Msg("Skipped histogram update")
+			}
+		case typeSummary:
+			s.addSummary(metric.Key(), *metric.Summary)
+		}
+
+		if changes != nil {
+			changes[i].New = s.value(metric.MType, metric.Key())
+		}
+	}
+}
+
+// value returns a copy of the stored value of the series k of the metric
+// type mtype, nil if there is none, s.m must be held.
+func (s *MemStorage) value(mtype, k string) *monitor.AuditValue {
+	switch mtype {
+	case typeGauge:
+		if v, ok := s.DataGauge[k]; ok {
+			value := float64(v)
+			return &monitor.AuditValue{Value: &value}
+		}
+	case typeCounter:
+		if v, ok := s.DataCounter[k]; ok {
+			delta := int64(v)
+			return &monitor.AuditValue{Delta: &delta}
+		}
+	case typeHistogram:
+		if h, ok := s.DataHistogram[k]; ok {
+			v := *h
+			v.Buckets = append([]float64(nil), h.Buckets...)
+			v.Counts = append([]uint64(nil), h.Counts...)
+			return &monitor.AuditValue{Histogram: &v}
+		}
+	case typeSummary:
+		if sum, ok := s.DataSummary[k]; ok {
+			v := *sum
+			v.Observations = append([]float64(nil), sum.Observations...)
+			v.Quantiles = append([]monitor.Quantile(nil), sum.Quantiles...)
+			return &monitor.AuditValue{Summary: &v}
+		}
+	}
+	return nil
+}
+
+// addSummary adds the observations of v to the summary for k, s.m must be
+// held.
+func (s *MemStorage) addSummary(k string, v monitor.Summary) {
+	sum, ok := s.DataSummary[k]
+	if !ok {
+		sum = &monitor.Summary{}
+		s.DataSummary[k] = sum
+	}
+	sum.Merge(v, monitor.SummaryWindow)
+}
+
+// Delete removes the series k of the metric type mtype.
+func (s *MemStorage) Delete(_ context.Context, mtype, k string) (monitor.MetricRepo, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if !s.deleteSeries(mtype, k) {
+		return s, monitor.ErrNotFound
+	}
+	return s, nil
+}
+
+// DeleteBatch removes the series of the metrics batch, skipping missing ones.
+func (s *MemStorage) DeleteBatch(_ context.Context, batch []*monitor.Metrics) (monitor.MetricRepo, error) {
+	s.m.Lock()
+	for _, metric := range batch {
+		s.deleteSeries(metric.MType, metric.Key())
+	}
+	s.m.Unlock()
+
+	return s, nil
+}
+
+// ExpireGauges removes the gauges last updated before the given time.
+func (s *MemStorage) ExpireGauges(_ context.Context, before time.Time) (int, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	expired := s.expiredGauges(before)
+	for _, k := range expired {
+		s.deleteSeries(typeGauge, k)
+	}
+	return len(expired), nil
+}
+
+// deleteSeries removes the series k of the metric type mtype and reports
+// whether it existed, s.m must be held.
+func (s *MemStorage) deleteSeries(mtype, k string) bool {
+	var ok bool
+	switch mtype {
+	case typeGauge:
+		_, ok = s.DataGauge[k]
+		delete(s.DataGauge, k)
+		delete(s.UpdatedGauge, k)
+		delete(s.historyGauge, k)
+	case typeCounter:
+		_, ok = s.DataCounter[k]
+		delete(s.DataCounter, k)
+		delete(s.historyCounter, k)
+	case typeHistogram:
+		_, ok = s.DataHistogram[k]
+		delete(s.DataHistogram, k)
+	case typeSummary:
+		_, ok = s.DataSummary[k]
+		delete(s.DataSummary, k)
+	}
+	return ok
+}
+
+// expiredGauges returns the keys of the gauges last updated before the given
+// time, s.m must be held.
+func (s *MemStorage) expiredGauges(before time.Time) []string {
+	var expired []string
+	for k, updated := range s.UpdatedGauge {
+		if updated.Before(before) {
+			expired = append(expired, k)
+		}
+	}
+	return expired
+}
+
+// ClaimBatch claims the idempotency key of a batch about to be applied and
+// tells its state.
+func (s *MemStorage) ClaimBatch(_ context.Context, key string) (monitor.BatchState, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	return s.BatchKeys.claim(time.Now(), key), nil
+}
+
+// CommitBatch applies a batch like ApplyBatch and marks its idempotency key
+// applied at the same time.
+func (s *MemStorage) CommitBatch(_ context.Context, key string, batch []*monitor.Metrics) ([]monitor.Change, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if err := s.checkBatch(batch); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	changes := make([]monitor.Change, len(batch))
+	s.applyBatch(now, batch, changes)
+	if key != "" {
+		s.BatchKeys.commit(now, key)
+	}
+	return changes, nil
+}
+
+// ReleaseBatch gives the claim of the idempotency key of a batch that failed
+// to apply up.
+func (s *MemStorage) ReleaseBatch(_ context.Context, key string) error {
+	s.m.Lock()
+	s.BatchKeys.release(key)
+	s.m.Unlock()
+
+	return nil
+}
+
+// Query iterates over the gauges and counters selected by the query.
+func (s *MemStorage) Query(_ context.Context, q monitor.Query) (monitor.MetricIterator, error) {
+	s.m.Lock()
+	metrics, err := querySeries(q, s.DataGauge, s.DataCounter)
+	s.m.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	return &sliceIterator{metrics: metrics}, nil
+}
+
+// GaugeHistory retrieves the values of the gauge k recorded within [from, to]
+// in chronological order.
+func (s *MemStorage) GaugeHistory(_ context.Context, k string, from, to time.Time) ([]monitor.Sample, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	history, ok := s.historyGauge[k]
+	if !ok {
+		return nil, nil
+	}
+
+	points := history.between(from, to)
+	samples := make([]monitor.Sample, len(points))
+	for i, p := range points {
+		value := float64(p.value)
+		samples[i] = monitor.Sample{Time: p.time, Value: &value}
+	}
+	return samples, nil
+}
+
+// CounterHistory retrieves the values of the counter k recorded within
+// [from, to] in chronological order.
+func (s *MemStorage) CounterHistory(_ context.Context, k string, from, to time.Time) ([]monitor.Sample, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	history, ok := s.historyCounter[k]
+	if !ok {
+		return nil, nil
+	}
+
+	points := history.between(from, to)
+	samples := make([]monitor.Sample, len(points))
+	for i, p := range points {
+		delta := int64(p.value)
+		samples[i] = monitor.Sample{Time: p.time, Delta: &delta}
+	}
+	return samples, nil
+}
+
+// PingContext reports whether the storage is available, which memory always
+// is.
+func (s *MemStorage) PingContext(_ context.Context) error {
+	return nil
+}
+
+// Close does nothing as there is nothing to release.
+func (s *MemStorage) Close() error {
+	return nil
+}
@@ -0,0 +1,151 @@
+package storage
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/zerolog/log"
+
+	"github.com/a-tho/monitor/pkg/retry"
+)
+
+// Migrations are applied in the order of their versions, the version being
+// the number before the first underscore in the file name, e.g.
+// 0002_create_samples.sql. Applied migrations must never be edited, add a new
+// one instead. The first migrations tolerate the tables created before
+// migrations were introduced.
+//
+//go:embed migrations/*.sql
+var migrationsFS embed.FS
+
+type migration struct {
+	version int
+	name    string
+	query   string
+}
+
+// Migrate brings the schema of the Postgres database at dsn up to date.
+func Migrate(ctx context.Context, dsn string) error {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return fmt.Errorf("storage address: %w", err)
+	}
+	if u.Scheme != SchemePostgres && u.Scheme != SchemePostgreSQL {
+		return fmt.Errorf("migrations apply to Postgres storage only, got scheme %q", u.Scheme)
+	}
+
+	return retry.Do(ctx, func(context.Context) error {
+		db, err := sqlx.Open("pgx", dsn)
+		if err != nil {
+			return retry.RetriableError(err)
+		}
+		defer db.Close()
+
+		return retryIfPgConnException(migrate(ctx, db))
+	})
+}
+
+// migrate applies the migrations that have not been applied to db yet.
+func migrate(ctx context.Context, db *sqlx.DB) error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+
+	_, err = db.ExecContext(ctx, `
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		"version" INTEGER PRIMARY KEY,
+		"name" TEXT NOT NULL,
+		"applied_at" TIMESTAMPTZ NOT NULL DEFAULT now()
+	);`)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		applied, err := applyMigration(ctx, db, m)
+		if err != nil {
+			return fmt.Errorf("migration %s: %w", m.name, err)
+		}
+		if applied {
+			log.Info().Str("migration", m.name).Msg("Applied migration")
+		}
+	}
+
+	return nil
+}
+
+// applyMigration applies m unless it has already been applied. The table lock
+// keeps concurrently starting servers from applying m twice.
+func applyMigration(ctx context.Context, db *sqlx.DB, m migration) (bool, error) {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.ExecContext(ctx, `LOCK TABLE schema_migrations IN EXCLUSIVE MODE`); err != nil {
+		return false, err
+	}
+
+	var applied bool
+	err = tx.QueryRowContext(ctx,
+		`SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = $1)`, m.version,
+	).Scan(&applied)
+	if err != nil || applied {
+		return false, err
+	}
+
+	if _, err = tx.ExecContext(ctx, m.query); err != nil {
+		return false, err
+	}
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`, m.version, m.name,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+func loadMigrations() ([]migration, error) {
+	files, err := fs.Glob(migrationsFS, "migrations/*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	migrations := make([]migration, 0, len(files))
+	for _, file := range files {
+		name := strings.TrimSuffix(path.Base(file), ".sql")
+		versionStr, _, _ := strings.Cut(name, "_")
+		version, err := strconv.Atoi(versionStr)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s: invalid version", name)
+		}
+
+		query, err := migrationsFS.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		migrations = append(migrations, migration{version: version, name: name, query: string(query)})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].version < migrations[j].version })
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].version == migrations[i-1].version {
+			return nil, fmt.Errorf("migrations %s and %s share a version", migrations[i-1].name, migrations[i].name)
+		}
+	}
+
+	return migrations, nil
+}
@@ -0,0 +1,25 @@
+package storage
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	migrations, err := loadMigrations()
+	require.NoError(t, err)
+	require.NotEmpty(t, migrations)
+
+	for i, m := range migrations {
+		assert.Equal(t, i+1, m.version, "migration versions must be consecutive")
+		assert.NotEmpty(t, m.query, m.name)
+	}
+}
+
+func TestMigrateNonPostgres(t *testing.T) {
+	err := Migrate(context.Background(), "file:///tmp/metrics-db.json")
+	assert.Error(t, err)
+}
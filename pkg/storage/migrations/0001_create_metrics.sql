@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS gauge (
+	"name" VARCHAR(50) PRIMARY KEY,
+	"value" DOUBLE PRECISION
+);
+
+CREATE TABLE IF NOT EXISTS counter (
+	"name" VARCHAR(50) PRIMARY KEY,
+	"value" NUMERIC
+);
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS samples (
+	"mtype" VARCHAR(10) NOT NULL,
+	"name" VARCHAR(50) NOT NULL,
+	"ts" TIMESTAMPTZ NOT NULL,
+	"value" DOUBLE PRECISION,
+	"delta" NUMERIC
+);
+
+CREATE INDEX IF NOT EXISTS samples_mtype_name_ts_idx ON samples (mtype, name, ts);
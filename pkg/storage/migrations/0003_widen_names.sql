@@ -0,0 +1,3 @@
+ALTER TABLE gauge ALTER COLUMN "name" TYPE TEXT;
+ALTER TABLE counter ALTER COLUMN "name" TYPE TEXT;
+ALTER TABLE samples ALTER COLUMN "name" TYPE TEXT;
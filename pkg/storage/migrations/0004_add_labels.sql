@@ -0,0 +1,11 @@
+ALTER TABLE gauge ADD COLUMN IF NOT EXISTS "labels" TEXT NOT NULL DEFAULT '';
+ALTER TABLE gauge DROP CONSTRAINT IF EXISTS gauge_pkey;
+ALTER TABLE gauge ADD PRIMARY KEY ("name", "labels");
+
+ALTER TABLE counter ADD COLUMN IF NOT EXISTS "labels" TEXT NOT NULL DEFAULT '';
+ALTER TABLE counter DROP CONSTRAINT IF EXISTS counter_pkey;
+ALTER TABLE counter ADD PRIMARY KEY ("name", "labels");
+
+ALTER TABLE samples ADD COLUMN IF NOT EXISTS "labels" TEXT NOT NULL DEFAULT '';
+DROP INDEX IF EXISTS samples_mtype_name_ts_idx;
+CREATE INDEX IF NOT EXISTS samples_mtype_name_labels_ts_idx ON samples (mtype, name, labels, ts);
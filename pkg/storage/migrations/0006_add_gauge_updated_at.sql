@@ -0,0 +1,3 @@
+ALTER TABLE gauge ADD COLUMN IF NOT EXISTS "updated_at" TIMESTAMPTZ NOT NULL DEFAULT now();
+
+CREATE INDEX IF NOT EXISTS gauge_updated_at_idx ON gauge ("updated_at");
@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS batch_keys (
+	"key" TEXT PRIMARY KEY,
+	"applied_at" TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS batch_keys_applied_at_idx ON batch_keys ("applied_at");
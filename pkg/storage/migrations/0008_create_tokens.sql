@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS tokens (
+	"name" TEXT PRIMARY KEY,
+	"hash" TEXT NOT NULL UNIQUE,
+	"scopes" TEXT NOT NULL,
+	"prefix" TEXT NOT NULL DEFAULT ''
+);
@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS audit (
+	"seq" BIGSERIAL PRIMARY KEY,
+	"ts" TIMESTAMPTZ NOT NULL,
+	"ip" TEXT NOT NULL,
+	"real_ip" TEXT NOT NULL DEFAULT '',
+	"key_id" TEXT NOT NULL DEFAULT '',
+	"token" TEXT NOT NULL DEFAULT '',
+	"name" TEXT NOT NULL,
+	"series" TEXT NOT NULL,
+	"mtype" TEXT NOT NULL,
+	"old" JSONB,
+	"new" JSONB
+);
+
+CREATE INDEX IF NOT EXISTS audit_ts_idx ON audit ("ts");
+CREATE INDEX IF NOT EXISTS audit_name_ts_idx ON audit ("name", "ts");
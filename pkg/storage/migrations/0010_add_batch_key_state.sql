@@ -0,0 +1 @@
+ALTER TABLE batch_keys ADD COLUMN IF NOT EXISTS "pending" BOOLEAN NOT NULL DEFAULT false;
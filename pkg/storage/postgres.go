@@ -0,0 +1,1306 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5/pgconn"
+	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/zerolog/log"
+
+	monitor "github.com/a-tho/monitor/internal"
+	"github.com/a-tho/monitor/pkg/retry"
+)
+
+// DBStorage keeps metrics in a Postgres database.
+type DBStorage struct {
+	db                 *sqlx.DB
+	stmtSetGauge       *sqlx.Stmt
+	stmtAddCounter     *sqlx.Stmt
+	stmtGetGauge       *sqlx.Stmt
+	stmtGetCounter     *sqlx.Stmt
+	stmtStringGauge    *sqlx.Stmt
+	stmtStringCounter  *sqlx.Stmt
+	stmtAllGauge       *sqlx.Stmt
+	stmtAllCounter     *sqlx.Stmt
+	stmtGaugeHistory   *sqlx.Stmt
+	stmtCounterHistory *sqlx.Stmt
+}
+
+func newDBStorage(ctx context.Context, addr *url.URL, _ Options) (monitor.MetricRepo, error) {
+	storage := DBStorage{}
+	dsn := addr.String()
+
+	err := retry.Do(ctx, func(context.Context) error {
+		db, err := sqlx.Open("pgx", dsn)
+		if err != nil {
+			return retry.RetriableError(err)
+		}
+
+		if err = migrate(ctx, db); err != nil {
+			db.Close()
+			return retry.RetriableError(err)
+		}
+
+		// Every update is also recorded as a sample, taken at $4 if known. The
+		// updated value is returned, for counters along with whether the
+		// series is new. Gauges are shifted by the value if $5 is true
+		stmtSetGauge, err := db.Preparex(`
+		WITH updated AS (
+			INSERT INTO gauge (name, labels, value)
+			VALUES
+				($1, $2, $3)
+			ON CONFLICT (name, labels) DO UPDATE
+			SET value = CASE WHEN $5::boolean THEN gauge.value + EXCLUDED.value ELSE EXCLUDED.value END,
+				updated_at = now()
+			RETURNING name, labels, value
+		), sampled AS (
+			INSERT INTO samples (mtype, name, labels, ts, value)
+			SELECT 'gauge', name, labels, COALESCE($4::timestamptz, now()), value FROM updated
+		)
+		SELECT value FROM updated;`)
+		if err != nil {
+			db.Close()
+			return retry.RetriableError(err)
+		}
+
+		stmtAddCounter, err := db.Preparex(`
+		WITH updated AS (
+			INSERT INTO counter (name, labels, value)
+			VALUES
+				($1, $2, $3)
+			ON CONFLICT (name, labels) DO UPDATE
+			SET value = counter.value + EXCLUDED.value
+			RETURNING name, labels, value, xmax = 0 AS inserted
+		), sampled AS (
+			INSERT INTO samples (mtype, name, labels, ts, delta)
+			SELECT 'counter', name, labels, COALESCE($4::timestamptz, now()), value FROM updated
+		)
+		SELECT value, inserted FROM updated;`)
+		if err != nil {
+			db.Close()
+			return retry.RetriableError(err)
+		}
+
+		stmtGetGauge, err := db.Preparex(`
+		SELECT value FROM gauge WHERE name = $1 AND labels = $2`)
+		if err != nil {
+			db.Close()
+			return retry.RetriableError(err)
+		}
+
+		stmtGetCounter, err := db.Preparex(`
+		SELECT value FROM counter WHERE name = $1 AND labels = $2`)
+		if err != nil {
+			db.Close()
+			return retry.RetriableError(err)
+		}
+
+		// Same shape as the JSON produced by the memory storage
+		stmtStringGauge, err := db.Preparex(`
+		SELECT COALESCE(json_object_agg(name || labels, value), '{}') FROM gauge;`)
+		if err != nil {
+			db.Close()
+			return retry.RetriableError(err)
+		}
+
+		stmtStringCounter, err := db.Preparex(`
+		SELECT COALESCE(json_object_agg(name || labels, value), '{}') FROM counter;`)
+		if err != nil {
+			db.Close()
+			return retry.RetriableError(err)
+		}
+
+		stmtAllGauge, err := db.Preparex(`
+		SELECT name || labels, value FROM gauge`)
+		if err != nil {
+			db.Close()
+			return retry.RetriableError(err)
+		}
+
+		stmtAllCounter, err := db.Preparex(`
+		SELECT name || labels, value FROM counter`)
+		if err != nil {
+			db.Close()
+			return retry.RetriableError(err)
+		}
+
+		stmtGaugeHistory, err := db.Preparex(`
+		SELECT ts, value FROM samples
+		WHERE mtype = 'gauge' AND name = $1 AND labels = $2 AND ts BETWEEN $3 AND $4
+		ORDER BY ts`)
+		if err != nil {
+			db.Close()
+			return retry.RetriableError(err)
+		}
+
+		stmtCounterHistory, err := db.Preparex(`
+		SELECT ts, delta FROM samples
+		WHERE mtype = 'counter' AND name = $1 AND labels = $2 AND ts BETWEEN $3 AND $4
+		ORDER BY ts`)
+		if err != nil {
+			db.Close()
+			return retry.RetriableError(err)
+		}
+
+		storage.db = db
+		storage.stmtSetGauge = stmtSetGauge
+		storage.stmtAddCounter = stmtAddCounter
+		storage.stmtGetGauge = stmtGetGauge
+		storage.stmtGetCounter = stmtGetCounter
+		storage.stmtStringGauge = stmtStringGauge
+		storage.stmtStringCounter = stmtStringCounter
+		storage.stmtAllGauge = stmtAllGauge
+		storage.stmtAllCounter = stmtAllCounter
+		storage.stmtGaugeHistory = stmtGaugeHistory
+		storage.stmtCounterHistory = stmtCounterHistory
+
+		return nil
+	})
+	if err != nil {
+		log.Info().Msg("Failed to init DB storage")
+
+		return nil, err
+	}
+
+	log.Info().Msg("Initialized DB storage successfully")
+
+	return &storage, nil
+}
+
+// SetGauge inserts or updates a gauge metric value v for the key k.
+func (s *DBStorage) SetGauge(ctx context.Context, k string, v monitor.Gauge) (monitor.MetricRepo, error) {
+	err := retry.Do(ctx, func(context.Context) error {
+		name, labels := splitSeriesKey(k)
+		_, err := s.stmtSetGauge.ExecContext(ctx, name, labels, v, nil, false)
+		return retryIfPgConnException(err)
+	})
+
+	return s, err
+}
+
+// SetGaugeBatch inserts or updates a gauge metrics batch.
+func (s *DBStorage) SetGaugeBatch(ctx context.Context, batch []*monitor.Metrics) (monitor.MetricRepo, error) {
+	err := retry.Do(ctx, func(context.Context) error {
+		tx, err := s.db.BeginTxx(ctx, nil)
+		if err != nil {
+			return retryIfPgConnException(err)
+		}
+		defer tx.Rollback()
+
+		stmt := tx.StmtxContext(ctx, s.stmtSetGauge)
+		defer stmt.Close()
+
+		for _, metric := range batch {
+			name, labels := splitSeriesKey(metric.Key())
+			_, err = stmt.ExecContext(ctx, name, labels, metric.Value, metric.Time, false)
+			if err != nil {
+				return retryIfPgConnException(err)
+			}
+		}
+		err = tx.Commit()
+		return retryIfPgConnException(err)
+	})
+
+	return s, err
+}
+
+// AddCounter adds a counter metric value v for the key k.
+func (s *DBStorage) AddCounter(ctx context.Context, k string, v monitor.Counter) (monitor.MetricRepo, error) {
+	err := retry.Do(ctx, func(context.Context) error {
+		name, labels := splitSeriesKey(k)
+		_, err := s.stmtAddCounter.ExecContext(ctx, name, labels, v, nil)
+		return retryIfPgConnException(err)
+	})
+
+	return s, err
+}
+
+// AddCounterBatch adds a counter metrics batch.
+func (s *DBStorage) AddCounterBatch(ctx context.Context, batch []*monitor.Metrics) (monitor.MetricRepo, error) {
+	err := retry.Do(ctx, func(context.Context) error {
+		tx, err := s.db.BeginTxx(ctx, nil)
+		if err != nil {
+			return retryIfPgConnException(err)
+		}
+		defer tx.Rollback()
+
+		stmt := tx.StmtxContext(ctx, s.stmtAddCounter)
+		defer stmt.Close()
+
+		for _, metric := range batch {
+			name, labels := splitSeriesKey(metric.Key())
+			_, err = stmt.ExecContext(ctx, name, labels, metric.Delta, metric.Time)
+			if err != nil {
+				return retryIfPgConnException(err)
+			}
+		}
+		err = tx.Commit()
+		return retryIfPgConnException(err)
+	})
+
+	return s, err
+}
+
+// GetGauge retrieves the gauge value for the key k.
+func (s *DBStorage) GetGauge(ctx context.Context, k string) (v monitor.Gauge, ok bool) {
+	err := retry.Do(ctx, func(context.Context) error {
+		name, labels := splitSeriesKey(k)
+		row := s.stmtGetGauge.QueryRowContext(ctx, name, labels)
+		err := row.Scan(&v)
+		return retryIfPgConnException(err)
+	})
+	if err != nil {
+		return v, false
+	}
+	return v, true
+}
+
+// GetCounter retrieves the counter value for the key k.
+func (s *DBStorage) GetCounter(ctx context.Context, k string) (v monitor.Counter, ok bool) {
+	err := retry.Do(ctx, func(context.Context) error {
+		name, labels := splitSeriesKey(k)
+		row := s.stmtGetCounter.QueryRowContext(ctx, name, labels)
+		err := row.Scan(&v)
+		return retryIfPgConnException(err)
+	})
+	if err != nil {
+		return v, false
+	}
+	return v, true
+}
+
+// StringGauge produces a JSON representation of gauge metrics kept in the
+// storage
+func (s *DBStorage) StringGauge(ctx context.Context) (string, error) {
+	var enc string
+	err := retry.Do(ctx, func(context.Context) error {
+		row := s.stmtStringGauge.QueryRowContext(ctx)
+		err := row.Scan(&enc)
+		return retryIfPgConnException(err)
+	})
+
+	return enc, err
+}
+
+// StringCounter produces a JSON representation of counter metrics kept in the
+// storage
+func (s *DBStorage) StringCounter(ctx context.Context) (string, error) {
+	var enc string
+	err := retry.Do(ctx, func(context.Context) error {
+		row := s.stmtStringCounter.QueryRowContext(ctx)
+		err := row.Scan(&enc)
+		return retryIfPgConnException(err)
+	})
+
+	return enc, err
+}
+
+// WriteAllGauge writes gauge metrics satisfying the matchers as HTML into
+// specified writer.
+func (s *DBStorage) WriteAllGauge(ctx context.Context, wr io.Writer, matchers ...monitor.LabelMatcher) error {
+	tmpl, err := template.New("metrics").Parse(metricsTemplate)
+	if err != nil {
+		return err
+	}
+
+	var (
+		key   string
+		value monitor.Gauge
+	)
+	dataGauge := make(map[string]monitor.Gauge)
+
+	err = retry.Do(ctx, func(context.Context) error {
+		rows, err := s.stmtAllGauge.QueryContext(ctx)
+		if err != nil {
+			return retryIfPgConnException(err)
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			if err = rows.Scan(&key, &value); err != nil {
+				// TODO replace with clear(dataGauge) once Go 1.21 is out
+				for key := range dataGauge {
+					delete(dataGauge, key)
+				}
+				return retryIfPgConnException(err)
+			}
+			dataGauge[key] = value
+		}
+		if err = rows.Err(); err != nil {
+			// TODO replace with clear(dataGauge) once Go 1.21 is out
+			for key := range dataGauge {
+				delete(dataGauge, key)
+			}
+			return retryIfPgConnException(err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return tmpl.Execute(wr, filter(dataGauge, matchers))
+}
+
+// WriteAllCounter writes counter metrics satisfying the matchers as HTML into
+// specified writer.
+func (s *DBStorage) WriteAllCounter(ctx context.Context, wr io.Writer, matchers ...monitor.LabelMatcher) error {
+	tmpl, err := template.New("metrics").Parse(metricsTemplate)
+	if err != nil {
+		return err
+	}
+
+	var (
+		key   string
+		value monitor.Counter
+	)
+	dataCounter := make(map[string]monitor.Counter)
+
+	err = retry.Do(ctx, func(context.Context) error {
+		rows, err := s.stmtAllCounter.QueryContext(ctx)
+		if err != nil {
+			return retryIfPgConnException(err)
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			if err = rows.Scan(&key, &value); err != nil {
+				// TODO replace with clear(dataCounter) once Go 1.21 is out
+				for key := range dataCounter {
+					delete(dataCounter, key)
+				}
+				return retryIfPgConnException(err)
+			}
+			dataCounter[key] = value
+		}
+		if err = rows.Err(); err != nil {
+			// TODO replace with clear(dataCounter) once Go 1.21 is out
+			for key := range dataCounter {
+				delete(dataCounter, key)
+			}
+			return retryIfPgConnException(err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return tmpl.Execute(wr, filter(dataCounter, matchers))
+}
+
+// GaugeHistory retrieves the values of the gauge k recorded within [from, to]
+// in chronological order.
+func (s *DBStorage) GaugeHistory(ctx context.Context, k string, from, to time.Time) ([]monitor.Sample, error) {
+	var samples []monitor.Sample
+
+	err := retry.Do(ctx, func(context.Context) error {
+		samples = samples[:0]
+
+		name, labels := splitSeriesKey(k)
+		rows, err := s.stmtGaugeHistory.QueryContext(ctx, name, labels, from, to)
+		if err != nil {
+			return retryIfPgConnException(err)
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var sample monitor.Sample
+			if err = rows.Scan(&sample.Time, &sample.Value); err != nil {
+				return retryIfPgConnException(err)
+			}
+			samples = append(samples, sample)
+		}
+		return retryIfPgConnException(rows.Err())
+	})
+
+	return samples, err
+}
+
+// CounterHistory retrieves the values of the counter k recorded within
+// [from, to] in chronological order.
+func (s *DBStorage) CounterHistory(ctx context.Context, k string, from, to time.Time) ([]monitor.Sample, error) {
+	var samples []monitor.Sample
+
+	err := retry.Do(ctx, func(context.Context) error {
+		samples = samples[:0]
+
+		name, labels := splitSeriesKey(k)
+		rows, err := s.stmtCounterHistory.QueryContext(ctx, name, labels, from, to)
+		if err != nil {
+			return retryIfPgConnException(err)
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var sample monitor.Sample
+			if err = rows.Scan(&sample.Time, &sample.Delta); err != nil {
+				return retryIfPgConnException(err)
+			}
+			samples = append(samples, sample)
+		}
+		return retryIfPgConnException(rows.Err())
+	})
+
+	return samples, err
+}
+
+// AddHistogram merges the histogram v into the histogram for the key k.
+func (s *DBStorage) AddHistogram(ctx context.Context, k string, v monitor.Histogram) (monitor.MetricRepo, error) {
+	err := s.updateJSON(ctx, tableHistogram, k, mergeHistogram(v))
+
+	return s, err
+}
+
+// GetHistogram retrieves the histogram for the key k.
+func (s *DBStorage) GetHistogram(ctx context.Context, k string) (v monitor.Histogram, ok bool) {
+	ok = s.getJSON(ctx, tableHistogram, k, &v)
+	return
+}
+
+// AddSummary adds the observations of v to the summary for the key k.
+func (s *DBStorage) AddSummary(ctx context.Context, k string, v monitor.Summary) (monitor.MetricRepo, error) {
+	err := s.updateJSON(ctx, tableSummary, k, mergeSummary(v))
+
+	return s, err
+}
+
+// GetSummary retrieves the summary for the key k, with the observations kept
+// to compute quantiles.
+func (s *DBStorage) GetSummary(ctx context.Context, k string) (v monitor.Summary, ok bool) {
+	ok = s.getJSON(ctx, tableSummary, k, &v)
+	return
+}
+
+// ApplyBatch applies a batch of metrics of any type in a single transaction.
+func (s *DBStorage) ApplyBatch(ctx context.Context, batch []*monitor.Metrics) (monitor.MetricRepo, error) {
+	return s, s.commitBatch(ctx, "", batch, nil)
+}
+
+// CommitBatch applies a batch like ApplyBatch and marks its idempotency key
+// applied in the same transaction.
+func (s *DBStorage) CommitBatch(ctx context.Context, key string, batch []*monitor.Metrics) ([]monitor.Change, error) {
+	changes := make([]monitor.Change, len(batch))
+	if err := s.commitBatch(ctx, key, batch, changes); err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// commitBatch is CommitBatch, the changes receiving how every metric changed
+// its series if not nil. The rows of the series stay locked in between.
+func (s *DBStorage) commitBatch(ctx context.Context, key string, batch []*monitor.Metrics, changes []monitor.Change) error {
+	return retry.Do(ctx, func(context.Context) error {
+		tx, err := s.db.BeginTxx(ctx, nil)
+		if err != nil {
+			return retryIfPgConnException(err)
+		}
+		defer tx.Rollback()
+
+		stmtSetGauge := tx.StmtxContext(ctx, s.stmtSetGauge)
+		defer stmtSetGauge.Close()
+		stmtAddCounter := tx.StmtxContext(ctx, s.stmtAddCounter)
+		defer stmtAddCounter.Close()
+
+		for i, metric := range batch {
+			var change *monitor.Change
+			if changes != nil {
+				change = &changes[i]
+			}
+
+			name, labels := splitSeriesKey(metric.Key())
+			switch metric.MType {
+			case typeGauge:
+				if err = lockedGauge(ctx, tx, name, labels, change); err != nil {
+					return retryIfPgConnException(err)
+				}
+				var value float64
+				err = stmtSetGauge.QueryRowxContext(ctx, name, labels, metric.Value, metric.Time, metric.Shift).Scan(&value)
+				if err == nil && change != nil {
+					change.New = &monitor.AuditValue{Value: &value}
+				}
+			case typeCounter:
+				// The old value follows from the new one, which the upsert
+				// returns as it stands once the row is locked
+				var (
+					value    int64
+					inserted bool
+				)
+				err = stmtAddCounter.QueryRowxContext(ctx, name, labels, metric.Delta, metric.Time).Scan(&value, &inserted)
+				if err == nil && change != nil {
+					change.Old = nil
+					if !inserted {
+						old := value - *metric.Delta
+						change.Old = &monitor.AuditValue{Delta: &old}
+					}
+					change.New = &monitor.AuditValue{Delta: &value}
+				}
+			case typeHistogram:
+				err = updateJSONTx(ctx, tx, tableHistogram, metric.Key(), changing(mergeHistogram(*metric.Histogram), change,
+					func(h *monitor.Histogram) *monitor.AuditValue { return &monitor.AuditValue{Histogram: h} }))
+			case typeSummary:
+				err = updateJSONTx(ctx, tx, tableSummary, metric.Key(), changing(mergeSummary(*metric.Summary), change,
+					func(sum *monitor.Summary) *monitor.AuditValue { return &monitor.AuditValue{Summary: sum} }))
+			}
+			if err != nil {
+				return retryIfPgConnException(err)
+			}
+		}
+		if key != "" {
+			_, err = tx.ExecContext(ctx, `
+			INSERT INTO batch_keys (key, pending)
+			VALUES
+				($1, false)
+			ON CONFLICT (key) DO UPDATE
+			SET pending = false, applied_at = now()`, key)
+			if err != nil {
+				return retryIfPgConnException(err)
+			}
+		}
+		return retryIfPgConnException(tx.Commit())
+	})
+}
+
+// lockedGauge locks the row of the gauge series and sets its value as the old
+// value of the change, if not nil. A missing row is inserted first, so that a
+// concurrent first update of the series waits for this one instead of taking
+// it as missing too.
+func lockedGauge(ctx context.Context, tx *sqlx.Tx, name, labels string, change *monitor.Change) error {
+	if change == nil {
+		return nil
+	}
+
+	for {
+		var old float64
+		err := tx.QueryRowContext(ctx, `
+		SELECT value FROM gauge WHERE name = $1 AND labels = $2 FOR UPDATE`, name, labels,
+		).Scan(&old)
+		switch {
+		case err == nil:
+			change.Old = &monitor.AuditValue{Value: &old}
+			return nil
+		case !errors.Is(err, sql.ErrNoRows):
+			return err
+		}
+
+		res, err := tx.ExecContext(ctx, `
+		INSERT INTO gauge (name, labels, value)
+		VALUES
+			($1, $2, 0)
+		ON CONFLICT (name, labels) DO NOTHING`, name, labels)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil || n == 1 {
+			change.Old = nil
+			return err
+		}
+		// Another transaction inserted the row meanwhile, lock it instead
+	}
+}
+
+// Delete removes the series k of the metric type mtype.
+func (s *DBStorage) Delete(ctx context.Context, mtype, k string) (monitor.MetricRepo, error) {
+	var deleted bool
+	err := retry.Do(ctx, func(context.Context) error {
+		tx, err := s.db.BeginTxx(ctx, nil)
+		if err != nil {
+			return retryIfPgConnException(err)
+		}
+		defer tx.Rollback()
+
+		if deleted, err = deleteSeries(ctx, tx, mtype, k); err != nil {
+			return retryIfPgConnException(err)
+		}
+		return retryIfPgConnException(tx.Commit())
+	})
+	if err == nil && !deleted {
+		err = monitor.ErrNotFound
+	}
+
+	return s, err
+}
+
+// DeleteBatch removes the series of the metrics batch, skipping missing ones.
+func (s *DBStorage) DeleteBatch(ctx context.Context, batch []*monitor.Metrics) (monitor.MetricRepo, error) {
+	err := retry.Do(ctx, func(context.Context) error {
+		tx, err := s.db.BeginTxx(ctx, nil)
+		if err != nil {
+			return retryIfPgConnException(err)
+		}
+		defer tx.Rollback()
+
+		for _, metric := range batch {
+			if _, err = deleteSeries(ctx, tx, metric.MType, metric.Key()); err != nil {
+				return retryIfPgConnException(err)
+			}
+		}
+		return retryIfPgConnException(tx.Commit())
+	})
+
+	return s, err
+}
+
+// ExpireGauges removes the gauges last updated before the given time.
+func (s *DBStorage) ExpireGauges(ctx context.Context, before time.Time) (int, error) {
+	var expired int64
+	err := retry.Do(ctx, func(context.Context) error {
+		tx, err := s.db.BeginTxx(ctx, nil)
+		if err != nil {
+			return retryIfPgConnException(err)
+		}
+		defer tx.Rollback()
+
+		_, err = tx.ExecContext(ctx, `
+		DELETE FROM samples USING gauge
+		WHERE samples.mtype = 'gauge' AND samples.name = gauge.name
+			AND samples.labels = gauge.labels AND gauge.updated_at < $1`, before)
+		if err != nil {
+			return retryIfPgConnException(err)
+		}
+
+		res, err := tx.ExecContext(ctx, `
+		DELETE FROM gauge WHERE updated_at < $1`, before)
+		if err != nil {
+			return retryIfPgConnException(err)
+		}
+		if expired, err = res.RowsAffected(); err != nil {
+			return err
+		}
+		return retryIfPgConnException(tx.Commit())
+	})
+
+	return int(expired), err
+}
+
+// deleteSeries removes the series k of the metric type mtype, whose table is
+// named after the type, and its samples. It reports whether the series
+// existed.
+func deleteSeries(ctx context.Context, tx *sqlx.Tx, mtype, k string) (bool, error) {
+	switch mtype {
+	case typeGauge, typeCounter, typeHistogram, typeSummary:
+	default:
+		return false, nil
+	}
+	name, labels := splitSeriesKey(k)
+
+	res, err := tx.ExecContext(ctx, `
+	DELETE FROM `+mtype+` WHERE name = $1 AND labels = $2`, name, labels)
+	if err != nil {
+		return false, err
+	}
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+	DELETE FROM samples WHERE mtype = $1 AND name = $2 AND labels = $3`, mtype, name, labels)
+	return deleted > 0, err
+}
+
+// ClaimBatch claims the idempotency key of a batch about to be applied and
+// tells its state. Applied keys older than batchKeyTTL and claims older than
+// batchClaimLease are pruned on the way.
+func (s *DBStorage) ClaimBatch(ctx context.Context, key string) (monitor.BatchState, error) {
+	var state monitor.BatchState
+	err := retry.Do(ctx, func(context.Context) error {
+		_, err := s.db.ExecContext(ctx, `
+		DELETE FROM batch_keys
+		WHERE (NOT pending AND applied_at < now() - make_interval(secs => $1))
+			OR (pending AND applied_at < now() - make_interval(secs => $2))`,
+			batchKeyTTL.Seconds(), batchClaimLease.Seconds())
+		if err != nil {
+			return retryIfPgConnException(err)
+		}
+
+		res, err := s.db.ExecContext(ctx, `
+		INSERT INTO batch_keys (key, pending)
+		VALUES
+			($1, true)
+		ON CONFLICT (key) DO NOTHING`, key)
+		if err != nil {
+			return retryIfPgConnException(err)
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			state = monitor.BatchNew
+			return nil
+		}
+
+		var pending bool
+		err = s.db.QueryRowContext(ctx, `
+		SELECT pending FROM batch_keys WHERE key = $1`, key).Scan(&pending)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			// Released or committed and pruned meanwhile, the client retries
+			state = monitor.BatchPending
+		case err != nil:
+			return retryIfPgConnException(err)
+		case pending:
+			state = monitor.BatchPending
+		default:
+			state = monitor.BatchApplied
+		}
+		return nil
+	})
+
+	return state, err
+}
+
+// ReleaseBatch gives the claim of the idempotency key of a batch that failed
+// to apply up.
+func (s *DBStorage) ReleaseBatch(ctx context.Context, key string) error {
+	return retry.Do(ctx, func(context.Context) error {
+		_, err := s.db.ExecContext(ctx, `
+		DELETE FROM batch_keys WHERE key = $1 AND pending`, key)
+		return retryIfPgConnException(err)
+	})
+}
+
+// LookupToken returns the token of the secret from the tokens table, which
+// holds the hash of the secret (see monitor.HashToken) along with the
+// comma-separated scopes of the token.
+func (s *DBStorage) LookupToken(ctx context.Context, secret string) (monitor.Token, error) {
+	var row struct {
+		Name   string `db:"name"`
+		Scopes string `db:"scopes"`
+		Prefix string `db:"prefix"`
+	}
+	err := retry.Do(ctx, func(context.Context) error {
+		err := s.db.GetContext(ctx, &row, `
+		SELECT name, scopes, prefix FROM tokens WHERE hash = $1`, monitor.HashToken(secret))
+		return retryIfPgConnException(err)
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return monitor.Token{}, monitor.ErrUnknownToken
+	}
+	if err != nil {
+		return monitor.Token{}, err
+	}
+
+	scopes, err := monitor.ParseScopes(row.Scopes)
+	if err != nil {
+		return monitor.Token{}, fmt.Errorf("token %s: %w", row.Name, err)
+	}
+	return monitor.Token{Name: row.Name, Scopes: scopes, Prefix: row.Prefix}, nil
+}
+
+// Audit inserts the audit records into the audit table in a single
+// transaction.
+func (s *DBStorage) Audit(ctx context.Context, records ...monitor.AuditRecord) error {
+	return retry.Do(ctx, func(context.Context) error {
+		tx, err := s.db.BeginTxx(ctx, nil)
+		if err != nil {
+			return retryIfPgConnException(err)
+		}
+		defer tx.Rollback()
+
+		for _, record := range records {
+			name, _ := splitSeriesKey(record.ID)
+			oldValue, err := auditJSON(record.Old)
+			if err != nil {
+				return err
+			}
+			newValue, err := auditJSON(record.New)
+			if err != nil {
+				return err
+			}
+			_, err = tx.ExecContext(ctx, `
+			INSERT INTO audit (ts, ip, real_ip, key_id, token, name, series, mtype, old, new)
+			VALUES
+				($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+				record.Time, record.IP, record.RealIP, record.KeyID, record.Token,
+				name, record.ID, record.MType, oldValue, newValue)
+			if err != nil {
+				return retryIfPgConnException(err)
+			}
+		}
+		return retryIfPgConnException(tx.Commit())
+	})
+}
+
+// AuditTrail returns the audit records selected by the query, oldest first.
+func (s *DBStorage) AuditTrail(ctx context.Context, q monitor.AuditQuery) ([]monitor.AuditRecord, error) {
+	var to, limit any
+	if !q.To.IsZero() {
+		to = q.To
+	}
+	if q.Limit > 0 {
+		limit = q.Limit
+	}
+
+	var rows []struct {
+		Time   time.Time      `db:"ts"`
+		IP     string         `db:"ip"`
+		RealIP string         `db:"real_ip"`
+		KeyID  string         `db:"key_id"`
+		Token  string         `db:"token"`
+		Series string         `db:"series"`
+		MType  string         `db:"mtype"`
+		Old    sql.NullString `db:"old"`
+		New    sql.NullString `db:"new"`
+	}
+	err := retry.Do(ctx, func(context.Context) error {
+		rows = rows[:0]
+		err := s.db.SelectContext(ctx, &rows, `
+		SELECT ts, ip, real_ip, key_id, token, series, mtype, old, new FROM audit
+		WHERE ($1 = '' OR name = $1 OR series = $1) AND starts_with(name, $2)
+			AND ts >= $3 AND ($4::timestamptz IS NULL OR ts <= $4)
+		ORDER BY ts, seq
+		LIMIT $5`, q.Metric, q.Prefix, q.From, to, limit)
+		return retryIfPgConnException(err)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]monitor.AuditRecord, 0, len(rows))
+	for _, row := range rows {
+		record := monitor.AuditRecord{
+			Time:   row.Time,
+			IP:     row.IP,
+			RealIP: row.RealIP,
+			KeyID:  row.KeyID,
+			Token:  row.Token,
+			ID:     row.Series,
+			MType:  row.MType,
+		}
+		if row.Old.Valid {
+			if err = json.Unmarshal([]byte(row.Old.String), &record.Old); err != nil {
+				return nil, err
+			}
+		}
+		if row.New.Valid {
+			if err = json.Unmarshal([]byte(row.New.String), &record.New); err != nil {
+				return nil, err
+			}
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// auditJSON encodes an audit value for a JSONB column, nil for NULL.
+func auditJSON(v *monitor.AuditValue) (any, error) {
+	if v == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+// Query iterates over the gauges and counters selected by the query. The
+// types, order and cursor are applied by the database, and so are the name
+// pattern and label matchers as far as they translate to SQL. Regular
+// expressions are not handed over, as the dialects of Go and Postgres differ,
+// only their literal prefixes are. The rows are filtered by the query again
+// on the way, being then fetched a page at a time until the limit is reached.
+func (s *DBStorage) Query(ctx context.Context, q monitor.Query) (monitor.MetricIterator, error) {
+	it := &dbIterator{s: s, ctx: ctx, q: q, limit: q.Limit, fetch: q.Limit}
+	noArg := func(any) string { return "" }
+	_, exact := matcherConds(q.Matchers, noArg)
+	if _, complete := q.NamePrefix(); !complete {
+		exact = false
+	}
+	if !exact && q.Limit > 0 && q.Limit < minQueryFetch {
+		it.fetch = minQueryFetch
+	}
+	if err := it.query(q.After); err != nil {
+		return nil, err
+	}
+	return it, nil
+}
+
+// minQueryFetch is the least number of rows fetched at a time when label
+// matchers drop rows past the database.
+const minQueryFetch = 100
+
+// queryRows selects the rows of the query that come after the cursor after,
+// if not nil, up to limit rows if positive.
+func (s *DBStorage) queryRows(ctx context.Context, q monitor.Query, after *monitor.Cursor, limit int) (*sql.Rows, error) {
+	var (
+		where []string
+		args  []any
+	)
+	arg := func(v any) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	types := q.Types
+	if len(types) == 0 {
+		types = []string{typeGauge, typeCounter}
+	}
+	where = append(where, "mtype = ANY("+arg(types)+")")
+	if prefix, _ := q.NamePrefix(); prefix != "" {
+		where = append(where, "name LIKE "+arg(likeEscaper.Replace(prefix)+"%"))
+	}
+	conds, _ := matcherConds(q.Matchers, arg)
+	where = append(where, conds...)
+
+	// Keys are ordered bytewise as in Go
+	columns := []string{`(name || labels) COLLATE "C"`, "mtype"}
+	var afterArgs []string
+	if after != nil {
+		afterArgs = []string{arg(after.Key), arg(after.Type)}
+	}
+	if q.SortBy == monitor.SortByValue {
+		columns = append([]string{"value"}, columns...)
+		if after != nil {
+			afterArgs = append([]string{arg(after.Value)}, afterArgs...)
+		}
+	}
+	if after != nil {
+		cmp := ">"
+		if q.Desc {
+			cmp = "<"
+		}
+		where = append(where, "("+strings.Join(columns, ", ")+") "+cmp+" ("+strings.Join(afterArgs, ", ")+")")
+	}
+
+	order := columns
+	if q.Desc {
+		order = make([]string, len(columns))
+		for i, column := range columns {
+			order[i] = column + " DESC"
+		}
+	}
+
+	query := `
+	SELECT mtype, name, labels, value, delta FROM (
+		SELECT 'gauge' AS mtype, name, labels, value, NULL::BIGINT AS delta FROM gauge
+		UNION ALL
+		SELECT 'counter', name, labels, value::DOUBLE PRECISION, value FROM counter
+	) metrics
+	WHERE ` + strings.Join(where, " AND ") + `
+	ORDER BY ` + strings.Join(order, ", ")
+	if limit > 0 {
+		query += " LIMIT " + arg(limit)
+	}
+
+	return s.db.QueryContext(ctx, query, args...)
+}
+
+// matcherConds translates the label matchers to SQL conditions, arg adding
+// their arguments. It tells whether the conditions select exactly what the
+// matchers do, the others narrowing the rows down only.
+func matcherConds(ms monitor.Matchers, arg func(any) string) (conds []string, exact bool) {
+	exact = true
+	for _, m := range ms {
+		switch {
+		case m.Name == monitor.NameLabel && m.Op == monitor.MatchEqual:
+			conds = append(conds, "name = "+arg(m.Value))
+		case m.Name == monitor.NameLabel && m.Op == monitor.MatchRegexp:
+			// The regular expression dialects of Go and Postgres differ, the
+			// names are narrowed down by the literal prefix only
+			prefix, complete := m.Prefix()
+			if prefix != "" {
+				conds = append(conds, "name LIKE "+arg(likeEscaper.Replace(prefix)+"%"))
+			}
+			exact = exact && complete
+		case m.Op == monitor.MatchEqual && m.Value != "":
+			// Labels are stored canonically, with quoted values (see
+			// monitor.Labels), so that the label is found by its text
+			// between a brace or comma and a comma or brace
+			label := m.Name + "=" + strconv.Quote(m.Value)
+			conds = append(conds, "strpos(',' || substr(labels, 2, length(labels) - 2) || ',', "+arg(","+label+",")+") > 0")
+		default:
+			exact = false
+		}
+	}
+	return conds, exact
+}
+
+// likeEscaper escapes the wildcards of LIKE patterns.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// dbIterator iterates over the rows of a query, filtering them by the label
+// matchers of the query. With a fetch size set, it fetches that many rows at
+// a time, each page starting after the last row of the previous one.
+type dbIterator struct {
+	s     *DBStorage
+	ctx   context.Context
+	q     monitor.Query
+	limit int
+	fetch int
+
+	rows    *sql.Rows
+	fetched int // rows of the current page
+	last    monitor.Cursor
+	n       int
+	metric  monitor.Metrics
+	err     error
+}
+
+// query fetches the page of rows after the cursor.
+func (it *dbIterator) query(after *monitor.Cursor) error {
+	rows, err := it.s.queryRows(it.ctx, it.q, after, it.fetch)
+	if err != nil {
+		return err
+	}
+	it.rows, it.fetched = rows, 0
+	return nil
+}
+
+func (it *dbIterator) Next() bool {
+	if it.err != nil || (it.limit > 0 && it.n >= it.limit) {
+		return false
+	}
+
+	for {
+		if !it.rows.Next() {
+			// A full page may be followed by more rows
+			if it.fetch <= 0 || it.fetched < it.fetch || it.rows.Err() != nil {
+				return false
+			}
+			if it.err = it.rows.Close(); it.err != nil {
+				return false
+			}
+			last := it.last
+			if it.err = it.query(&last); it.err != nil {
+				return false
+			}
+			continue
+		}
+		it.fetched++
+
+		var (
+			metric       monitor.Metrics
+			name, labels string
+			value        float64
+			delta        sql.NullInt64
+		)
+		if it.err = it.rows.Scan(&metric.MType, &name, &labels, &value, &delta); it.err != nil {
+			return false
+		}
+		it.last = monitor.Cursor{Value: value, Key: name + labels, Type: metric.MType}
+
+		if metric.ID, metric.Labels, it.err = monitor.ParseSeriesKey(name + labels); it.err != nil {
+			return false
+		}
+		if !it.q.Matches(metric.MType, metric.ID, metric.Labels) {
+			continue
+		}
+		if delta.Valid {
+			metric.Delta = &delta.Int64
+		} else {
+			metric.Value = &value
+		}
+
+		it.metric = metric
+		it.n++
+		return true
+	}
+}
+
+func (it *dbIterator) Metric() monitor.Metrics {
+	return it.metric
+}
+
+func (it *dbIterator) Err() error {
+	if it.err != nil {
+		return it.err
+	}
+	return it.rows.Err()
+}
+
+func (it *dbIterator) Close() error {
+	return it.rows.Close()
+}
+
+// Tables keeping a JSON document per series.
+const (
+	tableHistogram = "histogram"
+	tableSummary   = "summary"
+)
+
+// updateJSON replaces the JSON document of the series k in table with the
+// result of update, which receives the current document ({} for a new
+// series). The row stays locked in between.
+func (s *DBStorage) updateJSON(ctx context.Context, table, k string, update func([]byte) (any, error)) error {
+	return retry.Do(ctx, func(context.Context) error {
+		tx, err := s.db.BeginTxx(ctx, nil)
+		if err != nil {
+			return retryIfPgConnException(err)
+		}
+		defer tx.Rollback()
+
+		if err = updateJSONTx(ctx, tx, table, k, update); err != nil {
+			return retryIfPgConnException(err)
+		}
+		return retryIfPgConnException(tx.Commit())
+	})
+}
+
+// updateJSONTx is updateJSON within the transaction tx.
+func updateJSONTx(ctx context.Context, tx *sqlx.Tx, table, k string, update func([]byte) (any, error)) error {
+	name, labels := splitSeriesKey(k)
+
+	_, err := tx.ExecContext(ctx, `
+	INSERT INTO `+table+` (name, labels, data)
+	VALUES
+		($1, $2, '{}')
+	ON CONFLICT (name, labels) DO NOTHING`, name, labels)
+	if err != nil {
+		return err
+	}
+
+	var data []byte
+	err = tx.QueryRowContext(ctx, `
+	SELECT data FROM `+table+` WHERE name = $1 AND labels = $2 FOR UPDATE`, name, labels,
+	).Scan(&data)
+	if err != nil {
+		return err
+	}
+
+	updated, err := update(data)
+	if err != nil {
+		return err
+	}
+	if data, err = json.Marshal(updated); err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+	UPDATE `+table+` SET data = $3 WHERE name = $1 AND labels = $2`, name, labels, data)
+	return err
+}
+
+// changing wraps an update for updateJSON of documents of type T so that it
+// records the documents before and after in change, if not nil, as returned
+// by value.
+func changing[T any](update func([]byte) (any, error), change *monitor.Change, value func(*T) *monitor.AuditValue) func([]byte) (any, error) {
+	if change == nil {
+		return update
+	}
+	return func(data []byte) (any, error) {
+		change.Old = nil
+		// updateJSON starts new series with an empty document
+		if string(data) != "{}" {
+			var old T
+			if err := json.Unmarshal(data, &old); err != nil {
+				return nil, err
+			}
+			change.Old = value(&old)
+		}
+
+		updated, err := update(data)
+		if err != nil {
+			return nil, err
+		}
+		v, ok := updated.(T)
+		if !ok {
+			return nil, fmt.Errorf("unexpected update type %T", updated)
+		}
+		change.New = value(&v)
+		return updated, nil
+	}
+}
+
+// mergeHistogram returns an update for updateJSON merging v into the stored
+// histogram.
+func mergeHistogram(v monitor.Histogram) func([]byte) (any, error) {
+	return func(data []byte) (any, error) {
+		var h monitor.Histogram
+		if err := json.Unmarshal(data, &h); err != nil {
+			return nil, err
+		}
+		return h, h.Merge(v)
+	}
+}
+
+// mergeSummary returns an update for updateJSON adding the observations of v
+// to the stored summary.
+func mergeSummary(v monitor.Summary) func([]byte) (any, error) {
+	return func(data []byte) (any, error) {
+		var sum monitor.Summary
+		if err := json.Unmarshal(data, &sum); err != nil {
+			return nil, err
+		}
+		sum.Merge(v, monitor.SummaryWindow)
+		return sum, nil
+	}
+}
+
+// getJSON decodes the JSON document of the series k in table into v.
+func (s *DBStorage) getJSON(ctx context.Context, table, k string, v any) bool {
+	name, labels := splitSeriesKey(k)
+
+	var data []byte
+	err := retry.Do(ctx, func(context.Context) error {
+		err := s.db.QueryRowContext(ctx, `
+		SELECT data FROM `+table+` WHERE name = $1 AND labels = $2`, name, labels,
+		).Scan(&data)
+		return retryIfPgConnException(err)
+	})
+	if err != nil {
+		return false
+	}
+	return json.Unmarshal(data, v) == nil
+}
+
+// PingContext pings the underlying database.
+func (s *DBStorage) PingContext(ctx context.Context) error {
+	err := retry.Do(ctx, func(context.Context) error {
+		err := s.db.PingContext(ctx)
+		return retryIfPgConnException(err)
+	})
+
+	return err
+}
+
+// Close closes the connection to the underlying database and helper
+// statements.
+func (s *DBStorage) Close() error {
+	s.stmtSetGauge.Close()
+	s.stmtAddCounter.Close()
+	s.stmtGetGauge.Close()
+	s.stmtGetCounter.Close()
+	s.stmtStringGauge.Close()
+	s.stmtStringCounter.Close()
+	s.stmtAllGauge.Close()
+	s.stmtAllCounter.Close()
+	s.stmtGaugeHistory.Close()
+	s.stmtCounterHistory.Close()
+	return s.db.Close()
+}
+
+// splitSeriesKey splits a canonical series key into the metric name and
+// labels columns.
+func splitSeriesKey(k string) (name, labels string) {
+	if i := strings.IndexByte(k, '{'); i >= 0 {
+		return k[:i], k[i:]
+	}
+	return k, ""
+}
+
+func retryIfPgConnException(err error) error {
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) {
+			if pgerrcode.IsConnectionException(pgErr.Code) {
+				return retry.RetriableError(err)
+			}
+		}
+	}
+	return err
+}
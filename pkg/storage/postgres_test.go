@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"regexp"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	monitor "github.com/a-tho/monitor/internal"
+)
+
+func TestMatcherConds(t *testing.T) {
+	matcher := func(name string, op monitor.MatchOp, value string) monitor.LabelMatcher {
+		m, err := monitor.NewLabelMatcher(name, op, value)
+		require.NoError(t, err)
+		return m
+	}
+
+	tests := []struct {
+		name      string
+		matchers  monitor.Matchers
+		wantConds []string
+		wantArgs  []any
+		wantExact bool
+	}{
+		{name: "none", wantExact: true},
+		{
+			name:      "metric name",
+			matchers:  monitor.Matchers{matcher(monitor.NameLabel, monitor.MatchEqual, "load")},
+			wantConds: []string{"name = $1"},
+			wantArgs:  []any{"load"},
+			wantExact: true,
+		},
+		{
+			name:      "name prefix",
+			matchers:  monitor.Matchers{matcher(monitor.NameLabel, monitor.MatchRegexp, regexp.QuoteMeta("app_1.")+".*")},
+			wantConds: []string{"name LIKE $1"},
+			wantArgs:  []any{`app\_1.%`},
+			wantExact: true,
+		},
+		{
+			name:      "name pattern",
+			matchers:  monitor.Matchers{matcher(monitor.NameLabel, monitor.MatchRegexp, "cpu|mem")},
+			wantConds: nil,
+		},
+		{
+			name:      "name pattern with a prefix",
+			matchers:  monitor.Matchers{matcher(monitor.NameLabel, monitor.MatchRegexp, `cpu_(user|sys)\d+`)},
+			wantConds: []string{"name LIKE $1"},
+			wantArgs:  []any{`cpu\_%`},
+		},
+		{
+			name:      "label",
+			matchers:  monitor.Matchers{matcher("cpu", monitor.MatchEqual, `0"`)},
+			wantConds: []string{"strpos(',' || substr(labels, 2, length(labels) - 2) || ',', $1) > 0"},
+			wantArgs:  []any{`,cpu="0\"",`},
+			wantExact: true,
+		},
+		{
+			name: "left to go",
+			matchers: monitor.Matchers{
+				matcher("cpu", monitor.MatchEqual, ""),
+				matcher("host", monitor.MatchNotEqual, "web"),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var args []any
+			arg := func(v any) string {
+				args = append(args, v)
+				return "$" + strconv.Itoa(len(args))
+			}
+			conds, exact := matcherConds(tt.matchers, arg)
+			assert.Equal(t, tt.wantConds, conds)
+			assert.Equal(t, tt.wantArgs, args)
+			assert.Equal(t, tt.wantExact, exact)
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package storage
+
+import (
+	"sort"
+
+	monitor "github.com/a-tho/monitor/internal"
+)
+
+// sliceIterator iterates over metrics collected beforehand.
+type sliceIterator struct {
+	metrics []monitor.Metrics
+	next    int
+}
+
+func (it *sliceIterator) Next() bool {
+	if it.next >= len(it.metrics) {
+		return false
+	}
+	it.next++
+	return true
+}
+
+func (it *sliceIterator) Metric() monitor.Metrics {
+	return it.metrics[it.next-1]
+}
+
+func (it *sliceIterator) Err() error {
+	return nil
+}
+
+func (it *sliceIterator) Close() error {
+	return nil
+}
+
+// querySeries selects the metrics for the compiled query q among the gauges
+// and counters, ordering and paginating them.
+func querySeries(q monitor.Query, gauges map[string]monitor.Gauge, counters map[string]monitor.Counter) ([]monitor.Metrics, error) {
+	var (
+		metrics []monitor.Metrics
+		cursors []monitor.Cursor
+	)
+	add := func(typ, key string, m monitor.Metrics) error {
+		name, labels, err := monitor.ParseSeriesKey(key)
+		if err != nil || !q.Matches(typ, name, labels) {
+			return nil
+		}
+		m.ID, m.MType, m.Labels = name, typ, labels
+
+		c, err := monitor.CursorOf(m)
+		if err != nil {
+			return err
+		}
+		if q.After != nil && !q.Less(*q.After, c) {
+			return nil
+		}
+		metrics = append(metrics, m)
+		cursors = append(cursors, c)
+		return nil
+	}
+
+	for key, v := range gauges {
+		value := float64(v)
+		if err := add(typeGauge, key, monitor.Metrics{Value: &value}); err != nil {
+			return nil, err
+		}
+	}
+	for key, v := range counters {
+		delta := int64(v)
+		if err := add(typeCounter, key, monitor.Metrics{Delta: &delta}); err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Sort(byCursor{q: &q, metrics: metrics, cursors: cursors})
+	if q.Limit > 0 && len(metrics) > q.Limit {
+		metrics = metrics[:q.Limit]
+	}
+	return metrics, nil
+}
+
+// byCursor sorts metrics along with their cursors in the order of a query.
+type byCursor struct {
+	q       *monitor.Query
+	metrics []monitor.Metrics
+	cursors []monitor.Cursor
+}
+
+func (b byCursor) Len() int           { return len(b.metrics) }
+func (b byCursor) Less(i, j int) bool { return b.q.Less(b.cursors[i], b.cursors[j]) }
+func (b byCursor) Swap(i, j int) {
+	b.metrics[i], b.metrics[j] = b.metrics[j], b.metrics[i]
+	b.cursors[i], b.cursors[j] = b.cursors[j], b.cursors[i]
+}
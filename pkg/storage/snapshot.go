@@ -0,0 +1,122 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/a-tho/monitor/internal/rotate"
+)
+
+// ErrRestore is returned when previously saved metrics exist but cannot be
+// loaded. New does not fall back to other storages on such an error, as that
+// would silently start the server with no data.
+var ErrRestore = errors.New("failed to restore metrics")
+
+// snapshot is the content of a snapshot file. Seq is the sequence number of
+// the last log record the snapshot includes.
+type snapshot struct {
+	*MemStorage
+	Seq uint64
+}
+
+// writeSnapshot writes the snapshot to the snapshot file and to a new
+// timestamped copy next to it, keeping only the kept most recent copies.
+func writeSnapshot(path string, snap snapshot, kept int) error {
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+
+	if kept > 0 {
+		if err = writeFileAtomic(rotate.Name(path, time.Now()), data); err != nil {
+			return err
+		}
+	}
+	if err = writeFileAtomic(path, data); err != nil {
+		return err
+	}
+
+	return rotate.RemoveOld(path, kept)
+}
+
+// writeFileAtomic writes data to a temporary file, syncs it and renames it to
+// path, so that path holds either the previous or the new content even if the
+// process crashes midway.
+func writeFileAtomic(path string, data []byte) error {
+	dir, base := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+
+	tmp, err := os.CreateTemp(dir, base+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(tmp.Name(), 0o644); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	// Make the rename itself durable
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// snapshotPath resolves which names a snapshot of the file at path: either
+// the timestamp suffix of a rotated copy or a file path.
+func snapshotPath(path, which string) (string, error) {
+	if rotate.IsSuffix(which) {
+		which = path + "." + which
+	}
+
+	if _, err := os.Stat(which); err != nil {
+		snapshots, _ := rotate.List(path)
+		return "", fmt.Errorf("%w: snapshot %s: %w (available: %s)",
+			ErrRestore, which, err, strings.Join(snapshots, ", "))
+	}
+	return which, nil
+}
+
+// readSnapshot loads the snapshot file at path into snap. A missing or empty
+// file leaves snap untouched, as there is nothing to restore yet.
+func readSnapshot(path string, snap *snapshot) error {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrRestore, err)
+	}
+	defer file.Close()
+
+	dec := json.NewDecoder(file)
+	if err = dec.Decode(snap); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("%w: snapshot %s: %w", ErrRestore, path, err)
+	}
+	return nil
+}
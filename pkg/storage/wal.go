@@ -0,0 +1,174 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	monitor "github.com/a-tho/monitor/internal"
+)
+
+// walCompactSize is the log size in bytes past which the log is compacted
+// right away instead of waiting for the store interval.
+const walCompactSize = 16 << 20
+
+// walOpDelete marks a log record that deletes the series of its metrics
+// rather than updating them.
+const walOpDelete = "delete"
+
+const (
+	typeGauge     = "gauge"
+	typeCounter   = "counter"
+	typeHistogram = "histogram"
+	typeSummary   = "summary"
+)
+
+// wal is an append-only log of metric updates. Each record takes a line made
+// of the hex CRC-32 checksum of the JSON-encoded record, a space and the
+// record itself, so a record torn by a crash is detected and dropped on
+// replay.
+type wal struct {
+	file *os.File
+	size int64  // bytes of whole records in the file
+	seq  uint64 // sequence number of the last record
+}
+
+type walRecord struct {
+	Seq     uint64             `json:"seq"`
+	Time    time.Time          `json:"time"`
+	Op      string             `json:"op,omitempty"` // empty for updates
+	Metrics []*monitor.Metrics `json:"metrics"`
+	Key     string             `json:"key,omitempty"` // idempotency key of the updates
+}
+
+var errWALChecksum = errors.New("write-ahead log: checksum mismatch")
+
+func openWAL(path string) (*wal, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &wal{file: file}, nil
+}
+
+// append writes the record to the log under the next sequence number,
+// syncing it to disk if sync is set.
+func (l *wal) append(r walRecord, sync bool) error {
+	r.Seq = l.seq + 1
+	rec, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	line := make([]byte, 0, crc32.Size*2+1+len(rec)+1)
+	line = fmt.Appendf(line, "%08x ", crc32.ChecksumIEEE(rec))
+	line = append(line, rec...)
+	line = append(line, '\n')
+
+	n, err := l.file.Write(line)
+	if err == nil && sync {
+		err = l.file.Sync()
+	}
+	if err != nil {
+		// Cut off whatever part of the record made it into the file so that
+		// the following records are not appended to a torn one
+		if n > 0 {
+			_ = l.file.Truncate(l.size)
+		}
+		return err
+	}
+
+	l.size += int64(n)
+	l.seq++
+	return nil
+}
+
+// replay reads the log from the beginning and passes every record following
+// the after sequence number to apply. Reading stops at the first torn or
+// corrupted record, which can only be the last one written before a crash.
+func (l *wal) replay(after uint64, apply func(walRecord)) (int, error) {
+	if _, err := l.file.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	var (
+		r        = bufio.NewReader(l.file)
+		replayed int
+		size     int64
+	)
+	for {
+		line, err := r.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(line) > 0 {
+				log.Warn().Int64("offset", size).Msg("Dropped torn write-ahead log record")
+			}
+			break
+		}
+		if err != nil {
+			return replayed, err
+		}
+
+		rec, err := decodeWALRecord(line)
+		if err != nil {
+			log.Warn().Err(err).Int64("offset", size).Msg("Dropped write-ahead log tail")
+			break
+		}
+		size += int64(len(line))
+		l.seq = rec.Seq
+
+		if rec.Seq <= after {
+			continue
+		}
+		apply(rec)
+		replayed++
+	}
+
+	// Drop what could not be replayed so that new records follow whole ones
+	if err := l.file.Truncate(size); err != nil {
+		return replayed, err
+	}
+	l.size = size
+
+	return replayed, nil
+}
+
+func decodeWALRecord(line []byte) (walRecord, error) {
+	var rec walRecord
+
+	sumHex, body, ok := bytes.Cut(bytes.TrimSuffix(line, []byte{'\n'}), []byte{' '})
+	if !ok {
+		return rec, errWALChecksum
+	}
+	sum, err := strconv.ParseUint(string(sumHex), 16, 32)
+	if err != nil || uint32(sum) != crc32.ChecksumIEEE(body) {
+		return rec, errWALChecksum
+	}
+
+	err = json.Unmarshal(body, &rec)
+	return rec, err
+}
+
+// truncate empties the log once its records are in the snapshot.
+func (l *wal) truncate() error {
+	if err := l.file.Truncate(0); err != nil {
+		return err
+	}
+	if err := l.file.Sync(); err != nil {
+		return err
+	}
+	l.size = 0
+	return nil
+}
+
+func (l *wal) Close() error {
+	return l.file.Close()
+}
@@ -0,0 +1,151 @@
+// Package stream implements an in-process hub that fans accepted metric
+// updates out to subscribers.
+package stream
+
+import (
+	"path"
+	"sync"
+	"sync/atomic"
+
+	monitor "github.com/a-tho/monitor/internal"
+)
+
+// DefaultBuffer is the number of updates buffered per subscriber unless
+// configured otherwise.
+const DefaultBuffer = 256
+
+// A Filter selects the updates a subscriber receives. The zero Filter
+// selects every update.
+type Filter struct {
+	// Types are the metric types to receive, all of them if empty.
+	Types []string
+	// Name is a glob pattern (see path.Match) the metric name must match,
+	// any name if empty.
+	Name string
+}
+
+// Validate checks the name pattern.
+func (f Filter) Validate() error {
+	_, err := path.Match(f.Name, "")
+	return err
+}
+
+// Matches tells whether the update passes the filter.
+func (f Filter) Matches(m *monitor.Metrics) bool {
+	if len(f.Types) > 0 {
+		found := false
+		for _, typ := range f.Types {
+			if typ == m.MType {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if f.Name == "" {
+		return true
+	}
+	ok, _ := path.Match(f.Name, m.ID)
+	return ok
+}
+
+// A Hub delivers published updates to its subscribers. Publishing never
+// blocks: a subscriber whose buffer is full misses the updates until it
+// catches up.
+type Hub struct {
+	m      sync.RWMutex
+	subs   map[*Subscription]struct{}
+	closed bool
+}
+
+// NewHub returns a hub with no subscribers.
+func NewHub() *Hub {
+	return &Hub{subs: make(map[*Subscription]struct{})}
+}
+
+// A Subscription receives the updates passing its filter on C until it is
+// closed.
+type Subscription struct {
+	C <-chan monitor.Metrics
+
+	c       chan monitor.Metrics
+	filter  Filter
+	hub     *Hub
+	dropped atomic.Uint64
+	once    sync.Once
+}
+
+// Subscribe registers a subscriber buffering up to buffer updates,
+// DefaultBuffer if buffer is not positive. Once the hub is closed, the
+// subscription comes closed.
+func (h *Hub) Subscribe(filter Filter, buffer int) *Subscription {
+	if buffer <= 0 {
+		buffer = DefaultBuffer
+	}
+	c := make(chan monitor.Metrics, buffer)
+	sub := &Subscription{C: c, c: c, filter: filter, hub: h}
+
+	h.m.Lock()
+	closed := h.closed
+	if !closed {
+		h.subs[sub] = struct{}{}
+	}
+	h.m.Unlock()
+
+	if closed {
+		sub.once.Do(func() { close(sub.c) })
+	}
+	return sub
+}
+
+// Close closes every subscription, which lets streaming clients go on
+// shutdown.
+func (h *Hub) Close() {
+	h.m.Lock()
+	subs := h.subs
+	h.subs = make(map[*Subscription]struct{})
+	h.closed = true
+	h.m.Unlock()
+
+	for sub := range subs {
+		sub.once.Do(func() { close(sub.c) })
+	}
+}
+
+// Publish delivers the updates to the subscribers whose filters they pass.
+func (h *Hub) Publish(metrics ...*monitor.Metrics) {
+	h.m.RLock()
+	defer h.m.RUnlock()
+
+	for sub := range h.subs {
+		for _, m := range metrics {
+			if !sub.filter.Matches(m) {
+				continue
+			}
+			select {
+			case sub.c <- *m:
+			default:
+				sub.dropped.Add(1)
+			}
+		}
+	}
+}
+
+// Dropped returns the number of updates missed because the buffer was full,
+// resetting it.
+func (s *Subscription) Dropped() uint64 {
+	return s.dropped.Swap(0)
+}
+
+// Close unregisters the subscriber and closes C.
+func (s *Subscription) Close() {
+	s.once.Do(func() {
+		s.hub.m.Lock()
+		delete(s.hub.subs, s)
+		s.hub.m.Unlock()
+
+		close(s.c)
+	})
+}
@@ -0,0 +1,65 @@
+package stream
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	monitor "github.com/a-tho/monitor/internal"
+)
+
+func TestHubPublish(t *testing.T) {
+	hub := NewHub()
+	all := hub.Subscribe(Filter{}, 0)
+	defer all.Close()
+	cpu := hub.Subscribe(Filter{Types: []string{"gauge"}, Name: "CPU*"}, 0)
+	defer cpu.Close()
+
+	value, delta := 1.0, int64(2)
+	hub.Publish(
+		&monitor.Metrics{ID: "CPUutilization", MType: "gauge", Value: &value},
+		&monitor.Metrics{ID: "CPUcount", MType: "counter", Delta: &delta},
+		&monitor.Metrics{ID: "Alloc", MType: "gauge", Value: &value},
+	)
+
+	assert.Len(t, all.C, 3)
+	require.Len(t, cpu.C, 1)
+	assert.Equal(t, "CPUutilization", (<-cpu.C).ID)
+}
+
+func TestHubSlowSubscriber(t *testing.T) {
+	hub := NewHub()
+	sub := hub.Subscribe(Filter{}, 2)
+
+	value := 1.0
+	for i := 0; i < 5; i++ {
+		hub.Publish(&monitor.Metrics{ID: "Alloc", MType: "gauge", Value: &value})
+	}
+	assert.Len(t, sub.C, 2)
+	assert.Equal(t, uint64(3), sub.Dropped())
+	assert.Equal(t, uint64(0), sub.Dropped())
+
+	sub.Close()
+	sub.Close()
+	hub.Publish(&monitor.Metrics{ID: "Alloc", MType: "gauge", Value: &value})
+	_, ok := <-sub.C
+	assert.True(t, ok, "buffered updates are still delivered")
+}
+
+func TestHubClose(t *testing.T) {
+	hub := NewHub()
+	sub := hub.Subscribe(Filter{}, 0)
+
+	hub.Close()
+	_, ok := <-sub.C
+	assert.False(t, ok)
+	sub.Close()
+
+	late := hub.Subscribe(Filter{}, 0)
+	_, ok = <-late.C
+	assert.False(t, ok)
+
+	value := 1.0
+	hub.Publish(&monitor.Metrics{ID: "Alloc", MType: "gauge", Value: &value})
+}
@@ -3,6 +3,7 @@ package telemetry
 import (
 	"math/rand"
 	"runtime"
+	"time"
 
 	monitor "github.com/a-tho/monitor/internal"
 )
@@ -43,4 +44,21 @@ func (o *Observer) poll(pollCount int) {
 
 	randomValue := rand.Float64()
 	o.polled[countSinceReport].Gauges["RandomValue"] = monitor.Gauge(randomValue)
+
+	o.observeGCPauses(&memStats)
+}
+
+// observeGCPauses adds the pauses of the GC cycles completed since the
+// previous poll to the GC pause histogram. Only the most recent
+// len(PauseNs) pauses are available.
+func (o *Observer) observeGCPauses(memStats *runtime.MemStats) {
+	n := memStats.NumGC - o.numGC
+	if n > uint32(len(memStats.PauseNs)) {
+		n = uint32(len(memStats.PauseNs))
+	}
+	for i := uint32(0); i < n; i++ {
+		pause := memStats.PauseNs[(memStats.NumGC-i+255)%256]
+		o.gcPause.Observe(time.Duration(pause).Seconds())
+	}
+	o.numGC = memStats.NumGC
 }
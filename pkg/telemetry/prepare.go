@@ -54,12 +54,21 @@ func (o *Observer) prepare(ctx context.Context, toReport chan<- []*monitor.Metri
 	}
 	for i, util := range cpuUtils {
 		util := util
-		id := "CPUutilization" + strconv.Itoa(i)
+		labels := monitor.Labels{"cpu": strconv.Itoa(i)}
 		metrics = append(metrics,
-			&monitor.Metrics{ID: id, MType: server.GaugePath, Value: &util},
+			&monitor.Metrics{ID: "CPUutilization", MType: server.GaugePath, Value: &util, Labels: labels},
 		)
 	}
 
+	// Add GC pause distribution (histogram)
+	if o.gcPause.Count > 0 {
+		gcPause := *o.gcPause
+		metrics = append(metrics,
+			&monitor.Metrics{ID: "GCPause", MType: server.HistogramPath, Histogram: &gcPause},
+		)
+		o.gcPause = monitor.NewHistogram(gcPause.Buckets)
+	}
+
 	// Send prepared metrics batch to worker pool
 	toReport <- metrics
 
@@ -4,17 +4,22 @@ import (
 	"bytes"
 	"compress/gzip"
 	"context"
-	"crypto/hmac"
-	"crypto/sha256"
+	"crypto/rand"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net"
+	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/go-resty/resty/v2"
 
 	monitor "github.com/a-tho/monitor/internal"
+	"github.com/a-tho/monitor/pkg/encryption"
+	mw "github.com/a-tho/monitor/pkg/middleware"
 	"github.com/a-tho/monitor/pkg/retry"
 	"github.com/a-tho/monitor/pkg/server"
 )
@@ -24,7 +29,7 @@ const (
 	contentType         = "Content-Type"
 	encodingGzip        = "gzip"
 	typeApplicationJSON = "application/json"
-	bodySignature       = "HashSHA256"
+	retryAfterHeader    = "Retry-After"
 )
 
 func (o Observer) report(ctx context.Context, metrics <-chan []*monitor.Metrics) {
@@ -38,7 +43,7 @@ func (o Observer) report(ctx context.Context, metrics <-chan []*monitor.Metrics)
 				return // no more work to be performed
 			}
 			// Prepare request url
-			url := fmt.Sprintf("http://%s/%s/", o.SrvAddr, server.UpdsPath)
+			url := fmt.Sprintf("%s://%s/%s/", o.scheme(), o.SrvAddr, server.UpdsPath)
 			// Prepare request body
 			buf.Reset()
 			compressBuf.Reset(&buf)
@@ -48,24 +53,56 @@ func (o Observer) report(ctx context.Context, metrics <-chan []*monitor.Metrics)
 			}
 			compressBuf.Close()
 
+			// The same key goes with every retry so that the server applies
+			// the batch once
+			batchKey, err := randomKey()
+			if err != nil {
+				continue
+			}
+
+			// Encrypt after compressing, the ciphertext would not compress
+			body := buf.Bytes()
+			if o.PublicKey != nil {
+				if body, err = encryption.Encrypt(o.PublicKey, body); err != nil {
+					continue
+				}
+			}
+
 			// Prepare and send request
 			_ = retry.Do(ctx, func(context.Context) error {
 				client := resty.New()
-				body := buf.Bytes()
+				if o.TLSConfig != nil {
+					client.SetTLSClientConfig(o.TLSConfig)
+				}
 				req := client.R().
 					SetBody(body).
 					SetHeader(contentEncoding, encodingGzip).
 					SetHeader(contentType, typeApplicationJSON).
+					SetHeader(server.IdempotencyKeyHeader, batchKey).
 					SetContext(ctx)
+				if o.PublicKey != nil {
+					req.SetHeader(encryption.Header, encryption.Scheme)
+				}
+				if o.Token != "" {
+					req.SetAuthToken(o.Token)
+				}
+				if ip := o.localIP(); ip != nil {
+					req.SetHeader(mw.RealIPHeader, ip.String())
+				}
 
-				// sign request body if necessary
+				// sign request body if necessary, stamped afresh on every
+				// attempt
 				if len(o.signKey) > 0 {
-					req.SetHeader(bodySignature, o.signature(body))
+					if err := o.sign(req, body); err != nil {
+						return err
+					}
 				}
 
-				_, err := req.Post(url)
-
-				return o.retryIfNetError(err)
+				resp, err := req.Post(url)
+				if err != nil {
+					return o.retryIfNetError(err)
+				}
+				return retryIfBusy(resp)
 			})
 		case <-ctx.Done():
 			return
@@ -73,11 +110,84 @@ func (o Observer) report(ctx context.Context, metrics <-chan []*monitor.Metrics)
 	}
 }
 
-func (o Observer) signature(body []byte) string {
-	hash := hmac.New(sha256.New, o.signKey)
-	hash.Write(body)
-	sum := hash.Sum(nil)
-	return base64.StdEncoding.EncodeToString(sum)
+// scheme returns the scheme of the server urls.
+func (o Observer) scheme() string {
+	if o.TLSConfig != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// localIP returns the address the agent reaches the server from, nil if the
+// server cannot be reached.
+func (o Observer) localIP() net.IP {
+	// Nothing is sent over UDP until written to
+	conn, err := net.Dial("udp", o.SrvAddr)
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP
+}
+
+// randomKey returns a random key, for batch idempotency keys and nonces.
+func randomKey() (string, error) {
+	var key [16]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(key[:]), nil
+}
+
+// sign stamps the request with the time and a nonce and signs them along with
+// the body.
+func (o Observer) sign(req *resty.Request, body []byte) error {
+	nonce, err := randomKey()
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	sum := mw.Sign(o.signKey, timestamp, nonce, body)
+
+	req.SetHeader(mw.SignatureHeader, base64.StdEncoding.EncodeToString(sum))
+	req.SetHeader(mw.TimestampHeader, timestamp)
+	req.SetHeader(mw.NonceHeader, nonce)
+	if o.KeyID != "" {
+		req.SetHeader(mw.KeyIDHeader, o.KeyID)
+	}
+	return nil
+}
+
+// retryIfBusy returns a retriable error if the server could not take the
+// batch yet: it is still applying it (409) or is unavailable (503). The retry
+// waits as long as the Retry-After header asks, if it does.
+func retryIfBusy(resp *resty.Response) error {
+	switch status := resp.StatusCode(); {
+	case status == http.StatusConflict || status == http.StatusServiceUnavailable:
+		err := fmt.Errorf("server responded %s", resp.Status())
+		return retry.RetriableAfter(err, retryAfter(resp.Header().Get(retryAfterHeader)))
+	case resp.IsError():
+		return fmt.Errorf("server responded %s", resp.Status())
+	}
+	return nil
+}
+
+// retryAfter returns the wait a Retry-After header value asks for, given in
+// seconds or as a date, 0 if there is none.
+func retryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if sec, err := strconv.Atoi(v); err == nil {
+		if sec < 0 {
+			return 0
+		}
+		return time.Duration(sec) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t)
+	}
+	return 0
 }
 
 func (o Observer) retryIfNetError(err error) error {
@@ -0,0 +1,53 @@
+package telemetry
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	monitor "github.com/a-tho/monitor/internal"
+	"github.com/a-tho/monitor/pkg/server"
+)
+
+func TestReportRetriesBusyBatch(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		keys []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		keys = append(keys, r.Header.Get(server.IdempotencyKeyHeader))
+		attempt := len(keys)
+		mu.Unlock()
+
+		// The batch is still being applied on the first attempt
+		if attempt == 1 {
+			w.Header().Set(retryAfterHeader, "1")
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	o, err := NewObserver(strings.TrimPrefix(srv.URL, "http://"), 1, 1, "", 1, nil)
+	assert.NoError(t, err)
+
+	value := 1.0
+	metrics := make(chan []*monitor.Metrics, 1)
+	metrics <- []*monitor.Metrics{{ID: "Alloc", MType: "gauge", Value: &value}}
+	close(metrics)
+	o.report(context.Background(), metrics)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if assert.Len(t, keys, 2) {
+		assert.NotEmpty(t, keys[0])
+		assert.Equal(t, keys[0], keys[1], "every attempt carries the same idempotency key")
+	}
+}
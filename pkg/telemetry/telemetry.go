@@ -3,10 +3,12 @@ package telemetry
 
 import (
 	"context"
-	"encoding/base64"
+	"crypto/rsa"
+	"crypto/tls"
 	"time"
 
 	monitor "github.com/a-tho/monitor/internal"
+	mw "github.com/a-tho/monitor/pkg/middleware"
 )
 
 const (
@@ -15,7 +17,16 @@ const (
 
 // An Observer is used to collect and transmit metrics.
 type Observer struct {
-	SrvAddr        string
+	SrvAddr string
+	// TLSConfig makes the observer report over https when not nil
+	TLSConfig *tls.Config
+	// PublicKey makes the observer encrypt the batches when not nil
+	PublicKey *rsa.PublicKey
+	// KeyID names the key the observer signs with, the server's primary key
+	// if empty
+	KeyID string
+	// Token is the bearer token sent along with the batches, if any
+	Token          string
 	pollInterval   time.Duration
 	reportStep     int
 	reportInterval time.Duration
@@ -24,6 +35,11 @@ type Observer struct {
 
 	// local storage for the polled metrics that have not been reported yet
 	polled []MetricInstance
+
+	// GC pauses observed since the last report, and the number of GC cycles
+	// seen so far
+	gcPause *monitor.Histogram
+	numGC   uint32
 }
 
 // A MetricInstance holds a set of metrics collected roughly at the same moment
@@ -32,11 +48,14 @@ type MetricInstance struct {
 	Gauges map[string]monitor.Gauge
 }
 
-// NewObserver returns an initialized observer.
-func NewObserver(srvAddr string, pollInterval, reportStep int, signKeyStr string, rateLimit int) *Observer {
-	signKey, err := base64.StdEncoding.DecodeString(signKeyStr)
+// NewObserver returns an initialized observer. GC pause durations are
+// reported as a histogram with the bucket upper bounds buckets (in seconds),
+// or monitor.DefaultBuckets if empty. A signing key that is not base64 is an
+// error, as it is on the server.
+func NewObserver(srvAddr string, pollInterval, reportStep int, signKeyStr string, rateLimit int, buckets []float64) (*Observer, error) {
+	signKey, err := mw.ParseKey(signKeyStr)
 	if err != nil {
-		signKey = []byte{}
+		return nil, err
 	}
 
 	obs := Observer{
@@ -48,10 +67,14 @@ func NewObserver(srvAddr string, pollInterval, reportStep int, signKeyStr string
 		signKey:        signKey,
 		rateLimit:      rateLimit,
 	}
+	if len(buckets) == 0 {
+		buckets = monitor.DefaultBuckets()
+	}
+	obs.gcPause = monitor.NewHistogram(buckets)
 	for i := range obs.polled {
 		obs.polled[i].Gauges = make(map[string]monitor.Gauge)
 	}
-	return &obs
+	return &obs, nil
 }
 
 // Observe collects and transmit metrics.
@@ -0,0 +1,149 @@
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// issuer is a certificate along with its key, able to sign other ones when
+// it is an authority.
+type issuer struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// issue creates a certificate named name signed by parent, or self-signed if
+// parent is nil, and writes it and its key to dir as name.pem and name.key.
+func issue(t *testing.T, dir, name string, parent *issuer, tmpl *x509.Certificate) *issuer {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+	tmpl.SerialNumber = serial
+	tmpl.Subject = pkix.Name{CommonName: name}
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+
+	signer := &issuer{cert: tmpl, key: key}
+	if parent != nil {
+		signer = parent
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer.cert, &key.PublicKey, signer.key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name+".pem"),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name+".key"),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+
+	return &issuer{cert: cert, key: key}
+}
+
+// generate writes an authority, a server and a client certificate to dir, and
+// another authority unrelated to them.
+func generate(t *testing.T, dir string) {
+	t.Helper()
+
+	ca := issue(t, dir, "ca", nil, &x509.Certificate{
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	})
+	issue(t, dir, "other-ca", nil, &x509.Certificate{
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	})
+	issue(t, dir, "server", ca, &x509.Certificate{
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	issue(t, dir, "client", ca, &x509.Certificate{
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+}
+
+func TestTLS(t *testing.T) {
+	dir := t.TempDir()
+	generate(t, dir)
+	file := func(name string) string {
+		if name == "" {
+			return ""
+		}
+		return filepath.Join(dir, name)
+	}
+
+	tests := []struct {
+		name     string
+		clientCA string // server side
+		ca       string // client side
+		cert     string
+		key      string
+		wantErr  bool
+	}{
+		{name: "tls", ca: "ca.pem"},
+		{name: "mutual tls", clientCA: "ca.pem", ca: "ca.pem", cert: "client.pem", key: "client.key"},
+		{name: "unknown server authority", ca: "other-ca.pem", wantErr: true},
+		{name: "no client certificate", clientCA: "ca.pem", ca: "ca.pem", wantErr: true},
+		{name: "unknown client authority", clientCA: "other-ca.pem", ca: "ca.pem", cert: "client.pem", key: "client.key", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srvCfg, err := Server(file("server.pem"), file("server.key"), file(tt.clientCA))
+			require.NoError(t, err)
+			srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			srv.TLS = srvCfg
+			srv.StartTLS()
+			defer srv.Close()
+
+			clientCfg, err := Client(file(tt.ca), file(tt.cert), file(tt.key))
+			require.NoError(t, err)
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientCfg}}
+
+			resp, err := client.Get(srv.URL)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+		})
+	}
+}
+
+func TestLoadPool(t *testing.T) {
+	dir := t.TempDir()
+	empty := filepath.Join(dir, "empty.pem")
+	require.NoError(t, os.WriteFile(empty, nil, 0o600))
+
+	_, err := Client(empty, "", "")
+	assert.ErrorIs(t, err, ErrNoCertificates)
+
+	_, err = Client(filepath.Join(dir, "missing.pem"), "", "")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}